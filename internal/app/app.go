@@ -4,6 +4,8 @@ import "context"
 
 type KeywordRepository interface {
 	Increment(ctx context.Context, keyword string, increment int) error
+	// IncrementAll may count some of the keywords even when it fails.
+	IncrementAll(ctx context.Context, increments map[string]int) error
 	Find(ctx context.Context, keyword string) (int, error)
 }
 
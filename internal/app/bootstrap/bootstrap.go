@@ -6,6 +6,8 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 
 	v1 "emag-homework/gen/proto/go/api/v1"
 	"emag-homework/internal/app"
@@ -21,6 +23,7 @@ import (
 const (
 	appAddressEnv = "APP_ADDRESS"
 	dbAddressEnv  = "DB_ADDRESS"
+	dbCRDTEnv     = "DB_CRDT"
 )
 
 func Bootstrap() error {
@@ -46,12 +49,28 @@ func Bootstrap() error {
 		return err
 	}
 
-	db, err := dbclient.New(dbAddress)
+	// the controllers of the db, comma separated
+	dbAddresses := strings.Split(dbAddress, ",")
+
+	db, err := dbclient.New(dbAddresses[0], dbclient.WithControllers(dbAddresses[1:]...))
 	if err != nil {
 		return fmt.Errorf("failed to connected to db %q: %w", dbAddress, err)
 	}
 
-	repository := keyword.NewRepository(db)
+	var repoOpts []keyword.Option
+
+	if v := os.Getenv(dbCRDTEnv); v != "" {
+		crdt, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q: %w", dbCRDTEnv, err)
+		}
+
+		if crdt {
+			repoOpts = append(repoOpts, keyword.WithCRDT())
+		}
+	}
+
+	repository := keyword.NewRepository(db, repoOpts...)
 	counter := keyword.NewCounter()
 	srv := server.NewAppServer(repository, counter, logger)
 
@@ -12,17 +12,43 @@ import (
 var ErrNotFound = errors.New("not found")
 
 type DB interface {
-	Get(ctx context.Context, key string) ([]byte, error)
-	Put(ctx context.Context, key string, value []byte) error
+	Get(ctx context.Context, key string, opts ...dbclient.CallOption) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte, opts ...dbclient.CallOption) error
+	Increment(ctx context.Context, key string, delta int64, opts ...dbclient.CallOption) (int64, error)
+	IncrementCounter(ctx context.Context, key string, delta int64, opts ...dbclient.CallOption) (int64, error)
+	Counter(ctx context.Context, key string, opts ...dbclient.CallOption) (int64, error)
+	Batch(ctx context.Context, b *dbclient.Batch, opts ...dbclient.CallOption) error
 }
 
+type Config struct {
+	CRDT bool
+}
+
+type Option func(cfg *Config)
+
 type Repository struct {
-	db DB
+	db   DB
+	crdt bool
 }
 
-func NewRepository(db DB) *Repository {
+func NewRepository(db DB, opts ...Option) *Repository {
+	cfg := &Config{}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
 	return &Repository{
-		db: db,
+		db:   db,
+		crdt: cfg.CRDT,
+	}
+}
+
+// WithCRDT keeps the counts in PN-counters, so the replicas converge on the
+// same counts after a partition.
+func WithCRDT() Option {
+	return func(cfg *Config) {
+		cfg.CRDT = true
 	}
 }
 
@@ -32,15 +58,37 @@ func (r *Repository) Increment(ctx context.Context, keyword string, increment in
 		return fmt.Errorf("failed cleaning up the text: %w", err)
 	}
 
-	v, err := r.Find(ctx, keyword)
-	if err != nil {
-		fmt.Println(err)
-		if !errors.Is(err, dbclient.ErrNotFound) {
-			return err
+	if r.crdt {
+		_, err = r.db.IncrementCounter(ctx, keyword, int64(increment))
+
+		return err
+	}
+
+	_, err = r.db.Increment(ctx, keyword, int64(increment))
+
+	return err
+}
+
+// IncrementAll increments every keyword with a single batch. The batch is
+// atomic on every node, not across them: when it fails, the keywords of some
+// nodes may be counted already, so retrying it may count them twice.
+func (r *Repository) IncrementAll(ctx context.Context, increments map[string]int) error {
+	b := dbclient.NewBatch()
+
+	for keyword, increment := range increments {
+		keyword, err := clean(keyword)
+		if err != nil {
+			return fmt.Errorf("failed cleaning up the text: %w", err)
+		}
+
+		if r.crdt {
+			b.IncrementCounter(keyword, int64(increment))
+		} else {
+			b.Increment(keyword, int64(increment))
 		}
 	}
 
-	return r.db.Put(ctx, keyword, []byte(fmt.Sprint(v+increment)))
+	return r.db.Batch(ctx, b)
 }
 
 func (r *Repository) Find(ctx context.Context, keyword string) (int, error) {
@@ -49,6 +97,12 @@ func (r *Repository) Find(ctx context.Context, keyword string) (int, error) {
 		return 0, fmt.Errorf("failed cleaning up the text: %w", err)
 	}
 
+	if r.crdt {
+		v, err := r.db.Counter(ctx, keyword)
+
+		return int(v), err
+	}
+
 	b, err := r.db.Get(ctx, keyword)
 	if err != nil {
 		return 0, err
@@ -81,6 +135,17 @@ func (r *InMemRepository) Increment(_ context.Context, keyword string, increment
 	return nil
 }
 
+func (r *InMemRepository) IncrementAll(_ context.Context, increments map[string]int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for keyword, increment := range increments {
+		r.data[keyword] += increment
+	}
+
+	return nil
+}
+
 func (r *InMemRepository) Find(_ context.Context, keyword string) (int, error) {
 	r.mu.RLock()
 	defer r.mu.RLock()
@@ -48,13 +48,16 @@ func (s *AppServer) Save(ctx context.Context, req *v1.SaveRequest) (*v1.SaveResp
 		Keywords: make(map[string]int32),
 	}
 
-	for k, count := range keywordCounters {
-		if err := s.repository.Increment(ctx, k, count); err != nil {
-			s.logger.Error("failed to increment %q occurences", k)
+	// some keywords may be counted despite the error, the text is not saved
+	// again so none of them is counted twice
+	if err := s.repository.IncrementAll(ctx, keywordCounters); err != nil {
+		s.logger.Error("failed to increment the occurences of %d keyword(s), some may be counted: %v",
+			len(keywordCounters), err)
 
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("keywords may be partially counted: %v", err))
+	}
 
+	for k, count := range keywordCounters {
 		res.Keywords[k] = int32(count)
 
 		s.logger.Info("keyword %q occurs %d time(s)", k, count)
@@ -6,18 +6,42 @@ import (
 	"emag-homework/internal/db/api/v1"
 	"emag-homework/internal/db/controller/healthz"
 	"emag-homework/internal/db/controller/node"
+	"emag-homework/internal/db/controller/redirect"
 	"emag-homework/internal/db/controller/server"
 	"emag-homework/internal/db/controller/service"
+	"emag-homework/internal/db/hlc"
+	"emag-homework/internal/db/raft"
+	"emag-homework/internal/db/store"
 	"emag-homework/pkg/env"
 	"emag-homework/pkg/log"
+	"fmt"
 	"google.golang.org/grpc"
+	"math"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 const (
-	ctrlAddressEnv = "CTRL_ADDRESS"
+	ctrlAddressEnv     = "CTRL_ADDRESS"
+	ctrlConsistencyEnv = "CTRL_CONSISTENCY"
+	// ctrlTxnLogEnv is where the commit decisions of the transactions are
+	// recorded, required so a restart does not lose the ones in doubt
+	ctrlTxnLogEnv = "CTRL_TXN_LOG"
+	// ctrlRebalanceRateEnv is how many keys per second move to new nodes
+	ctrlRebalanceRateEnv = "CTRL_REBALANCE_RATE"
+	// ctrlPeersEnv lists the addresses of the controllers sharing the
+	// membership, comma separated, the own CTRL_ADDRESS included
+	ctrlPeersEnv = "CTRL_PEERS"
+	// ctrlRaftDirEnv is where a controller keeps its share of the membership,
+	// required along with CTRL_PEERS
+	ctrlRaftDirEnv = "CTRL_RAFT_DIR"
+	// ctrlStateFileEnv is where a single controller keeps the membership
+	ctrlStateFileEnv = "CTRL_STATE_FILE"
 )
 
 func StartController() error {
@@ -33,34 +57,177 @@ func StartController() error {
 		cancel()
 	}()
 
-	nodePool := node.NewPool()
+	address, err := env.Require(ctrlAddressEnv)
+	if err != nil {
+		return err
+	}
+
+	peers := splitAddresses(os.Getenv(ctrlPeersEnv))
+
+	id, err := clockID(address, peers)
+	if err != nil {
+		return err
+	}
+
+	opts := []service.Option{
+		service.WithClock(hlc.New(id)),
+	}
+
+	if level := os.Getenv(ctrlConsistencyEnv); level != "" {
+		consistency, ok := v1.Consistency_value["CONSISTENCY_"+strings.ToUpper(level)]
+		if !ok {
+			return fmt.Errorf("%q: unknown consistency level %q", ctrlConsistencyEnv, level)
+		}
+
+		opts = append(opts, service.WithDefaultConsistency(v1.Consistency(consistency)))
+	}
+
+	txnLogFile, err := env.Require(ctrlTxnLogEnv)
+	if err != nil {
+		return err
+	}
+
+	txnLog, err := store.New(store.WithFilename(txnLogFile), store.WithLogger(logger))
+	if err != nil {
+		return fmt.Errorf("failed opening transaction log: %w", err)
+	}
+
+	opts = append(opts, service.WithTxnLog(txnLog))
+
+	if rate := os.Getenv(ctrlRebalanceRateEnv); rate != "" {
+		n, err := strconv.Atoi(rate)
+		if err != nil {
+			return fmt.Errorf("%q: invalid rebalance rate %q", ctrlRebalanceRateEnv, rate)
+		}
+
+		opts = append(opts, service.WithRebalanceRate(n))
+	}
+
+	var replica *raft.Raft
+
+	if len(peers) > 0 {
+		replica, err = newRaft(address, peers, logger)
+		if err != nil {
+			return err
+		}
+		defer replica.Close()
+
+		opts = append(opts, service.WithReplicator(replica), service.WithTxnOwner(address))
+	}
+
+	poolOpts := []node.Option{node.WithLogger(logger)}
+
+	if filename := os.Getenv(ctrlStateFileEnv); filename != "" {
+		// replicated controllers rebuild the membership from the Raft log
+		if replica != nil {
+			return fmt.Errorf("%q cannot be used along with %q", ctrlStateFileEnv, ctrlPeersEnv)
+		}
+
+		poolOpts = append(poolOpts, node.WithStateFile(filename))
+	}
+
+	nodePool := node.NewPool(poolOpts...)
+
+	if err := nodePool.Load(); err != nil {
+		return fmt.Errorf("failed restoring membership: %w", err)
+	}
+
 	checker := healthz.NewChecker()
-	svc := service.NewController(logger, nodePool, checker)
+	svc := service.NewController(logger, nodePool, checker, opts...)
 	srv := server.NewControllerServer(svc)
 	defer svc.TearDown()
 
-	address, err := env.Require(ctrlAddressEnv)
+	lis, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
 
-	lis, err := net.Listen("tcp", address)
+	var raftSrv v1.RaftServer
+
+	if replica != nil {
+		replica.Start(svc)
+		raftSrv = replica
+	}
+
+	return StartControllerGRPCServer(ctx, lis, srv, raftSrv, logger)
+}
+
+// newRaft creates the member of the controller among the peers, identified by
+// their addresses.
+func newRaft(address string, peers []string, logger app.Logger) (*raft.Raft, error) {
+	members := make([]raft.Peer, 0, len(peers))
+
+	for _, addr := range peers {
+		members = append(members, raft.Peer{ID: addr, Address: addr})
+	}
+
+	// a member forgetting its votes and log on restart breaks the guarantees
+	// of the others
+	dir := os.Getenv(ctrlRaftDirEnv)
+	if dir == "" {
+		return nil, fmt.Errorf("%q is required along with %q", ctrlRaftDirEnv, ctrlPeersEnv)
+	}
+
+	r, err := raft.New(address, members, raft.WithLogger(logger),
+		raft.WithStorage(raft.NewFileStorage(filepath.Join(dir, "raft.json"))))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%q: %w", ctrlPeersEnv, err)
 	}
 
-	return StartControllerGRPCServer(ctx, lis, srv, logger)
+	return r, nil
 }
 
+// clockID numbers the controller after the rank of its address among the
+// peers, so every controller stamps the versions with its own id. A single
+// controller has the id 0.
+func clockID(address string, peers []string) (uint8, error) {
+	if len(peers) == 0 {
+		return 0, nil
+	}
+
+	if len(peers) > math.MaxUint8+1 {
+		return 0, fmt.Errorf("%q: at most %d controllers are supported", ctrlPeersEnv, math.MaxUint8+1)
+	}
+
+	sorted := append([]string(nil), peers...)
+	sort.Strings(sorted)
+
+	for i, addr := range sorted {
+		if addr == address {
+			return uint8(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%q does not list %q", ctrlPeersEnv, address)
+}
+
+func splitAddresses(s string) []string {
+	addrs := make([]string, 0)
+
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// StartControllerGRPCServer serves the controller, and the Raft service of its
+// member when replicated.
 func StartControllerGRPCServer(
-	ctx context.Context, lis net.Listener, srv v1.ControllerServer, logger app.Logger,
+	ctx context.Context, lis net.Listener, srv v1.ControllerServer, raftSrv v1.RaftServer, logger app.Logger,
 ) error {
 	grpcSrv := grpc.NewServer(
-		grpc.UnaryInterceptor(log.GRPCUnaryServerInterceptor(logger)),
+		grpc.ChainUnaryInterceptor(log.GRPCUnaryServerInterceptor(logger), redirect.UnaryServerInterceptor()),
 	)
 
 	v1.RegisterControllerServer(grpcSrv, srv)
 
+	if raftSrv != nil {
+		v1.RegisterRaftServer(grpcSrv, raftSrv)
+	}
+
 	logger.Info("DB started at %s ...", lis.Addr().String())
 
 	go func() {
@@ -3,7 +3,10 @@ package bootstrap
 import (
 	"context"
 	v1 "emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/redirect"
 	"emag-homework/internal/db/node"
+	"emag-homework/internal/db/node/cdc"
+	"emag-homework/internal/db/node/gossip"
 	"emag-homework/internal/db/node/server"
 	"emag-homework/internal/db/store"
 	"emag-homework/pkg/env"
@@ -13,12 +16,20 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 )
 
 const (
 	nodeAddressEnv = "NODE_ADDRESS"
 	storePathEnv   = "STORE_PATH"
+	cdcDirEnv      = "CDC_DIR"
+	// gossipSeedsEnv enables the gossip between nodes, listing the addresses
+	// of nodes to join, comma separated. The controllers read the membership
+	// it detects to stop using failed nodes sooner.
+	gossipSeedsEnv = "GOSSIP_SEEDS"
+
+	nodeIDSuffix = ".id"
 )
 
 func StartNode() error {
@@ -49,7 +60,8 @@ func StartNode() error {
 		return err
 	}
 
-	cc, err := grpc.Dial(ctrlAddress, grpc.WithInsecure())
+	// the controllers, comma separated, followed to the leader on registration
+	cc, err := redirect.Dial(strings.Split(ctrlAddress, ","), grpc.WithInsecure())
 	if err != nil {
 		return err
 	}
@@ -68,17 +80,56 @@ func StartNode() error {
 	}
 	defer s.Close()
 
+	if dir := os.Getenv(cdcDirEnv); dir != "" {
+		exporter, err := cdc.New(s, dir, cdc.WithLogger(logger))
+		if err != nil {
+			return fmt.Errorf("failed starting change export: %w", err)
+		}
+		defer exporter.Close()
+	}
+
+	// the id is kept next to the store, both being reused on restart
+	id, err := server.LoadID(storePath + nodeIDSuffix)
+	if err != nil {
+		return err
+	}
+
 	nodeInfo := server.NodeInfo{
-		ID:      server.GenerateID(),
+		ID:      id,
 		Address: lis.Addr().String(),
 	}
 	srv := server.NewNodeServer(s, nodeInfo.ID)
 
+	var members *gossip.Gossip
+	var gossipSrv v1.GossipServer
+	var seeds []string
+
+	if v := os.Getenv(gossipSeedsEnv); v != "" {
+		seeds = strings.Split(v, ",")
+		members = gossip.New(nodeInfo.ID, nodeInfo.Address, gossip.WithLogger(logger))
+		gossipSrv = gossip.NewServer(members)
+
+		defer members.Close()
+
+		go members.Start()
+	}
+
+	// join joins the seeds again until the node knows other nodes
+	join := func() {
+		if members == nil || len(members.Members()) > 1 {
+			return
+		}
+
+		if err := members.Join(ctx, seeds...); err != nil {
+			logger.Error("failed joining gossip: %v", err)
+		}
+	}
+
 	doneCh := make(chan struct{}, 1)
 	errCh := make(chan error, 1)
 
 	go func() {
-		if err := StartNodeGRPCServer(ctx, lis, srv, logger); err != nil {
+		if err := StartNodeGRPCServer(ctx, lis, srv, gossipSrv, logger); err != nil {
 			errCh <- err
 
 			close(errCh)
@@ -109,6 +160,8 @@ func StartNode() error {
 
 	registered = true
 
+	join()
+
 	for {
 		select {
 		case <-doneCh:
@@ -116,6 +169,8 @@ func StartNode() error {
 		case err := <-errCh:
 			return err
 		case <-t.C:
+			join()
+
 			if err := server.Register(ctx, nodeInfo, ctrlClient, logger); err != nil {
 				logger.Error(err.Error())
 
@@ -128,8 +183,10 @@ func StartNode() error {
 	}
 }
 
+// StartNodeGRPCServer serves the node, and its gossip with the other nodes
+// when enabled.
 func StartNodeGRPCServer(
-	ctx context.Context, lis net.Listener, srv v1.NodeServer, logger node.Logger,
+	ctx context.Context, lis net.Listener, srv v1.NodeServer, gossipSrv v1.GossipServer, logger node.Logger,
 ) error {
 	grpcSrv := grpc.NewServer(
 		grpc.UnaryInterceptor(log.GRPCUnaryServerInterceptor(logger)),
@@ -137,6 +194,10 @@ func StartNodeGRPCServer(
 
 	v1.RegisterNodeServer(grpcSrv, srv)
 
+	if gossipSrv != nil {
+		v1.RegisterGossipServer(grpcSrv, gossipSrv)
+	}
+
 	logger.Info("node started at %s ...", lis.Addr().String())
 
 	errCh := make(chan error)
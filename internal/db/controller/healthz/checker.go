@@ -92,7 +92,10 @@ func (c *Checker) Add(id string, fn CheckFunc) {
 	c.checkers[id] = item
 
 	go func() {
-		c.newCheckCh <- item
+		select {
+		case c.newCheckCh <- item:
+		case <-c.doneCh:
+		}
 	}()
 }
 
@@ -109,8 +112,13 @@ func (c *Checker) Remove(id string) {
 }
 
 func (c *Checker) Start() {
-	for item := range c.newCheckCh {
-		go c.checkItem(item)
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case item := <-c.newCheckCh:
+			go c.checkItem(item)
+		}
 	}
 }
 
@@ -120,7 +128,6 @@ func (c *Checker) Events() <-chan CheckEvent {
 
 func (c *Checker) Stop() {
 	close(c.doneCh)
-	close(c.newCheckCh)
 }
 
 func (c *Checker) sendEvent(id string, res *v1.HealthzResponse, err error) {
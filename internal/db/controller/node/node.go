@@ -13,17 +13,27 @@ const (
 )
 
 type Item struct {
-	id     string
-	conn   *grpc.ClientConn
-	client v1.NodeClient
-	status int
-	mu     sync.RWMutex
+	id      string
+	address string
+	conn    *grpc.ClientConn
+	client  v1.NodeClient
+	status  int
+	mu      sync.RWMutex
 }
 
 func (n *Item) ID() string {
 	return n.id
 }
 
+func (n *Item) Address() string {
+	return n.address
+}
+
+// GossipClient reaches the membership the node gossips with the others.
+func (n *Item) GossipClient() v1.GossipClient {
+	return v1.NewGossipClient(n.conn)
+}
+
 func (n *Item) close() error {
 	if n.conn == nil {
 		return nil
@@ -33,9 +43,28 @@ func (n *Item) close() error {
 }
 
 func (n *Item) IsReady() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
 	return n.status == readyNodeStatus
 }
 
+// IsPending tells whether the node is catching up with the keys it is about to
+// store. It does not serve any key until then.
+func (n *Item) IsPending() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.status == pendingNodeStatus
+}
+
+func (n *Item) MarkPending() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.status = pendingNodeStatus
+}
+
 func (n *Item) MarkError() {
 	n.mu.Lock()
 	defer n.mu.Unlock()
@@ -50,6 +79,20 @@ func (n *Item) MarkReady() {
 	n.status = readyNodeStatus
 }
 
+func (n *Item) getStatus() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.status
+}
+
+func (n *Item) setStatus(status int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.status = status
+}
+
 func (n *Item) Client() v1.NodeClient {
 	return n.client
 }
@@ -2,27 +2,73 @@ package node
 
 import (
 	v1 "emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/keyspace"
 	"fmt"
 	"google.golang.org/grpc"
 	"sync"
 )
 
-type Pool struct {
-	mu         sync.RWMutex
-	nodes      map[string]*Item
-	newNodesCh chan NewNodeEvent
-	closed     bool
+const defaultReplicationFactor = 3
+
+type Config struct {
+	ReplicationFactor int
+	VirtualNodes      int
+	StateFile         string
+	Logger            Logger
 }
 
-type NewNodeEvent struct {
-	ID     string
-	Client v1.NodeClient
+type Option func(cfg *Config)
+
+type Pool struct {
+	mu    sync.RWMutex
+	nodes map[string]*Item
+	ring  *Ring
+	// next is the ring the keys are moving to while nodes join or leave,
+	// nil when the ring is stable. Keys are served from ring until the
+	// moves are committed.
+	next              *Ring
+	epoch             uint64
+	replicationFactor int
+	filename          string
+	logger            Logger
+	closed            bool
+
+	// dirty tells the membership changed since saved to the state file
+	dirty  bool
+	saveMu sync.Mutex
 }
 
-func NewPool() *Pool {
+func NewPool(opts ...Option) *Pool {
+	cfg := &Config{
+		ReplicationFactor: defaultReplicationFactor,
+		VirtualNodes:      defaultVirtualNodes,
+		Logger:            noOpLogger{},
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
 	return &Pool{
-		nodes:      make(map[string]*Item),
-		newNodesCh: make(chan NewNodeEvent),
+		nodes:             make(map[string]*Item),
+		ring:              NewRing(cfg.VirtualNodes),
+		replicationFactor: cfg.ReplicationFactor,
+		filename:          cfg.StateFile,
+		logger:            cfg.Logger,
+	}
+}
+
+// WithReplicationFactor sets on how many nodes every key is stored.
+func WithReplicationFactor(n int) Option {
+	return func(cfg *Config) {
+		cfg.ReplicationFactor = n
+	}
+}
+
+// WithVirtualNodes sets how many tokens every node owns on the hash ring.
+func WithVirtualNodes(n int) Option {
+	return func(cfg *Config) {
+		cfg.VirtualNodes = n
 	}
 }
 
@@ -41,7 +87,53 @@ func (p *Pool) Select() []*Item {
 	return items
 }
 
+// Preference returns the replicas responsible for the key, primary first,
+// whatever their status.
+func (p *Pool) Preference(key string) []*Item {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.items(p.ring.Lookup(key, p.replicationFactor))
+}
+
+// ItemRange is an arc of the hash ring and the replicas of its keys, primary
+// first, whatever their status.
+type ItemRange struct {
+	Range keyspace.Range
+	Items []*Item
+}
+
+// Ranges returns the arcs of the hash ring along with their replicas.
+func (p *Pool) Ranges() []ItemRange {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	tokenRanges := p.ring.Ranges(p.replicationFactor)
+	ranges := make([]ItemRange, 0, len(tokenRanges))
+
+	for _, tr := range tokenRanges {
+		ranges = append(ranges, ItemRange{Range: tr.Range, Items: p.items(tr.Owners)})
+	}
+
+	return ranges
+}
+
+// ReplicationFactor returns the number of replicas a key is stored on.
+func (p *Pool) ReplicationFactor() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if n := p.ring.Size(); n < p.replicationFactor {
+		return n
+	}
+
+	return p.replicationFactor
+}
+
 func (p *Pool) Add(id, address string) (*Item, error) {
+	// saved once unlocked
+	defer p.save()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -49,6 +141,11 @@ func (p *Pool) Add(id, address string) (*Item, error) {
 		return nil, fmt.Errorf("pool is closed")
 	}
 
+	// nodes register again periodically, keep the existing connection
+	if item, ok := p.nodes[id]; ok && item.address == address {
+		return item, nil
+	}
+
 	conn, err := grpc.Dial(address, grpc.WithInsecure())
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect to node %s", address)
@@ -56,37 +153,191 @@ func (p *Pool) Add(id, address string) (*Item, error) {
 
 	client := v1.NewNodeClient(conn)
 
-	p.nodes[id] = &Item{
-		id:     id,
-		conn:   conn,
-		client: client,
+	if item, ok := p.nodes[id]; ok {
+		_ = item.close()
 	}
 
-	go func() {
-		p.newNodesCh <- NewNodeEvent{
-			ID:     id,
-			Client: client,
-		}
-	}()
+	item := &Item{
+		id:      id,
+		address: address,
+		conn:    conn,
+		client:  client,
+	}
+	p.nodes[id] = item
+
+	// the first nodes have no keys to receive, the others are pending until
+	// they caught up, see Commit
+	switch {
+	case p.ring.Size() == 0 && p.next == nil:
+		p.ring.Add(id)
+	case !p.target().Has(id):
+		p.transition().Add(id)
+	}
+
+	if !p.ring.Has(id) {
+		item.MarkPending()
+	}
+
+	p.dirty = true
 
-	return p.nodes[id], nil
+	return item, nil
 }
 
+// Remove takes the node off the ring. A node owning keys keeps serving them
+// until they moved to their new owners, see Commit.
 func (p *Pool) Remove(id string) error {
+	// saved once unlocked
+	defer p.save()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	delete(p.nodes, id)
+	if !p.ring.Has(id) {
+		if p.next != nil {
+			p.next.Remove(id)
+			p.epoch++
+		}
+
+		if item, ok := p.nodes[id]; ok {
+			_ = item.close()
+			delete(p.nodes, id)
+		}
+
+		p.dirty = true
+
+		return nil
+	}
+
+	p.transition().Remove(id)
+	p.dirty = true
 
 	return nil
 }
 
+// Get returns the node with the id.
+func (p *Pool) Get(id string) (*Item, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	item, ok := p.nodes[id]
+
+	return item, ok
+}
+
+// target is the ring the keys end up in.
+func (p *Pool) target() *Ring {
+	if p.next != nil {
+		return p.next
+	}
+
+	return p.ring
+}
+
+// transition returns the ring the keys are moving to, starting a new
+// transition if needed.
+func (p *Pool) transition() *Ring {
+	if p.next == nil {
+		p.next = p.ring.Clone()
+	}
+
+	p.epoch++
+
+	return p.next
+}
+
+// Move is an arc of the hash ring whose keys have to be copied from their
+// current replicas to new ones.
+type Move struct {
+	Range keyspace.Range
+	From  []*Item
+	To    []*Item
+}
+
+// Moves returns the arcs changing replicas in the ongoing transition, and the
+// epoch to commit it at. It returns false when the ring is stable.
+func (p *Pool) Moves() (uint64, []Move, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.next == nil {
+		return p.epoch, nil, false
+	}
+
+	rangeMoves := p.ring.Moves(p.next, p.replicationFactor)
+	moves := make([]Move, 0, len(rangeMoves))
+
+	for _, rm := range rangeMoves {
+		moves = append(moves, Move{Range: rm.Range, From: p.items(rm.From), To: p.items(rm.To)})
+	}
+
+	return p.epoch, moves, true
+}
+
+// Pending returns the nodes that will be replicas of the key once the ongoing
+// transition is committed, but are not yet.
+func (p *Pool) Pending(key string) []*Item {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.next == nil {
+		return nil
+	}
+
+	return p.items(missing(p.next.Lookup(key, p.replicationFactor), p.ring.Lookup(key, p.replicationFactor)))
+}
+
+// Commit switches the keys over to the ring of the transition, unless the
+// membership changed since the epoch, and marks the nodes that caught up
+// ready. It returns the ids of the nodes that left the ring, which are removed
+// from the pool.
+func (p *Pool) Commit(epoch uint64) ([]string, bool) {
+	// saved once unlocked
+	defer p.save()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next == nil || p.epoch != epoch {
+		return nil, false
+	}
+
+	p.ring = p.next
+	p.next = nil
+	p.epoch++
+
+	removed := make([]string, 0)
+
+	for id, item := range p.nodes {
+		switch {
+		case !p.ring.Has(id):
+			_ = item.close()
+			delete(p.nodes, id)
+			removed = append(removed, id)
+		case item.IsPending():
+			item.MarkReady()
+		}
+	}
+
+	p.dirty = true
+
+	return removed, true
+}
+
+func (p *Pool) items(ids []string) []*Item {
+	items := make([]*Item, 0, len(ids))
+
+	for _, id := range ids {
+		items = append(items, p.nodes[id])
+	}
+
+	return items
+}
+
 func (p *Pool) Close() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	p.closed = true
-	close(p.newNodesCh)
 
 	for _, node := range p.nodes {
 		_ = node.close()
@@ -103,6 +354,9 @@ func (p *Pool) Size() int {
 }
 
 func (p *Pool) MarkError(id string) {
+	// saved once unlocked
+	defer p.save()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -111,10 +365,13 @@ func (p *Pool) MarkError(id string) {
 		return
 	}
 
-	node.MarkError()
+	p.mark(node, errorNodeStatus)
 }
 
 func (p *Pool) MarkReady(id string) {
+	// saved once unlocked
+	defer p.save()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -123,5 +380,23 @@ func (p *Pool) MarkReady(id string) {
 		return
 	}
 
-	node.MarkReady()
+	// a node not on the ring yet is still catching up
+	if !p.ring.Has(id) {
+		p.mark(node, pendingNodeStatus)
+
+		return
+	}
+
+	p.mark(node, readyNodeStatus)
+}
+
+// mark sets the status of the node, the membership to be saved when it
+// changed.
+func (p *Pool) mark(node *Item, status int) {
+	if node.getStatus() == status {
+		return
+	}
+
+	node.setStatus(status)
+	p.dirty = true
 }
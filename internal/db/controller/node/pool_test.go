@@ -0,0 +1,126 @@
+package node_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"emag-homework/internal/db/controller/node"
+	"emag-homework/pkg/test/require"
+)
+
+func TestPool_Transition(t *testing.T) {
+	t.Parallel()
+
+	p := node.NewPool(node.WithReplicationFactor(2))
+	defer p.Close()
+
+	first, err := p.Add("node-0", "127.0.0.1:1")
+	require.NoError(t, err)
+	require.True(t, first.IsReady(), "first node is ready")
+
+	_, _, ok := p.Moves()
+	require.False(t, ok, "nothing to move to the first node")
+
+	joined, err := p.Add("node-1", "127.0.0.1:2")
+	require.NoError(t, err)
+	require.True(t, joined.IsPending(), "joined node is pending")
+
+	p.MarkReady("node-1")
+	require.True(t, joined.IsPending(), "pending until caught up")
+
+	require.Equal(t, []*node.Item{first}, p.Preference("foo"), "served by the current replicas")
+	require.Equal(t, []*node.Item{joined}, p.Pending("foo"), "pending replicas")
+
+	epoch, moves, ok := p.Moves()
+	require.True(t, ok, "transition")
+	require.Equal(t, 1, len(moves), "moves")
+	require.Equal(t, []*node.Item{joined}, moves[0].To, "moved to")
+
+	_, err = p.Add("node-2", "127.0.0.1:3")
+	require.NoError(t, err)
+
+	_, ok = p.Commit(epoch)
+	require.False(t, ok, "membership changed")
+
+	epoch, _, _ = p.Moves()
+	removed, ok := p.Commit(epoch)
+	require.True(t, ok, "commit")
+	require.Equal(t, 0, len(removed), "removed")
+	require.True(t, joined.IsReady(), "caught up")
+	require.Equal(t, 2, len(p.Preference("foo")), "replicas")
+
+	require.NoError(t, p.Remove("node-0"))
+	_, ok = p.Get("node-0")
+	require.True(t, ok, "leaving node serves its keys until the commit")
+
+	epoch, _, _ = p.Moves()
+	removed, ok = p.Commit(epoch)
+	require.True(t, ok, "commit")
+	require.Equal(t, []string{"node-0"}, removed, "removed")
+	require.Equal(t, 2, p.Size(), "size")
+}
+
+func TestPool_Load(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "membership.json")
+
+	p := node.NewPool(node.WithReplicationFactor(2), node.WithStateFile(filename))
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := p.Add(fmt.Sprintf("node-%d", i), fmt.Sprintf("127.0.0.1:%d", i+1))
+		require.NoError(t, err)
+	}
+
+	epoch, _, _ := p.Moves()
+	_, ok := p.Commit(epoch)
+	require.True(t, ok, "commit")
+
+	// moving to a joined node, with a failed one
+	_, err := p.Add("node-3", "127.0.0.1:4")
+	require.NoError(t, err)
+
+	p.MarkError("node-1")
+
+	// a restarted controller with other tokens per node
+	restored := node.NewPool(node.WithReplicationFactor(2), node.WithVirtualNodes(8), node.WithStateFile(filename))
+	defer restored.Close()
+
+	require.NoError(t, restored.Load())
+	require.Equal(t, 4, restored.Size(), "size")
+
+	restoredEpoch, restoredMoves, ok := restored.Moves()
+	require.True(t, ok, "still moving")
+	require.Equal(t, epoch+2, restoredEpoch, "epoch")
+
+	_, moves, _ := p.Moves()
+	require.Equal(t, len(moves), len(restoredMoves), "moves")
+
+	ids := func(items []*node.Item) []string {
+		out := make([]string, 0, len(items))
+
+		for _, item := range items {
+			out = append(out, item.ID())
+		}
+
+		return out
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		require.Equal(t, ids(p.Preference(key)), ids(restored.Preference(key)), key)
+		require.Equal(t, ids(p.Pending(key)), ids(restored.Pending(key)), key)
+	}
+
+	item, ok := restored.Get("node-1")
+	require.True(t, ok, "failed node")
+	require.False(t, item.IsReady(), "failed node status")
+
+	item, _ = restored.Get("node-3")
+	require.True(t, item.IsPending(), "joined node status")
+
+	require.NoError(t, node.NewPool(node.WithStateFile(filepath.Join(t.TempDir(), "missing.json"))).Load())
+}
@@ -0,0 +1,311 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+
+	"emag-homework/internal/db/keyspace"
+)
+
+const defaultVirtualNodes = 64
+
+// Ring is a consistent hash ring. Every member owns a number of virtual nodes
+// (tokens) spread on the ring, and a key belongs to the members owning the
+// first tokens found clockwise from the key hash. Adding or removing a member
+// only moves the keys next to its tokens. Ring is not safe for concurrent use.
+type Ring struct {
+	vnodes int
+	tokens []uint64
+	owners map[uint64]string
+	member map[string][]uint64
+}
+
+func NewRing(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+
+	return &Ring{
+		vnodes: vnodes,
+		owners: make(map[uint64]string),
+		member: make(map[string][]uint64),
+	}
+}
+
+// Add places the member on the ring. Adding an existing member is a no-op.
+func (r *Ring) Add(id string) {
+	if _, ok := r.member[id]; ok {
+		return
+	}
+
+	tokens := make([]uint64, 0, r.vnodes)
+
+	for i := 0; i < r.vnodes; i++ {
+		tokens = append(tokens, hash(fmt.Sprintf("%s#%d", id, i)))
+	}
+
+	r.place(id, tokens)
+}
+
+// place puts the member on the ring at the tokens not owned yet.
+func (r *Ring) place(id string, tokens []uint64) {
+	owned := make([]uint64, 0, len(tokens))
+
+	for _, token := range tokens {
+		if _, ok := r.owners[token]; ok {
+			continue
+		}
+
+		r.owners[token] = id
+		owned = append(owned, token)
+	}
+
+	r.member[id] = owned
+	r.tokens = append(r.tokens, owned...)
+
+	sort.Slice(r.tokens, func(i, j int) bool {
+		return r.tokens[i] < r.tokens[j]
+	})
+}
+
+func (r *Ring) Remove(id string) {
+	tokens, ok := r.member[id]
+	if !ok {
+		return
+	}
+
+	for _, token := range tokens {
+		delete(r.owners, token)
+	}
+
+	delete(r.member, id)
+
+	kept := r.tokens[:0]
+
+	for _, token := range r.tokens {
+		if _, ok := r.owners[token]; ok {
+			kept = append(kept, token)
+		}
+	}
+
+	r.tokens = kept
+}
+
+// Lookup returns the preference list of the key: up to n distinct members,
+// the first one being the primary owner.
+func (r *Ring) Lookup(key string, n int) []string {
+	return r.lookup(hash(key), n)
+}
+
+// Ranges returns the arcs of the ring along with their preference lists of up
+// to n members. Consecutive arcs with the same preference list are merged.
+func (r *Ring) Ranges(n int) []TokenRange {
+	if len(r.tokens) == 0 {
+		return nil
+	}
+
+	ranges := make([]TokenRange, 0, len(r.tokens))
+
+	for i, token := range r.tokens {
+		prev := r.tokens[(i+len(r.tokens)-1)%len(r.tokens)]
+		owners := r.lookup(token, n)
+
+		if last := len(ranges) - 1; last >= 0 && equalOwners(ranges[last].Owners, owners) {
+			ranges[last].Range.End = token
+
+			continue
+		}
+
+		ranges = append(ranges, TokenRange{
+			Range:  keyspace.Range{Start: prev, End: token},
+			Owners: owners,
+		})
+	}
+
+	// the last arc may continue the first one
+	if last := len(ranges) - 1; last > 0 && equalOwners(ranges[0].Owners, ranges[last].Owners) {
+		ranges[0].Range.Start = ranges[last].Range.Start
+		ranges = ranges[:last]
+	}
+
+	if len(ranges) == 1 {
+		ranges[0].Range = keyspace.Full
+	}
+
+	return ranges
+}
+
+// Moves returns the arcs whose preference lists of up to n members differ in
+// the next ring, along with the members storing their keys now and the ones
+// that will store them but do not yet. Consecutive arcs moving between the
+// same members are merged.
+func (r *Ring) Moves(next *Ring, n int) []RangeMove {
+	if len(r.tokens) == 0 || len(next.tokens) == 0 {
+		return nil
+	}
+
+	// the arcs of both rings, cut at the tokens of either
+	tokens := make([]uint64, 0, len(r.tokens)+len(next.tokens))
+	tokens = append(tokens, r.tokens...)
+	tokens = append(tokens, next.tokens...)
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i] < tokens[j]
+	})
+
+	moves := make([]RangeMove, 0)
+	var prev uint64
+
+	for i, token := range tokens {
+		if i > 0 && token == tokens[i-1] {
+			continue
+		}
+
+		if i == 0 {
+			prev = tokens[len(tokens)-1]
+		}
+
+		from := r.lookup(token, n)
+		to := missing(next.lookup(token, n), from)
+
+		if len(to) > 0 {
+			last := len(moves) - 1
+			if last >= 0 && moves[last].Range.End == prev &&
+				equalOwners(moves[last].From, from) && equalOwners(moves[last].To, to) {
+				moves[last].Range.End = token
+			} else {
+				moves = append(moves, RangeMove{
+					Range: keyspace.Range{Start: prev, End: token},
+					From:  from,
+					To:    to,
+				})
+			}
+		}
+
+		prev = token
+	}
+
+	// the last arc may continue the first one
+	if last := len(moves) - 1; last > 0 && moves[last].Range.End == moves[0].Range.Start &&
+		equalOwners(moves[0].From, moves[last].From) && equalOwners(moves[0].To, moves[last].To) {
+		moves[0].Range.Start = moves[last].Range.Start
+		moves = moves[:last]
+	}
+
+	if len(moves) == 1 && moves[0].Range.Start == moves[0].Range.End {
+		moves[0].Range = keyspace.Full
+	}
+
+	return moves
+}
+
+// RangeMove is an arc of the ring whose keys are stored by the From members
+// and have to be copied to the To members.
+type RangeMove struct {
+	Range keyspace.Range
+	From  []string
+	To    []string
+}
+
+// Clone returns a copy of the ring.
+func (r *Ring) Clone() *Ring {
+	clone := NewRing(r.vnodes)
+	clone.tokens = append(clone.tokens, r.tokens...)
+
+	for token, id := range r.owners {
+		clone.owners[token] = id
+	}
+
+	for id, tokens := range r.member {
+		clone.member[id] = tokens
+	}
+
+	return clone
+}
+
+// Has tells whether the member is on the ring.
+func (r *Ring) Has(id string) bool {
+	_, ok := r.member[id]
+
+	return ok
+}
+
+// TokenRange is an arc of the ring and the members storing its keys.
+type TokenRange struct {
+	Range  keyspace.Range
+	Owners []string
+}
+
+func (r *Ring) lookup(h uint64, n int) []string {
+	if n > len(r.member) {
+		n = len(r.member)
+	}
+
+	if n <= 0 {
+		return nil
+	}
+
+	start := sort.Search(len(r.tokens), func(i int) bool {
+		return r.tokens[i] >= h
+	})
+
+	ids := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+
+	for i := 0; i < len(r.tokens) && len(ids) < n; i++ {
+		id := r.owners[r.tokens[(start+i)%len(r.tokens)]]
+		if _, ok := seen[id]; ok {
+			continue
+		}
+
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func equalOwners(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// missing returns the members of a not in b.
+func missing(a, b []string) []string {
+	out := make([]string, 0)
+
+	for _, id := range a {
+		var found bool
+
+		for _, other := range b {
+			if id == other {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			out = append(out, id)
+		}
+	}
+
+	return out
+}
+
+func (r *Ring) Size() int {
+	return len(r.member)
+}
+
+func hash(s string) uint64 {
+	return keyspace.Hash(s)
+}
@@ -0,0 +1,208 @@
+package node_test
+
+import (
+	"fmt"
+	"testing"
+
+	"emag-homework/internal/db/controller/node"
+	"emag-homework/internal/db/keyspace"
+	"emag-homework/pkg/test/require"
+)
+
+func TestRing_Lookup(t *testing.T) {
+	t.Parallel()
+
+	type args struct {
+		members []string
+		n       int
+	}
+
+	tests := []struct {
+		name string
+		args args
+		want int
+	}{
+		{
+			name: "preference list has n distinct members",
+			args: args{
+				members: []string{"node-1", "node-2", "node-3", "node-4"},
+				n:       3,
+			},
+			want: 3,
+		},
+		{
+			name: "not enough members",
+			args: args{
+				members: []string{"node-1", "node-2"},
+				n:       3,
+			},
+			want: 2,
+		},
+		{
+			name: "empty ring",
+			args: args{
+				n: 3,
+			},
+			want: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := node.NewRing(32)
+			for _, id := range tt.args.members {
+				r.Add(id)
+			}
+
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				got := r.Lookup(key, tt.args.n)
+
+				require.Equal(t, tt.want, len(got), key)
+
+				seen := make(map[string]bool)
+				for _, id := range got {
+					require.False(t, seen[id], "duplicate member")
+					seen[id] = true
+				}
+
+				require.Equal(t, got, r.Lookup(key, tt.args.n), "stable lookup")
+			}
+		})
+	}
+}
+
+func TestRing_Add(t *testing.T) {
+	t.Parallel()
+
+	r := node.NewRing(64)
+	for i := 1; i <= 4; i++ {
+		r.Add(fmt.Sprintf("node-%d", i))
+	}
+
+	const keys = 10000
+
+	before := make([]string, keys)
+	for i := range before {
+		before[i] = r.Lookup(fmt.Sprintf("key-%d", i), 1)[0]
+	}
+
+	r.Add("node-5")
+
+	var moved int
+
+	for i := range before {
+		got := r.Lookup(fmt.Sprintf("key-%d", i), 1)[0]
+		if got == before[i] {
+			continue
+		}
+
+		require.Equal(t, "node-5", got, "keys only move to the new member")
+		moved++
+	}
+
+	// ideally 1/5 of the keys move to the new member
+	require.True(t, moved > keys/10 && moved < keys*3/10, fmt.Sprintf("moved %d keys", moved))
+
+	r.Remove("node-5")
+
+	for i := range before {
+		require.Equal(t, before[i], r.Lookup(fmt.Sprintf("key-%d", i), 1)[0], "keys move back")
+	}
+}
+
+func TestRing_Ranges(t *testing.T) {
+	t.Parallel()
+
+	r := node.NewRing(16)
+
+	for i := 0; i < 5; i++ {
+		r.Add(fmt.Sprintf("node-%d", i))
+	}
+
+	ranges := r.Ranges(3)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		var found []node.TokenRange
+
+		for _, tr := range ranges {
+			if tr.Range.Contains(keyspace.Hash(key)) {
+				found = append(found, tr)
+			}
+		}
+
+		require.Equal(t, 1, len(found), key)
+		require.Equal(t, r.Lookup(key, 3), found[0].Owners, key)
+	}
+
+	single := node.NewRing(4)
+	single.Add("node-1")
+
+	require.Equal(t, []node.TokenRange{{Range: keyspace.Full, Owners: []string{"node-1"}}}, single.Ranges(3))
+}
+
+func TestRing_Moves(t *testing.T) {
+	t.Parallel()
+
+	r := node.NewRing(16)
+
+	for i := 0; i < 4; i++ {
+		r.Add(fmt.Sprintf("node-%d", i))
+	}
+
+	next := r.Clone()
+	next.Add("node-4")
+	next.Remove("node-0")
+
+	moves := r.Moves(next, 3)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		var found []node.RangeMove
+
+		for _, m := range moves {
+			if m.Range.Contains(keyspace.Hash(key)) {
+				found = append(found, m)
+			}
+		}
+
+		var added []string
+
+		for _, id := range next.Lookup(key, 3) {
+			if id == "node-4" || !contains(r.Lookup(key, 3), id) {
+				added = append(added, id)
+			}
+		}
+
+		if len(added) == 0 {
+			require.Equal(t, 0, len(found), key)
+
+			continue
+		}
+
+		require.Equal(t, 1, len(found), key)
+		require.Equal(t, r.Lookup(key, 3), found[0].From, key)
+		require.Equal(t, added, found[0].To, key)
+	}
+
+	require.True(t, r.Has("node-0"), "clone is a copy")
+	require.False(t, r.Has("node-4"), "clone is a copy")
+	require.Equal(t, 0, len(r.Moves(r.Clone(), 3)), "no moves")
+}
+
+func contains(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+
+	return false
+}
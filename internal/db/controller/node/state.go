@@ -0,0 +1,212 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	v1 "emag-homework/internal/db/api/v1"
+	"emag-homework/pkg/fileutil"
+
+	"google.golang.org/grpc"
+)
+
+// State is the membership of the pool, as kept across restarts.
+type State struct {
+	Epoch uint64 `json:"epoch"`
+	// Moving is true while the keys move to the next ring.
+	Moving bool        `json:"moving,omitempty"`
+	Nodes  []NodeState `json:"nodes"`
+}
+
+// NodeState is a node of the pool along with its tokens on the ring, and on
+// the next ring while moving. A node without tokens is not on the ring.
+type NodeState struct {
+	ID         string   `json:"id"`
+	Address    string   `json:"address"`
+	Status     string   `json:"status"`
+	Tokens     []uint64 `json:"tokens,omitempty"`
+	NextTokens []uint64 `json:"next_tokens,omitempty"`
+}
+
+var statusNames = map[int]string{
+	readyNodeStatus:   "ready",
+	errorNodeStatus:   "error",
+	pendingNodeStatus: "pending",
+}
+
+// WithStateFile keeps the membership in the file, replaced on every change,
+// so it survives restarts. It is read back by Load.
+func WithStateFile(filename string) Option {
+	return func(cfg *Config) {
+		cfg.StateFile = filename
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(cfg *Config) {
+		cfg.Logger = logger
+	}
+}
+
+// Load restores the membership kept in the state file, if any. It must be
+// called before the pool is used. The nodes keep their last known status
+// until checked again.
+func (p *Pool) Load() error {
+	if p.filename == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(p.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("failed reading membership %q: %w", p.filename, err)
+	}
+
+	var state State
+
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("failed json decoding membership: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next := NewRing(p.ring.vnodes)
+
+	for _, n := range state.Nodes {
+		conn, err := grpc.Dial(n.Address, grpc.WithInsecure())
+		if err != nil {
+			return fmt.Errorf("cannot connect to node %s", n.Address)
+		}
+
+		item := &Item{
+			id:      n.ID,
+			address: n.Address,
+			conn:    conn,
+			client:  v1.NewNodeClient(conn),
+		}
+
+		for status, name := range statusNames {
+			if name == n.Status {
+				item.status = status
+			}
+		}
+
+		if old, ok := p.nodes[n.ID]; ok {
+			_ = old.close()
+		}
+
+		p.nodes[n.ID] = item
+
+		if len(n.Tokens) > 0 {
+			p.ring.place(n.ID, n.Tokens)
+		}
+
+		if len(n.NextTokens) > 0 {
+			next.place(n.ID, n.NextTokens)
+		}
+	}
+
+	if state.Moving {
+		p.next = next
+	}
+
+	p.epoch = state.Epoch
+
+	return nil
+}
+
+// Items returns every node of the pool, whatever its status.
+func (p *Pool) Items() []*Item {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	items := make([]*Item, 0, len(p.nodes))
+
+	for _, item := range p.nodes {
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// save writes the membership to the state file when it changed. It is called
+// once the pool is unlocked, so the file is synced without blocking the
+// requests. The saves are serialized, so the file ends with the latest state.
+func (p *Pool) save() {
+	if p.filename == "" {
+		return
+	}
+
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
+	b, err := p.state()
+	if err == nil && b != nil {
+		err = fileutil.WriteFile(p.filename, b)
+	}
+
+	if err != nil {
+		p.logger.Error("failed saving membership: %v", err)
+
+		// saved on the next change
+		p.mu.Lock()
+		p.dirty = true
+		p.mu.Unlock()
+	}
+}
+
+// state encodes the membership if it changed since last saved, nil if not.
+func (p *Pool) state() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.dirty {
+		return nil, nil
+	}
+
+	p.dirty = false
+
+	state := State{Epoch: p.epoch, Moving: p.next != nil, Nodes: make([]NodeState, 0, len(p.nodes))}
+
+	for id, item := range p.nodes {
+		n := NodeState{
+			ID:      id,
+			Address: item.address,
+			Status:  statusNames[item.getStatus()],
+			Tokens:  p.ring.member[id],
+		}
+
+		if p.next != nil {
+			n.NextTokens = p.next.member[id]
+		}
+
+		state.Nodes = append(state.Nodes, n)
+	}
+
+	sort.Slice(state.Nodes, func(i, j int) bool {
+		return state.Nodes[i].ID < state.Nodes[j].ID
+	})
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed json encoding membership: %w", err)
+	}
+
+	return b, nil
+}
+
+type Logger interface {
+	Info(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+type noOpLogger struct{}
+
+func (noOpLogger) Info(string, ...interface{})  {}
+func (noOpLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,208 @@
+// Package redirect sends the calls the controller followers cannot serve to
+// the leader, and fails over between the controllers.
+package redirect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"emag-homework/internal/db/raft"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// leaderAddressKey is the trailer of the calls made to a follower, empty while
+// no leader is known.
+const leaderAddressKey = "leader-address"
+
+// UnaryServerInterceptor turns the errors of the calls only the leader serves
+// into Unavailable, telling the client where the leader is.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		res, err := handler(ctx, req)
+
+		var notLeader *raft.NotLeaderError
+		if err == nil || !errors.As(err, &notLeader) {
+			return res, err
+		}
+
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(leaderAddressKey, notLeader.LeaderAddress))
+
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+}
+
+var _ grpc.ClientConnInterface = (*Conn)(nil)
+
+// Conn is a connection to a set of controllers. A call goes to the last
+// controller that answered, follows the redirects of the followers, and moves
+// on to the next controller when the current one is unreachable.
+type Conn struct {
+	mu      sync.Mutex
+	addrs   []string
+	conns   map[string]*grpc.ClientConn
+	current string
+	opts    []grpc.DialOption
+}
+
+// Dial connects to the controllers at the addresses, without blocking.
+func Dial(addrs []string, opts ...grpc.DialOption) (*Conn, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no controller address")
+	}
+
+	c := &Conn{
+		addrs:   addrs,
+		conns:   make(map[string]*grpc.ClientConn, len(addrs)),
+		current: addrs[0],
+		opts:    opts,
+	}
+
+	for _, addr := range addrs {
+		if _, err := c.conn(addr); err != nil {
+			_ = c.Close()
+
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Conn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	addr := c.addr()
+
+	var err error
+
+	// every controller once, plus the redirect to the leader
+	for i := 0; i <= len(c.addrs); i++ {
+		var cc *grpc.ClientConn
+
+		cc, err = c.conn(addr)
+		if err != nil {
+			return err
+		}
+
+		var trailer metadata.MD
+
+		err = cc.Invoke(ctx, method, args, reply, append(opts, grpc.Trailer(&trailer))...)
+		if status.Code(err) != codes.Unavailable || ctx.Err() != nil {
+			c.setAddr(addr)
+
+			return err
+		}
+
+		switch leader := trailer.Get(leaderAddressKey); {
+		case len(leader) > 0 && leader[0] != "":
+			addr = leader[0]
+		case len(leader) > 0 || cc.GetState() != connectivity.Ready:
+			addr = c.next(addr)
+		default:
+			// the controller itself is unavailable to serve the call
+			return err
+		}
+	}
+
+	return err
+}
+
+// NewStream fails over when the stream cannot be opened, the streams are not
+// redirected.
+func (c *Conn) NewStream(
+	ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	addr := c.addr()
+
+	var err error
+
+	for range c.addrs {
+		var cc *grpc.ClientConn
+
+		cc, err = c.conn(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var stream grpc.ClientStream
+
+		stream, err = cc.NewStream(ctx, desc, method, opts...)
+		if status.Code(err) != codes.Unavailable || ctx.Err() != nil {
+			c.setAddr(addr)
+
+			return stream, err
+		}
+
+		addr = c.next(addr)
+	}
+
+	return nil, err
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+
+	for addr, cc := range c.conns {
+		if cerr := cc.Close(); err == nil {
+			err = cerr
+		}
+
+		delete(c.conns, addr)
+	}
+
+	return err
+}
+
+func (c *Conn) conn(addr string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cc, ok := c.conns[addr]; ok {
+		return cc, nil
+	}
+
+	// the leader may be reached at an address the client was not given
+	cc, err := grpc.Dial(addr, c.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to controller %s: %w", addr, err)
+	}
+
+	c.conns[addr] = cc
+
+	return cc, nil
+}
+
+func (c *Conn) addr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.current
+}
+
+func (c *Conn) setAddr(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current = addr
+}
+
+// next returns the address following addr among the ones given to Dial.
+func (c *Conn) next(addr string) string {
+	for i, a := range c.addrs {
+		if a == addr {
+			return c.addrs[(i+1)%len(c.addrs)]
+		}
+	}
+
+	return c.addrs[0]
+}
@@ -26,6 +26,56 @@ func (s *ControllerServer) Get(ctx context.Context, req *v1.GetRequest) (*v1.Get
 	return s.service.Get(ctx, req)
 }
 
+func (s *ControllerServer) Delete(ctx context.Context, req *v1.DeleteRequest) (*v1.DeleteResponse, error) {
+	return s.service.Delete(ctx, req)
+}
+
+func (s *ControllerServer) Increment(ctx context.Context, req *v1.IncrementRequest) (*v1.IncrementResponse, error) {
+	return s.service.Increment(ctx, req)
+}
+
+func (s *ControllerServer) IncrementCounter(
+	ctx context.Context, req *v1.IncrementCounterRequest,
+) (*v1.IncrementCounterResponse, error) {
+	return s.service.IncrementCounter(ctx, req)
+}
+
+func (s *ControllerServer) GetCounter(ctx context.Context, req *v1.GetCounterRequest) (*v1.GetCounterResponse, error) {
+	return s.service.GetCounter(ctx, req)
+}
+
+func (s *ControllerServer) Batch(ctx context.Context, req *v1.BatchRequest) (*v1.BatchResponse, error) {
+	return s.service.Batch(ctx, req)
+}
+
+func (s *ControllerServer) Begin(ctx context.Context, req *v1.BeginRequest) (*v1.BeginResponse, error) {
+	return s.service.Begin(ctx, req)
+}
+
+func (s *ControllerServer) TxnGet(ctx context.Context, req *v1.TxnGetRequest) (*v1.GetResponse, error) {
+	return s.service.TxnGet(ctx, req)
+}
+
+func (s *ControllerServer) TxnPut(ctx context.Context, req *v1.TxnPutRequest) (*v1.TxnPutResponse, error) {
+	return s.service.TxnPut(ctx, req)
+}
+
+func (s *ControllerServer) Commit(ctx context.Context, req *v1.CommitRequest) (*v1.CommitResponse, error) {
+	return s.service.Commit(ctx, req)
+}
+
+func (s *ControllerServer) Abort(ctx context.Context, req *v1.AbortRequest) (*v1.AbortResponse, error) {
+	return s.service.Abort(ctx, req)
+}
+
+func (s *ControllerServer) Scan(req *v1.ScanRequest, stream v1.Controller_ScanServer) error {
+	return s.service.Scan(req, stream)
+}
+
+func (s *ControllerServer) Watch(req *v1.WatchRequest, stream v1.Controller_WatchServer) error {
+	return s.service.Watch(req, stream)
+}
+
 func (s *ControllerServer) RegisterNode(
 	ctx context.Context, req *v1.RegisterNodeRequest,
 ) (*v1.RegisterNodeResponse, error) {
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+)
+
+const (
+	defaultAntiEntropyInterval = time.Minute
+
+	// merkleFanout is the number of parts a differing range is split in.
+	merkleFanout = 16
+	// merkleLeafKeys is the number of keys under which a differing range is
+	// compared key by key rather than split further.
+	merkleLeafKeys = 64
+	maxMerkleDepth = 4
+)
+
+// WithAntiEntropyInterval sets how often the replicas of every range are
+// compared, 0 to disable it.
+func WithAntiEntropyInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.AntiEntropyInterval = interval
+	}
+}
+
+// AntiEntropy compares the Merkle trees of the ready replicas of every range
+// of the ring, and repairs the keys they disagree on, so replicas converge
+// even for keys never read. It returns the number of keys repaired on at least
+// one replica.
+func (c *Controller) AntiEntropy(ctx context.Context) int {
+	var repaired int
+
+	for _, r := range c.pool.Ranges() {
+		items := make([]*node.Item, 0, len(r.Items))
+
+		for _, item := range r.Items {
+			if item.IsReady() {
+				items = append(items, item)
+			}
+		}
+
+		if len(items) < 2 {
+			continue
+		}
+
+		keys := make(map[string]struct{})
+
+		// every replica is compared with the first one, so a key any of
+		// them disagrees on is found
+		for _, item := range items[1:] {
+			diff, err := c.diffReplicas(ctx, items[0], item, &v1.KeyRange{Start: r.Range.Start, End: r.Range.End})
+			if err != nil {
+				c.logger.Error("anti-entropy between nodes %s and %s failed: %v", items[0].ID(), item.ID(), err)
+
+				continue
+			}
+
+			for _, key := range diff {
+				keys[key] = struct{}{}
+			}
+		}
+
+		for key := range keys {
+			n, err := c.reconcile(ctx, key, items)
+			if err != nil {
+				c.logger.Error("anti-entropy of %q failed: %v", key, err)
+
+				continue
+			}
+
+			// the replicas may differ on what the repair leaves as is
+			if n > 0 {
+				repaired++
+			}
+		}
+	}
+
+	if repaired > 0 {
+		c.logger.Info("anti-entropy repaired %d key(s)", repaired)
+		c.metrics.antiEntropyKeys.Add(int64(repaired))
+	}
+
+	return repaired
+}
+
+// diffReplicas returns the keys of the range the two replicas disagree on.
+func (c *Controller) diffReplicas(ctx context.Context, a, b *node.Item, r *v1.KeyRange) ([]string, error) {
+	ra, err := c.merkleRoot(ctx, a, r)
+	if err != nil {
+		return nil, err
+	}
+
+	rb, err := c.merkleRoot(ctx, b, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if ra.Hash == rb.Hash && ra.Count == rb.Count {
+		return nil, nil
+	}
+
+	return c.diffRange(ctx, a, b, &v1.MerklePart{Range: r, Count: ra.Count}, &v1.MerklePart{Range: r, Count: rb.Count}, 0)
+}
+
+// diffRange narrows the differing range down through its parts, until it is
+// small enough to compare the keys.
+func (c *Controller) diffRange(ctx context.Context, a, b *node.Item, pa, pb *v1.MerklePart, depth int) ([]string, error) {
+	if depth >= maxMerkleDepth || (pa.Count <= merkleLeafKeys && pb.Count <= merkleLeafKeys) {
+		return c.diffKeys(ctx, a, b, pa.Range)
+	}
+
+	partsA, err := c.merkleParts(ctx, a, pa.Range)
+	if err != nil {
+		return nil, err
+	}
+
+	partsB, err := c.merkleParts(ctx, b, pa.Range)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(partsA) != len(partsB) {
+		return nil, fmt.Errorf("nodes split range in %d and %d parts", len(partsA), len(partsB))
+	}
+
+	var diff []string
+
+	for i := range partsA {
+		if partsA[i].Hash == partsB[i].Hash && partsA[i].Count == partsB[i].Count {
+			continue
+		}
+
+		keys, err := c.diffRange(ctx, a, b, partsA[i], partsB[i], depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		diff = append(diff, keys...)
+	}
+
+	return diff, nil
+}
+
+func (c *Controller) diffKeys(ctx context.Context, a, b *node.Item, r *v1.KeyRange) ([]string, error) {
+	ka, err := c.merkleKeys(ctx, a, r)
+	if err != nil {
+		return nil, err
+	}
+
+	kb, err := c.merkleKeys(ctx, b, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff []string
+
+	for key, digest := range ka {
+		if d, ok := kb[key]; !ok || d != digest {
+			diff = append(diff, key)
+		}
+	}
+
+	for key := range kb {
+		if _, ok := ka[key]; !ok {
+			diff = append(diff, key)
+		}
+	}
+
+	return diff, nil
+}
+
+func (c *Controller) merkleRoot(ctx context.Context, item *node.Item, r *v1.KeyRange) (*v1.MerkleRootResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.replicaTimeout)
+	defer cancel()
+
+	res, err := item.Client().MerkleRoot(ctx, &v1.MerkleRootRequest{Range: r})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting merkle root from node %s: %w", item.ID(), err)
+	}
+
+	return res, nil
+}
+
+func (c *Controller) merkleParts(ctx context.Context, item *node.Item, r *v1.KeyRange) ([]*v1.MerklePart, error) {
+	var parts []*v1.MerklePart
+
+	err := c.merkleRange(ctx, item, &v1.MerkleRangeRequest{Range: r, Parts: merkleFanout}, func(res *v1.MerkleRangeResponse) {
+		parts = append(parts, res.Parts...)
+	})
+
+	return parts, err
+}
+
+func (c *Controller) merkleKeys(ctx context.Context, item *node.Item, r *v1.KeyRange) (map[string]uint64, error) {
+	keys := make(map[string]uint64)
+
+	err := c.merkleRange(ctx, item, &v1.MerkleRangeRequest{Range: r}, func(res *v1.MerkleRangeResponse) {
+		for _, k := range res.Keys {
+			keys[k.Key] = k.Digest
+		}
+	})
+
+	return keys, err
+}
+
+func (c *Controller) merkleRange(
+	ctx context.Context, item *node.Item, req *v1.MerkleRangeRequest, fn func(res *v1.MerkleRangeResponse),
+) error {
+	ctx, cancel := context.WithTimeout(ctx, c.replicaTimeout)
+	defer cancel()
+
+	stream, err := item.Client().MerkleRange(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed getting merkle range from node %s: %w", item.ID(), err)
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed getting merkle range from node %s: %w", item.ID(), err)
+		}
+
+		fn(res)
+	}
+}
+
+// reconcile reads the key from every replica and writes the latest version
+// back to the replicas behind, like a read repair. It returns the number of
+// replicas repaired.
+func (c *Controller) reconcile(ctx context.Context, key string, items []*node.Item) (int, error) {
+	replies := make(map[*node.Item]*v1.GetResponse, len(items))
+	resultCh := c.broadcast(ctx, items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Get(ctx, &v1.GetRequest{Key: key})
+	})
+
+	var lastErr error
+
+	for range items {
+		res := <-resultCh
+
+		switch {
+		case res.err == nil:
+			replies[res.item] = res.res.(*v1.GetResponse)
+		case isNotFound(res.err):
+			replies[res.item] = nil
+		default:
+			lastErr = fmt.Errorf("failed reading from node %s: %w", res.item.ID(), res.err)
+		}
+	}
+
+	if lastErr != nil {
+		return 0, lastErr
+	}
+
+	latest, err := resolveReplies(replies)
+	if err != nil {
+		return 0, err
+	}
+
+	if latest != nil && latest.PnCounter {
+		return c.reconcileCounter(ctx, key, items)
+	}
+
+	return c.repair(key, replies, nil, 0), nil
+}
+
+func (c *Controller) reconcileCounter(ctx context.Context, key string, items []*node.Item) (int, error) {
+	replies := make(map[*node.Item]*v1.GetCounterResponse, len(items))
+	resultCh := c.broadcast(ctx, items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.GetCounter(ctx, &v1.GetCounterRequest{Key: key})
+	})
+
+	var lastErr error
+
+	for range items {
+		res := <-resultCh
+
+		switch {
+		case res.err == nil:
+			replies[res.item] = res.res.(*v1.GetCounterResponse)
+		case isNotFound(res.err):
+			replies[res.item] = nil
+		default:
+			lastErr = fmt.Errorf("failed reading counter from node %s: %w", res.item.ID(), res.err)
+		}
+	}
+
+	if lastErr != nil {
+		return 0, lastErr
+	}
+
+	return c.repairCounters(key, replies, nil, 0), nil
+}
+
+func (c *Controller) startAntiEntropy() {
+	if c.antiEntropyInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(c.antiEntropyInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-t.C:
+			if c.isLeader() {
+				c.AntiEntropy(context.Background())
+			}
+		}
+	}
+}
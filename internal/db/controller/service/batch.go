@@ -0,0 +1,341 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Batch applies the operations in a single round of requests. The keys are
+// grouped by their first ready replica, which applies its group as one atomic
+// batch and resolves the increments. The applied operations are then
+// replicated in one batch per replica. A batch is atomic on every replica,
+// not across replicas: a replica failing does not undo the others, so the
+// groups already applied stay applied when the batch fails. As for Increment,
+// the replicas applying increments are first brought up to the latest counter
+// of a read quorum.
+func (c *Controller) Batch(ctx context.Context, req *v1.BatchRequest) (*v1.BatchResponse, error) {
+	if len(req.Ops) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no operations")
+	}
+
+	req.Replica = false
+	w := c.writeQuorum(req.Consistency, c.pool.ReplicationFactor())
+
+	replicas := make(map[string][]*node.Item, len(req.Ops))
+
+	for _, op := range req.Ops {
+		if err := validateBatchOp(op); err != nil {
+			return nil, err
+		}
+
+		if _, ok := replicas[op.Key]; ok {
+			continue
+		}
+
+		items := c.replicas(op.Key)
+		if len(items) == 0 || len(items) < w {
+			return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+				"write quorum not reachable for %q: %d of %d replicas ready", op.Key, len(items), w,
+			))
+		}
+
+		replicas[op.Key] = items
+	}
+
+	counters, err := c.latestCounters(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Version = c.clock.Now()
+
+	applied, coordinators, err := c.coordinateBatch(ctx, req, replicas, counters)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range applied {
+		c.clock.Update(op.Version)
+	}
+
+	if err := c.replicateBatch(ctx, applied, replicas, coordinators, w); err != nil {
+		return nil, err
+	}
+
+	return &v1.BatchResponse{Ops: applied}, nil
+}
+
+// coordinateBatch applies the operations on the first ready replica of their
+// key, every replica applying all of its keys in one batch. The keys of a
+// failing replica move to their next replica, unless the group increments and
+// the replica was reached: it may have applied the group before failing, and
+// the increments would be counted twice. A replica is first repaired with the
+// counters it increments.
+func (c *Controller) coordinateBatch(
+	ctx context.Context, req *v1.BatchRequest, replicas map[string][]*node.Item, counters map[string]*v1.GetResponse,
+) ([]*v1.BatchOp, map[string]*node.Item, error) {
+	applied := make([]*v1.BatchOp, 0, len(req.Ops))
+	coordinators := make(map[string]*node.Item, len(replicas))
+	failed := make(map[*node.Item]bool)
+	pending := req.Ops
+
+	for len(pending) > 0 {
+		groups := make(map[*node.Item][]*v1.BatchOp)
+
+		for _, op := range pending {
+			item := firstReplica(replicas[op.Key], failed)
+			if item == nil {
+				return nil, nil, status.Error(codes.Unavailable, fmt.Sprintf(
+					"no replica could apply the batch for %q", op.Key,
+				))
+			}
+
+			groups[item] = append(groups[item], op)
+		}
+
+		items := make([]*node.Item, 0, len(groups))
+		for item := range groups {
+			items = append(items, item)
+		}
+
+		resultCh := c.broadcastEach(ctx, items, func(ctx context.Context, item *node.Item) (interface{}, error) {
+			// a replica failing the repair is not sent the batch, so it
+			// fails as unreachable and its keys move to the next replica
+			for _, op := range groups[item] {
+				if err := c.repairCoordinator(ctx, item, op.Key, counters[op.Key]); err != nil {
+					return nil, err
+				}
+			}
+
+			return item.Client().Batch(ctx, &v1.BatchRequest{Ops: groups[item], Version: req.Version})
+		})
+
+		pending = nil
+
+		for range items {
+			r := <-resultCh
+
+			if r.err != nil {
+				if isClientError(r.err) {
+					return nil, nil, r.err
+				}
+
+				c.logger.Error("coordinate batch on node %s failed: %v", r.item.ID(), r.err)
+
+				if increments(groups[r.item]) && !isUnreachable(r.err) {
+					return nil, nil, status.Error(codes.Unavailable, fmt.Sprintf(
+						"batch on node %s failed, it may have been applied: %v", r.item.ID(), r.err,
+					))
+				}
+
+				failed[r.item] = true
+				pending = append(pending, groups[r.item]...)
+
+				continue
+			}
+
+			for _, op := range groups[r.item] {
+				coordinators[op.Key] = r.item
+			}
+
+			applied = append(applied, r.res.(*v1.BatchResponse).Ops...)
+		}
+	}
+
+	return applied, coordinators, nil
+}
+
+// latestCounters reads the counters the batch increments from a read quorum,
+// in parallel. The keys holding no counter are left out.
+func (c *Controller) latestCounters(ctx context.Context, req *v1.BatchRequest) (map[string]*v1.GetResponse, error) {
+	keys := make(map[string]struct{})
+
+	for _, op := range req.Ops {
+		if op.Type == v1.BatchOp_BATCH_OP_INCREMENT {
+			keys[op.Key] = struct{}{}
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var lastErr error
+
+	counters := make(map[string]*v1.GetResponse, len(keys))
+
+	for key := range keys {
+		wg.Add(1)
+
+		go func(key string) {
+			defer wg.Done()
+
+			latest, err := c.latestCounter(ctx, key, req.Consistency)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case err != nil:
+				lastErr = err
+			case latest != nil:
+				counters[key] = latest
+			}
+		}(key)
+	}
+
+	wg.Wait()
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	return counters, nil
+}
+
+// increments tells whether applying the operations twice counts twice.
+func increments(ops []*v1.BatchOp) bool {
+	for _, op := range ops {
+		if op.Type == v1.BatchOp_BATCH_OP_INCREMENT || op.Type == v1.BatchOp_BATCH_OP_INCREMENT_COUNTER {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replicateBatch sends the applied operations to the replicas besides their
+// coordinator, one batch per replica, and returns once every key was
+// acknowledged by w replicas, its coordinator included.
+func (c *Controller) replicateBatch(
+	ctx context.Context,
+	applied []*v1.BatchOp,
+	replicas map[string][]*node.Item,
+	coordinators map[string]*node.Item,
+	w int,
+) error {
+	groups := make(map[*node.Item][]*v1.BatchOp)
+	acks := make(map[string]int)
+
+	for _, op := range applied {
+		acks[op.Key] = 1
+
+		for _, item := range replicas[op.Key] {
+			if item != coordinators[op.Key] {
+				groups[item] = append(groups[item], op)
+			}
+		}
+	}
+
+	items := make([]*node.Item, 0, len(groups))
+	for item := range groups {
+		items = append(items, item)
+	}
+
+	c.hintDownBatch(applied)
+
+	resultCh := c.broadcastEach(ctx, items, func(ctx context.Context, item *node.Item) (interface{}, error) {
+		return c.hinted(groups[item][0].Key, batchHint(groups[item]))(ctx, item)
+	})
+
+	missing := quorumMissing(acks, w)
+
+	var lastErr error
+
+	for i := 0; i < len(items) && missing > 0; i++ {
+		r := <-resultCh
+
+		if r.err != nil {
+			c.logger.Error("replicate batch to node %s failed: %v", r.item.ID(), r.err)
+			lastErr = r.err
+
+			continue
+		}
+
+		seen := make(map[string]bool, len(groups[r.item]))
+
+		for _, op := range groups[r.item] {
+			if !seen[op.Key] {
+				seen[op.Key] = true
+				acks[op.Key]++
+			}
+		}
+
+		missing = quorumMissing(acks, w)
+	}
+
+	if missing > 0 {
+		return status.Error(codes.Unavailable, fmt.Sprintf(
+			"write quorum not reached for %d key(s): %v", missing, lastErr,
+		))
+	}
+
+	return nil
+}
+
+// hintDownBatch keeps the operations for the replicas of their key that are
+// not ready or that the key is moving to, one batch per replica.
+func (c *Controller) hintDownBatch(applied []*v1.BatchOp) {
+	groups := make(map[string][]*v1.BatchOp)
+
+	for _, op := range applied {
+		for _, item := range c.pool.Preference(op.Key) {
+			if !item.IsReady() {
+				groups[item.ID()] = append(groups[item.ID()], op)
+			}
+		}
+
+		for _, item := range c.pool.Pending(op.Key) {
+			groups[item.ID()] = append(groups[item.ID()], op)
+		}
+	}
+
+	for id, ops := range groups {
+		c.hint(id, ops[0].Key, batchHint(ops))
+	}
+}
+
+func validateBatchOp(op *v1.BatchOp) error {
+	if op.Key == "" {
+		return status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	switch op.Type {
+	case v1.BatchOp_BATCH_OP_PUT,
+		v1.BatchOp_BATCH_OP_DELETE,
+		v1.BatchOp_BATCH_OP_INCREMENT,
+		v1.BatchOp_BATCH_OP_INCREMENT_COUNTER:
+		return nil
+	default:
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%q: unsupported operation %s", op.Key, op.Type))
+	}
+}
+
+func firstReplica(items []*node.Item, failed map[*node.Item]bool) *node.Item {
+	for _, item := range items {
+		if !failed[item] {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// quorumMissing returns how many keys were acknowledged by less than w
+// replicas.
+func quorumMissing(acks map[string]int, w int) int {
+	var missing int
+
+	for _, n := range acks {
+		if n < w {
+			missing++
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+	"emag-homework/internal/db/store"
+	"emag-homework/internal/db/vclock"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// putCausal writes in causal mode. The first ready replica coordinates the
+// write: it creates the vector clock of the new value, which is then
+// replicated to the other replicas as is. The write only moves to the next
+// replica when the first one could not be reached: a replica applying it twice
+// would keep it twice, as two siblings.
+func (c *Controller) putCausal(ctx context.Context, req *v1.PutRequest, w int) (*v1.PutResponse, error) {
+	items := c.replicas(req.Key)
+	if len(items) == 0 || len(items) < w {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+			"write quorum not reachable: %d of %d replicas ready", len(items), w,
+		))
+	}
+
+	r, rest, err := c.coordinateOnce(ctx, req.Key, items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Put(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := r.(*v1.PutResponse)
+
+	replica := &v1.PutRequest{
+		Key:     req.Key,
+		Value:   req.Value,
+		Version: req.Version,
+		Causal:  true,
+		Clock:   res.Clock,
+	}
+
+	err = c.writeTo(ctx, req.Key, rest, w-1, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Put(ctx, replica)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.PutResponse{Clock: res.Clock}, nil
+}
+
+// resolveReplies returns the latest reply. For keys written in causal mode,
+// the siblings of all replies are merged instead.
+func resolveReplies(replies map[*node.Item]*v1.GetResponse) (*v1.GetResponse, error) {
+	latest := latestReply(replies)
+	if latest == nil || latest.Tombstone || len(latest.Siblings) == 0 {
+		return latest, nil
+	}
+
+	siblings := make([]store.Sibling, 0)
+
+	for _, reply := range replies {
+		if reply == nil {
+			continue
+		}
+
+		sibs, err := toSiblings(reply.Siblings)
+		if err != nil {
+			return nil, err
+		}
+
+		siblings = store.MergeSiblings(siblings, sibs)
+	}
+
+	res := &v1.GetResponse{
+		Siblings: make([]*v1.Sibling, 0, len(siblings)),
+	}
+
+	clock := vclock.VectorClock{}
+
+	for _, sib := range siblings {
+		clock = clock.Merge(sib.Clock.Clock())
+
+		if sib.Version > res.Version {
+			res.Value, res.Version = sib.Value, sib.Version
+		}
+
+		res.Siblings = append(res.Siblings, &v1.Sibling{
+			Value:   sib.Value,
+			Version: sib.Version,
+			Clock:   sib.Clock.Encode(),
+		})
+	}
+
+	res.Context = clock.Encode()
+
+	return res, nil
+}
+
+// missesSiblings reports whether the reply is behind the merged siblings.
+func missesSiblings(latest, reply *v1.GetResponse) bool {
+	if len(latest.Siblings) == 0 {
+		return false
+	}
+
+	want, err := vclock.Decode(latest.Context)
+	if err != nil {
+		return false
+	}
+
+	got, err := vclock.Decode(reply.Context)
+	if err != nil {
+		return true
+	}
+
+	return got.Compare(want) != vclock.Equal
+}
+
+func repairSiblings(ctx context.Context, client v1.NodeClient, key string, siblings []*v1.Sibling) error {
+	for _, sib := range siblings {
+		_, err := client.Put(ctx, &v1.PutRequest{
+			Key:     key,
+			Value:   sib.Value,
+			Version: sib.Version,
+			Causal:  true,
+			Clock:   sib.Clock,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func toSiblings(in []*v1.Sibling) ([]store.Sibling, error) {
+	out := make([]store.Sibling, 0, len(in))
+
+	for _, sib := range in {
+		clock, err := vclock.DecodeDotted(sib.Clock)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, store.Sibling{
+			Value:   sib.Value,
+			Version: sib.Version,
+			Clock:   clock,
+		})
+	}
+
+	return out, nil
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Increment adds the delta to the counter of the key. The first ready replica
+// applies the delta, so concurrent increments are serialized by it, and the
+// resulting value is then replicated to the other replicas as is. The replica
+// is first brought up to the latest counter of a read quorum, so it does not
+// add to a value it missed. The delta is not retried on another replica: a
+// replica failing to answer may have applied it already.
+func (c *Controller) Increment(ctx context.Context, req *v1.IncrementRequest) (*v1.IncrementResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	req.Replica = false
+	n := c.pool.ReplicationFactor()
+	w := c.writeQuorum(req.Consistency, n)
+
+	items := c.replicas(req.Key)
+	if len(items) == 0 || len(items) < w {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+			"write quorum not reachable: %d of %d replicas ready", len(items), w,
+		))
+	}
+
+	latest, err := c.latestCounter(ctx, req.Key, req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, rest := items[0], items[1:]
+
+	if err := c.repairCoordinator(ctx, primary, req.Key, latest); err != nil {
+		return nil, err
+	}
+
+	req.Version = c.clock.Now()
+
+	cctx, cancel := context.WithTimeout(ctx, c.replicaTimeout)
+	res, err := primary.Client().Increment(cctx, req)
+	cancel()
+
+	if err != nil {
+		if isClientError(err) {
+			return nil, err
+		}
+
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+			"increment on node %s failed, it may have been applied: %v", primary.ID(), err,
+		))
+	}
+
+	c.clock.Update(res.Version)
+
+	replica := &v1.IncrementRequest{
+		Key:     req.Key,
+		Version: res.Version,
+		Replica: true,
+		Value:   res.Value,
+	}
+
+	err = c.writeTo(ctx, req.Key, rest, w-1, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Increment(ctx, replica)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// latestCounter reads the counter of the key from a read quorum, nil when the
+// key holds no counter, and observes its version.
+func (c *Controller) latestCounter(ctx context.Context, key string, consistency v1.Consistency) (*v1.GetResponse, error) {
+	latest, err := c.read(ctx, key, c.readQuorum(consistency, c.pool.ReplicationFactor()))
+	if err != nil {
+		return nil, err
+	}
+
+	if latest == nil || !latest.Counter {
+		return nil, nil
+	}
+
+	c.clock.Update(latest.Version)
+
+	return latest, nil
+}
+
+// repairCoordinator brings the replica about to apply a delta up to the latest
+// counter, so it does not add to a value it missed.
+func (c *Controller) repairCoordinator(ctx context.Context, item *node.Item, key string, latest *v1.GetResponse) error {
+	if latest == nil {
+		return nil
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, c.replicaTimeout)
+	_, err := repairCounter(cctx, item.Client(), key, latest)
+	cancel()
+
+	if err != nil && !isSuperseded(err) {
+		return status.Error(codes.Unavailable, fmt.Sprintf(
+			"failed updating counter %q on node %s: %v", key, item.ID(), err,
+		))
+	}
+
+	return nil
+}
+
+func repairCounter(ctx context.Context, client v1.NodeClient, key string, latest *v1.GetResponse) (interface{}, error) {
+	value, err := strconv.ParseInt(string(latest.Value), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing counter: %w", err)
+	}
+
+	return client.Increment(ctx, &v1.IncrementRequest{
+		Key:     key,
+		Version: latest.Version,
+		Replica: true,
+		Value:   value,
+	})
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultGossipInterval = time.Second * 5
+
+// WithGossipInterval sets how often the membership gossiped between the nodes
+// is read, 0 to disable it.
+func WithGossipInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.GossipInterval = interval
+	}
+}
+
+// SyncGossip reads the membership the ready nodes gossip between them. The
+// nodes they suspect or declared dead stop serving requests until the health
+// check finds them ready again, which is sooner than the health check alone
+// would notice them failing. Once per controller, the leader also adds the
+// alive nodes it does not know, so a controller restarted without its state
+// learns the cluster from the first node registering. Nodes not gossiping are
+// skipped.
+func (c *Controller) SyncGossip(ctx context.Context) error {
+	items := c.pool.Select()
+	if len(items) == 0 {
+		return nil
+	}
+
+	resultCh := c.broadcastEach(ctx, items, func(ctx context.Context, item *node.Item) (interface{}, error) {
+		return item.GossipClient().Members(ctx, &v1.MembersRequest{})
+	})
+
+	var answered int
+	var lastErr error
+
+	view := make(map[string]*v1.Member)
+
+	for range items {
+		res := <-resultCh
+
+		if res.err != nil {
+			if status.Code(res.err) != codes.Unimplemented {
+				lastErr = fmt.Errorf("failed reading gossip of node %s: %w", res.item.ID(), res.err)
+			}
+
+			continue
+		}
+
+		answered++
+
+		for _, m := range res.res.(*v1.MembersResponse).Members {
+			if known, ok := view[m.Id]; !ok || gossipOverrides(m, known) {
+				view[m.Id] = m
+			}
+		}
+	}
+
+	if answered == 0 {
+		return lastErr
+	}
+
+	seed := c.isLeader() && !c.gossipSeeded.Swap(true)
+
+	for _, m := range view {
+		item, ok := c.pool.Get(m.Id)
+
+		switch {
+		case ok && m.State != v1.Member_STATE_ALIVE:
+			if item.IsReady() {
+				c.logger.Info("gossip reports node %s at %s %s", m.Id, m.Address, m.State)
+			}
+
+			c.pool.MarkError(m.Id)
+		case !ok && seed && m.State == v1.Member_STATE_ALIVE:
+			c.logger.Info("adding node %s at %s learnt from gossip", m.Id, m.Address)
+
+			res, err := c.propose(ctx, membershipCmd{Op: addNodeOp, ID: m.Id, Address: m.Address})
+			if err == nil {
+				err = res.err
+			}
+
+			if err != nil {
+				c.gossipSeeded.Store(false)
+
+				return fmt.Errorf("failed adding node %s learnt from gossip: %w", m.Id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// gossipOverrides tells whether a node knows more of the member than another
+// one, the way the nodes decide it: a higher incarnation, or a worse state at
+// the same one.
+func gossipOverrides(m, known *v1.Member) bool {
+	if m.Incarnation != known.Incarnation {
+		return m.Incarnation > known.Incarnation
+	}
+
+	return m.State > known.State
+}
+
+func (c *Controller) startGossipSync() {
+	if c.gossipInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(c.gossipInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-t.C:
+			if err := c.SyncGossip(context.Background()); err != nil {
+				c.logger.Error("gossip sync failed: %v", err)
+			}
+		}
+	}
+}
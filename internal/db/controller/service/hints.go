@@ -0,0 +1,308 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+)
+
+const (
+	defaultMaxHints           = 10000
+	defaultHintTTL            = time.Hour
+	defaultHintReplayInterval = time.Second * 10
+)
+
+// hint is a write a replica missed, handed off to it once it is back. Every
+// write is versioned, so replaying it late or twice is harmless.
+type hint struct {
+	key       string
+	call      replicaCall
+	createdAt time.Time
+}
+
+// hintStore keeps the hints of every node, up to max hints in total. Hints
+// older than ttl are dropped: the replica is then left to read repair.
+type hintStore struct {
+	mu    sync.Mutex
+	hints map[string][]hint
+	count int
+	max   int
+	ttl   time.Duration
+}
+
+func newHintStore(max int, ttl time.Duration) *hintStore {
+	return &hintStore{
+		hints: make(map[string][]hint),
+		max:   max,
+		ttl:   ttl,
+	}
+}
+
+// add stores the hint unless the store is full, returning whether it did.
+func (h *hintStore) add(id string, hi hint) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count >= h.max {
+		h.expire(time.Now())
+	}
+
+	if h.count >= h.max {
+		return false
+	}
+
+	h.hints[id] = append(h.hints[id], hi)
+	h.count++
+
+	return true
+}
+
+// take removes the hints of the node and returns the ones not expired, along
+// with how many expired.
+func (h *hintStore) take(id string) ([]hint, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hints := h.hints[id]
+	delete(h.hints, id)
+	h.count -= len(hints)
+
+	threshold := time.Now().Add(-h.ttl)
+	live := hints[:0]
+
+	for _, hi := range hints {
+		if hi.createdAt.After(threshold) {
+			live = append(live, hi)
+		}
+	}
+
+	return live, len(hints) - len(live)
+}
+
+// putBack stores again the hints a replay did not get through.
+func (h *hintStore) putBack(id string, hints []hint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.hints[id] = append(hints, h.hints[id]...)
+	h.count += len(hints)
+}
+
+func (h *hintStore) drop(id string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := len(h.hints[id])
+	delete(h.hints, id)
+	h.count -= n
+
+	return n
+}
+
+// nodes returns the nodes having hints.
+func (h *hintStore) nodes() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := make([]string, 0, len(h.hints))
+
+	for id := range h.hints {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// pending returns how many hints the node has.
+func (h *hintStore) pending(id string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.hints[id])
+}
+
+func (h *hintStore) size() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.count
+}
+
+func (h *hintStore) expire(now time.Time) {
+	threshold := now.Add(-h.ttl)
+
+	for id, hints := range h.hints {
+		live := hints[:0]
+
+		for _, hi := range hints {
+			if hi.createdAt.After(threshold) {
+				live = append(live, hi)
+			}
+		}
+
+		h.count -= len(hints) - len(live)
+
+		if len(live) == 0 {
+			delete(h.hints, id)
+		} else {
+			h.hints[id] = live
+		}
+	}
+}
+
+// WithMaxHints sets how many writes are kept in total for the replicas that
+// missed them.
+func WithMaxHints(n int) Option {
+	return func(cfg *Config) {
+		cfg.MaxHints = n
+	}
+}
+
+// WithHintTTL sets how long a write is kept for a replica that missed it. It
+// must be shorter than the tombstone grace period of the nodes, otherwise a
+// late write can bring a purged key back.
+func WithHintTTL(ttl time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.HintTTL = ttl
+	}
+}
+
+// WithHintReplayInterval sets how often the writes missed by ready replicas
+// are replayed, besides when a replica is marked ready again.
+func WithHintReplayInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.HintReplayInterval = interval
+	}
+}
+
+// hint keeps the write for the node to replay it later.
+func (c *Controller) hint(id, key string, call replicaCall) {
+	if !c.hints.add(id, hint{key: key, call: call, createdAt: time.Now()}) {
+		c.logger.Error("hint for %q on node %s dropped: %d hints stored", key, id, c.hints.size())
+		c.metrics.hintsDropped.Add(1)
+
+		return
+	}
+
+	c.metrics.hintsStored.Add(1)
+}
+
+// hintDown keeps the write for the replicas of the key that are not ready,
+// and for the nodes the key is moving to.
+func (c *Controller) hintDown(key string, call replicaCall) {
+	for _, item := range c.pool.Preference(key) {
+		if !item.IsReady() {
+			c.hint(item.ID(), key, call)
+		}
+	}
+
+	for _, item := range c.pool.Pending(key) {
+		c.hint(item.ID(), key, call)
+	}
+}
+
+// hinted wraps the call so that a replica failing it gets a hint.
+func (c *Controller) hinted(key string, call replicaCall) func(ctx context.Context, item *node.Item) (interface{}, error) {
+	return func(ctx context.Context, item *node.Item) (interface{}, error) {
+		res, err := call(ctx, item.Client())
+		if err != nil && !isSuperseded(err) && !isClientError(err) {
+			c.hint(item.ID(), key, call)
+		}
+
+		return res, err
+	}
+}
+
+// ReplayHints hands the writes they missed off to the ready nodes. The hints
+// are the ones of the writes this controller coordinated, which no other
+// controller holds, so every controller replays its own, leader or not.
+func (c *Controller) ReplayHints() {
+	ready := make(map[string]*node.Item)
+
+	for _, item := range c.pool.Select() {
+		ready[item.ID()] = item
+	}
+
+	for _, id := range c.hints.nodes() {
+		if item, ok := ready[id]; ok {
+			if err := c.replayHints(item); err != nil {
+				c.logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+// replayNode replays the hints of a node marked ready again.
+func (c *Controller) replayNode(id string) {
+	for _, item := range c.pool.Select() {
+		if item.ID() == id {
+			go func() {
+				if err := c.replayHints(item); err != nil {
+					c.logger.Error(err.Error())
+				}
+			}()
+
+			return
+		}
+	}
+}
+
+// replayHints hands the hints of the node off to it, in order. The hints not
+// handed off are kept, and the error is returned.
+func (c *Controller) replayHints(item *node.Item) error {
+	hints, expired := c.hints.take(item.ID())
+	if expired > 0 {
+		c.logger.Error("%d hint(s) for node %s expired", expired, item.ID())
+		c.metrics.hintsDropped.Add(int64(expired))
+	}
+
+	if len(hints) == 0 {
+		return nil
+	}
+
+	for i, hi := range hints {
+		ctx, cancel := context.WithTimeout(context.Background(), c.replicaTimeout)
+		_, err := hi.call(ctx, item.Client())
+		cancel()
+
+		if err != nil && !isSuperseded(err) && !isClientError(err) {
+			c.hints.putBack(item.ID(), hints[i:])
+
+			return fmt.Errorf("failed replaying hint for %q on node %s: %w", hi.key, item.ID(), err)
+		}
+
+		c.metrics.hintsReplayed.Add(1)
+	}
+
+	c.logger.Info("replayed %d hint(s) on node %s", len(hints), item.ID())
+
+	return nil
+}
+
+func (c *Controller) startHintReplay() {
+	t := time.NewTicker(c.hintReplayInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-t.C:
+			c.ReplayHints()
+		}
+	}
+}
+
+// batchHint is the call replaying the operations on a replica.
+func batchHint(ops []*v1.BatchOp) replicaCall {
+	return func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Batch(ctx, &v1.BatchRequest{Ops: ops, Replica: true})
+	}
+}
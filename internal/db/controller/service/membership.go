@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Replicator replicates the membership changes between the controllers of the
+// cluster, such as a raft.Raft. The changes are applied in the same order by
+// every controller, through Apply.
+type Replicator interface {
+	Propose(ctx context.Context, cmd []byte) (interface{}, error)
+	IsLeader() bool
+}
+
+// WithReplicator makes the controller one of several sharing the membership.
+// Only the leader changes it, moves the keys and repairs the replicas.
+func WithReplicator(replicator Replicator) Option {
+	return func(cfg *Config) {
+		cfg.Replicator = replicator
+	}
+}
+
+const (
+	addNodeOp    = "add"
+	removeNodeOp = "remove"
+	commitOp     = "commit"
+)
+
+type membershipCmd struct {
+	Op      string `json:"op"`
+	ID      string `json:"id,omitempty"`
+	Address string `json:"address,omitempty"`
+	Epoch   uint64 `json:"epoch,omitempty"`
+}
+
+type membershipResult struct {
+	err     error
+	removed []string
+	ok      bool
+}
+
+// Apply applies a membership change agreed on by the controllers.
+func (c *Controller) Apply(b []byte) interface{} {
+	var cmd membershipCmd
+
+	if err := json.Unmarshal(b, &cmd); err != nil {
+		return membershipResult{err: fmt.Errorf("failed json decoding membership change: %w", err)}
+	}
+
+	switch cmd.Op {
+	case addNodeOp:
+		return membershipResult{err: c.addNode(cmd.ID, cmd.Address)}
+	case removeNodeOp:
+		return membershipResult{err: c.removeNode(cmd.ID)}
+	case commitOp:
+		removed, ok := c.commitRing(cmd.Epoch)
+
+		return membershipResult{removed: removed, ok: ok}
+	default:
+		return membershipResult{err: fmt.Errorf("unknown membership change %q", cmd.Op)}
+	}
+}
+
+// propose has the controllers apply the membership change, or applies it
+// right away for a single controller.
+func (c *Controller) propose(ctx context.Context, cmd membershipCmd) (membershipResult, error) {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return membershipResult{}, fmt.Errorf("failed json encoding membership change: %w", err)
+	}
+
+	if c.replicator == nil {
+		return c.Apply(b).(membershipResult), nil
+	}
+
+	res, err := c.replicator.Propose(ctx, b)
+	if err != nil {
+		return membershipResult{}, fmt.Errorf("failed replicating membership change: %w", err)
+	}
+
+	return res.(membershipResult), nil
+}
+
+// isLeader tells whether the controller moves the keys and repairs the
+// replicas.
+func (c *Controller) isLeader() bool {
+	return c.replicator == nil || c.replicator.IsLeader()
+}
+
+func (c *Controller) addNode(id, address string) error {
+	item, err := c.pool.Add(id, address)
+	if err != nil {
+		return fmt.Errorf("failed adding node to pool: %w", err)
+	}
+
+	c.checkNode(item)
+	c.notifyRebalance()
+
+	return nil
+}
+
+func (c *Controller) removeNode(id string) error {
+	if err := c.pool.Remove(id); err != nil {
+		return fmt.Errorf("failed removing node from pool: %w", err)
+	}
+
+	// a node owning keys leaves once they moved to their new replicas
+	if _, ok := c.pool.Get(id); ok {
+		c.notifyRebalance()
+
+		return nil
+	}
+
+	c.healthzChecker.Remove(id)
+
+	if n := c.hints.drop(id); n > 0 {
+		c.logger.Info("dropped %d hint(s) for unregistered node %s", n, id)
+	}
+
+	return nil
+}
+
+// commitRing switches the keys over to their new replicas, when the
+// membership did not change since epoch.
+func (c *Controller) commitRing(epoch uint64) ([]string, bool) {
+	removed, ok := c.pool.Commit(epoch)
+
+	for _, id := range removed {
+		c.healthzChecker.Remove(id)
+
+		if n := c.hints.drop(id); n > 0 {
+			c.logger.Info("dropped %d hint(s) for removed node %s", n, id)
+		}
+	}
+
+	return removed, ok
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const defaultMetricsInterval = time.Minute
+
+// WithMetricsInterval sets how often the metrics are logged, when they changed
+// since logged last, 0 to disable it.
+func WithMetricsInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.MetricsInterval = interval
+	}
+}
+
+// Metrics is a snapshot of the counters kept by the controller.
+type Metrics struct {
+	// ReadRepairs is the number of replicas found behind on read and
+	// written back with the latest version.
+	ReadRepairs int64
+	// ReadRepairErrors is the number of read repairs that failed.
+	ReadRepairErrors int64
+	// HintsStored is the number of writes kept for replicas that missed them.
+	HintsStored int64
+	// HintsReplayed is the number of those writes handed off to the replica.
+	HintsReplayed int64
+	// HintsDropped is the number of those writes dropped, because too many
+	// were stored or because they expired.
+	HintsDropped int64
+	// HintsPending is the number of writes waiting for their replica.
+	HintsPending int64
+	// AntiEntropyKeys is the number of keys replicas disagreed on, found by
+	// comparing their Merkle trees, and repaired on at least one replica.
+	AntiEntropyKeys int64
+	// RebalanceKeys is the number of keys copied to new replicas after nodes
+	// joined or left.
+	RebalanceKeys int64
+}
+
+type metrics struct {
+	readRepairs      atomic.Int64
+	readRepairErrors atomic.Int64
+	hintsStored      atomic.Int64
+	hintsReplayed    atomic.Int64
+	hintsDropped     atomic.Int64
+	antiEntropyKeys  atomic.Int64
+	rebalanceKeys    atomic.Int64
+}
+
+func (c *Controller) Metrics() Metrics {
+	return Metrics{
+		ReadRepairs:      c.metrics.readRepairs.Load(),
+		ReadRepairErrors: c.metrics.readRepairErrors.Load(),
+		HintsStored:      c.metrics.hintsStored.Load(),
+		HintsReplayed:    c.metrics.hintsReplayed.Load(),
+		HintsDropped:     c.metrics.hintsDropped.Load(),
+		HintsPending:     int64(c.hints.size()),
+		AntiEntropyKeys:  c.metrics.antiEntropyKeys.Load(),
+		RebalanceKeys:    c.metrics.rebalanceKeys.Load(),
+	}
+}
+
+func (c *Controller) startMetricsLog() {
+	if c.metricsInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(c.metricsInterval)
+	defer t.Stop()
+
+	var last Metrics
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-t.C:
+			m := c.Metrics()
+			if m == last {
+				continue
+			}
+
+			last = m
+
+			c.logger.Info(
+				"metrics: read repairs %d (%d failed), hints stored %d, replayed %d, dropped %d, pending %d, "+
+					"anti-entropy keys %d, rebalance keys %d",
+				m.ReadRepairs, m.ReadRepairErrors, m.HintsStored, m.HintsReplayed, m.HintsDropped, m.HintsPending,
+				m.AntiEntropyKeys, m.RebalanceKeys,
+			)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+	"emag-homework/internal/db/store"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IncrementCounter adds the delta to the PN-counter of the key. The first
+// ready replica adds it to its own slots, and its counter is then merged into
+// the other replicas. Increments coordinated by different replicas land in
+// different slots, so none of them is lost. The delta only moves to the next
+// replica when the first one could not be reached, else it could be counted
+// twice. The caller is told instead, and decides whether to retry.
+func (c *Controller) IncrementCounter(
+	ctx context.Context, req *v1.IncrementCounterRequest,
+) (*v1.IncrementCounterResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	req.Version = c.clock.Now()
+	req.State = nil
+	w := c.writeQuorum(req.Consistency, c.pool.ReplicationFactor())
+
+	items := c.replicas(req.Key)
+	if len(items) == 0 || len(items) < w {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+			"write quorum not reachable: %d of %d replicas ready", len(items), w,
+		))
+	}
+
+	r, rest, err := c.coordinateOnce(ctx, req.Key, items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.IncrementCounter(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := r.(*v1.IncrementCounterResponse)
+	c.clock.Update(res.Version)
+
+	replica := &v1.IncrementCounterRequest{
+		Key:     req.Key,
+		Version: res.Version,
+		State:   res.State,
+	}
+
+	err = c.writeTo(ctx, req.Key, rest, w-1, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.IncrementCounter(ctx, replica)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetCounter returns the PN-counter of the key merged from the first r
+// replies. The counter is merged into the replicas missing any of its updates
+// in the background.
+func (c *Controller) GetCounter(ctx context.Context, req *v1.GetCounterRequest) (*v1.GetCounterResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	r := c.readQuorum(req.Consistency, c.pool.ReplicationFactor())
+
+	items := c.replicas(req.Key)
+	if len(items) == 0 || len(items) < r {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+			"read quorum not reachable: %d of %d replicas ready", len(items), r,
+		))
+	}
+
+	var lastErr error
+
+	replies := make(map[*node.Item]*v1.GetCounterResponse, len(items))
+	resultCh := c.broadcast(ctx, items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.GetCounter(ctx, &v1.GetCounterRequest{Key: req.Key})
+	})
+
+	for i := 0; i < len(items); i++ {
+		res := <-resultCh
+
+		switch {
+		case res.err == nil:
+			replies[res.item] = res.res.(*v1.GetCounterResponse)
+		case isNotFound(res.err):
+			replies[res.item] = nil
+		case isClientError(res.err):
+			return nil, res.err
+		default:
+			c.logger.Error("read counter %q from node %s failed: %v", req.Key, res.item.ID(), res.err)
+			lastErr = res.err
+
+			continue
+		}
+
+		if len(replies) >= r {
+			merged := mergeCounters(replies)
+
+			go c.repairCounters(req.Key, replies, resultCh, len(items)-i-1)
+
+			if merged == nil {
+				return nil, status.Error(codes.NotFound, fmt.Sprintf("%q not found", req.Key))
+			}
+
+			c.clock.Update(merged.Version)
+
+			return merged, nil
+		}
+	}
+
+	return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+		"read quorum not reached: %d of %d replies: %v", len(replies), r, lastErr,
+	))
+}
+
+// repairCounters waits for the replies still pending, then merges the counter
+// into every replica whose counter differs. It returns the number of replicas
+// repaired.
+func (c *Controller) repairCounters(
+	key string, replies map[*node.Item]*v1.GetCounterResponse, resultCh <-chan replicaResult, pending int,
+) int {
+	for ; pending > 0; pending-- {
+		res := <-resultCh
+
+		switch {
+		case res.err == nil:
+			replies[res.item] = res.res.(*v1.GetCounterResponse)
+		case isNotFound(res.err):
+			replies[res.item] = nil
+		}
+	}
+
+	merged := mergeCounters(replies)
+	if merged == nil {
+		return 0
+	}
+
+	stale := make([]*node.Item, 0)
+
+	for item, reply := range replies {
+		if reply == nil || !toPNCounter(reply.State).Equal(toPNCounter(merged.State)) {
+			stale = append(stale, item)
+		}
+	}
+
+	if len(stale) == 0 {
+		return 0
+	}
+
+	c.logger.Info("read repair counter %q on %d replica(s)", key, len(stale))
+
+	req := &v1.IncrementCounterRequest{Key: key, Version: merged.Version, State: merged.State}
+	resultCh = c.broadcast(context.Background(), stale, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.IncrementCounter(ctx, req)
+	})
+
+	var repaired int
+
+	for range stale {
+		if res := <-resultCh; res.err != nil {
+			c.logger.Error("read repair counter %q on node %s failed: %v", key, res.item.ID(), res.err)
+			c.metrics.readRepairErrors.Add(1)
+
+			continue
+		}
+
+		repaired++
+	}
+
+	c.metrics.readRepairs.Add(int64(repaired))
+
+	return repaired
+}
+
+// mergeCounters merges the counters of the replies, or returns nil when no
+// replica has the key.
+func mergeCounters(replies map[*node.Item]*v1.GetCounterResponse) *v1.GetCounterResponse {
+	var merged *store.PNCounter
+	var version int64
+
+	for _, reply := range replies {
+		if reply == nil {
+			continue
+		}
+
+		counter := toPNCounter(reply.State)
+		if merged != nil {
+			counter = merged.Merge(counter)
+		}
+
+		merged = &counter
+
+		if reply.Version > version {
+			version = reply.Version
+		}
+	}
+
+	if merged == nil {
+		return nil
+	}
+
+	return &v1.GetCounterResponse{
+		Value:   merged.Value(),
+		Version: version,
+		State:   &v1.PNCounter{P: merged.P, N: merged.N},
+	}
+}
+
+func toPNCounter(c *v1.PNCounter) store.PNCounter {
+	if c == nil {
+		return store.PNCounter{}
+	}
+
+	return store.PNCounter{P: c.P, N: c.N}
+}
@@ -0,0 +1,354 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type replicaCall func(ctx context.Context, client v1.NodeClient) (interface{}, error)
+
+type replicaResult struct {
+	item *node.Item
+	res  interface{}
+	err  error
+}
+
+// broadcast calls every replica in parallel. The calls are detached from the
+// request, so the replicas not needed for the quorum still get the request
+// after the response was sent.
+func (c *Controller) broadcast(ctx context.Context, items []*node.Item, call replicaCall) <-chan replicaResult {
+	return c.broadcastEach(ctx, items, func(ctx context.Context, item *node.Item) (interface{}, error) {
+		return call(ctx, item.Client())
+	})
+}
+
+// broadcastEach is broadcast for calls depending on the replica.
+func (c *Controller) broadcastEach(
+	ctx context.Context, items []*node.Item, call func(ctx context.Context, item *node.Item) (interface{}, error),
+) <-chan replicaResult {
+	resultCh := make(chan replicaResult, len(items))
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.replicaTimeout)
+
+	var wg sync.WaitGroup
+
+	wg.Add(len(items))
+
+	for _, item := range items {
+		go func(item *node.Item) {
+			defer wg.Done()
+
+			res, err := call(ctx, item)
+			resultCh <- replicaResult{item: item, res: res, err: err}
+		}(item)
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
+
+	return resultCh
+}
+
+// write sends the mutation to the replicas of the key and returns once w of
+// them acknowledged it. A replica refusing it for a newer version counts as an
+// acknowledgement.
+func (c *Controller) write(ctx context.Context, key string, w int, call replicaCall) error {
+	items := c.replicas(key)
+	if len(items) == 0 {
+		return status.Error(codes.Unavailable, "no replica ready")
+	}
+
+	return c.writeTo(ctx, key, items, w, call)
+}
+
+func (c *Controller) writeTo(ctx context.Context, key string, items []*node.Item, w int, call replicaCall) error {
+	if len(items) < w {
+		return status.Error(codes.Unavailable, fmt.Sprintf(
+			"write quorum not reachable: %d of %d replicas ready", len(items), w,
+		))
+	}
+
+	var acks int
+	var lastErr error
+
+	// the replicas missing the write get it once they are back
+	c.hintDown(key, call)
+	resultCh := c.broadcastEach(ctx, items, c.hinted(key, call))
+
+	if w <= 0 {
+		return nil
+	}
+
+	for i := 0; i < len(items); i++ {
+		r := <-resultCh
+
+		// a replica holding a newer version already has the data a later
+		// write would overwrite this one with
+		if r.err != nil && !isSuperseded(r.err) {
+			if isClientError(r.err) {
+				return r.err
+			}
+
+			c.logger.Error("write %q to node %s failed: %v", key, r.item.ID(), r.err)
+			lastErr = r.err
+
+			continue
+		}
+
+		acks++
+
+		if acks >= w {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unavailable, fmt.Sprintf(
+		"write quorum not reached: %d of %d acks: %v", acks, w, lastErr,
+	))
+}
+
+// coordinate makes the call on the replicas in order until one of them
+// succeeds, and returns its result along with the replicas left to update.
+func (c *Controller) coordinate(
+	ctx context.Context, key string, items []*node.Item, call replicaCall,
+) (interface{}, []*node.Item, error) {
+	return c.coordinateWhile(ctx, key, items, call, func(error) bool { return true })
+}
+
+// coordinateOnce is coordinate for the calls not to be applied twice, such as
+// increments.
+// It only moves to the next replica when a replica could not be reached: a
+// replica failing otherwise, such as timing out, may have applied the call.
+func (c *Controller) coordinateOnce(
+	ctx context.Context, key string, items []*node.Item, call replicaCall,
+) (interface{}, []*node.Item, error) {
+	return c.coordinateWhile(ctx, key, items, call, isUnreachable)
+}
+
+// coordinateWhile moves to the next replica as long as the failures are
+// retryable.
+func (c *Controller) coordinateWhile(
+	ctx context.Context, key string, items []*node.Item, call replicaCall, retryable func(err error) bool,
+) (interface{}, []*node.Item, error) {
+	for i, item := range items {
+		cctx, cancel := context.WithTimeout(ctx, c.replicaTimeout)
+		res, err := call(cctx, item.Client())
+		cancel()
+
+		if err == nil {
+			rest := make([]*node.Item, 0, len(items)-1)
+			rest = append(rest, items[:i]...)
+			rest = append(rest, items[i+1:]...)
+
+			return res, rest, nil
+		}
+
+		if isClientError(err) {
+			return nil, nil, err
+		}
+
+		c.logger.Error("coordinate %q on node %s failed: %v", key, item.ID(), err)
+
+		if !retryable(err) {
+			return nil, nil, status.Error(codes.Unavailable, fmt.Sprintf(
+				"write of %q on node %s failed, it may have been applied: %v", key, item.ID(), err,
+			))
+		}
+	}
+
+	return nil, nil, status.Error(codes.Unavailable, "no replica could coordinate the write")
+}
+
+// read asks the replicas of the key and returns the reply with the highest
+// version among the first r replies. A replica not having the key counts as a
+// reply. When no replica has the key, a nil reply is returned. The replicas
+// found behind are repaired in the background.
+func (c *Controller) read(ctx context.Context, key string, r int) (*v1.GetResponse, error) {
+	items := c.replicas(key)
+	if len(items) == 0 || len(items) < r {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+			"read quorum not reachable: %d of %d replicas ready", len(items), r,
+		))
+	}
+
+	var lastErr error
+
+	replies := make(map[*node.Item]*v1.GetResponse, len(items))
+	resultCh := c.broadcast(ctx, items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Get(ctx, &v1.GetRequest{Key: key})
+	})
+
+	for i := 0; i < len(items); i++ {
+		res := <-resultCh
+
+		switch {
+		case res.err == nil:
+			replies[res.item] = res.res.(*v1.GetResponse)
+		case isNotFound(res.err):
+			replies[res.item] = nil
+		case isClientError(res.err):
+			return nil, res.err
+		default:
+			c.logger.Error("read %q from node %s failed: %v", key, res.item.ID(), res.err)
+			lastErr = res.err
+
+			continue
+		}
+
+		if len(replies) >= r {
+			latest, err := resolveReplies(replies)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			go c.repair(key, replies, resultCh, len(items)-i-1)
+
+			return latest, nil
+		}
+	}
+
+	return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+		"read quorum not reached: %d of %d replies: %v", len(replies), r, lastErr,
+	))
+}
+
+// repair waits for the replies still pending, then writes the latest version
+// back to every replica that answered with an older one or without the key.
+// It returns the number of replicas repaired.
+func (c *Controller) repair(
+	key string, replies map[*node.Item]*v1.GetResponse, resultCh <-chan replicaResult, pending int,
+) int {
+	for ; pending > 0; pending-- {
+		res := <-resultCh
+
+		switch {
+		case res.err == nil:
+			replies[res.item] = res.res.(*v1.GetResponse)
+		case isNotFound(res.err):
+			replies[res.item] = nil
+		}
+	}
+
+	// PN-counters are merged, not replaced, see repairCounters
+	latest, err := resolveReplies(replies)
+	if err != nil || latest == nil || latest.PnCounter {
+		return 0
+	}
+
+	stale := make([]*node.Item, 0)
+
+	for item, reply := range replies {
+		if reply == nil || newer(latest, reply) || missesSiblings(latest, reply) {
+			stale = append(stale, item)
+		}
+	}
+
+	if len(stale) == 0 {
+		return 0
+	}
+
+	c.logger.Info("read repair %q at version %d on %d replica(s)", key, latest.Version, len(stale))
+
+	resultCh = c.broadcast(context.Background(), stale, writeBack(key, latest))
+
+	var repaired int
+
+	for range stale {
+		res := <-resultCh
+
+		switch {
+		case res.err == nil:
+			repaired++
+		case !isSuperseded(res.err):
+			c.logger.Error("read repair %q on node %s failed: %v", key, res.item.ID(), res.err)
+			c.metrics.readRepairErrors.Add(1)
+		}
+	}
+
+	c.metrics.readRepairs.Add(int64(repaired))
+
+	return repaired
+}
+
+// writeBack is the call writing the latest version of the key back to a
+// replica, as it was read.
+func writeBack(key string, latest *v1.GetResponse) replicaCall {
+	return func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		if latest.Tombstone {
+			return client.Delete(ctx, &v1.DeleteRequest{Key: key, Version: latest.Version})
+		}
+
+		if len(latest.Siblings) > 0 {
+			return nil, repairSiblings(ctx, client, key, latest.Siblings)
+		}
+
+		if latest.Counter {
+			return repairCounter(ctx, client, key, latest)
+		}
+
+		return client.Put(ctx, &v1.PutRequest{
+			Key: key, Value: latest.Value, Version: latest.Version, ExpiresAt: latest.ExpiresAt,
+		})
+	}
+}
+
+func latestReply(replies map[*node.Item]*v1.GetResponse) *v1.GetResponse {
+	var latest *v1.GetResponse
+
+	for _, reply := range replies {
+		if reply != nil && (latest == nil || newer(reply, latest)) {
+			latest = reply
+		}
+	}
+
+	return latest
+}
+
+// newer reports whether a wins over b, resolving equal versions the way the
+// nodes do: a delete wins over a write, then the highest value wins.
+func newer(a, b *v1.GetResponse) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+
+	if a.Tombstone != b.Tombstone {
+		return a.Tombstone
+	}
+
+	if c := bytes.Compare(a.Value, b.Value); c != 0 {
+		return c > 0
+	}
+
+	// a counter written back as a plain value is replaced by the counter
+	return a.Counter && !b.Counter
+}
+
+func isClientError(err error) bool {
+	s := status.Convert(err)
+	if s == nil {
+		return false
+	}
+
+	return s.Code() == codes.InvalidArgument || s.Code() == codes.FailedPrecondition
+}
+
+// isSuperseded reports whether a replica refused a write because it holds a
+// newer version.
+func isSuperseded(err error) bool {
+	return status.Code(err) == codes.Aborted
+}
+
+// isUnreachable reports whether a replica could not be reached, so it did
+// not apply the call. The nodes never answer Unavailable themselves.
+func isUnreachable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
@@ -0,0 +1,368 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+)
+
+const (
+	defaultRebalanceInterval = time.Second * 10
+	defaultRebalanceRate     = 1000
+
+	// maxRebalanceReplays is how many times the hints of a new replica are
+	// replayed before switching the ranges over, the writes going on.
+	maxRebalanceReplays = 3
+)
+
+// RebalanceStatus is the progress of the keys moving between nodes after nodes
+// joined or left.
+type RebalanceStatus struct {
+	// Active is true while ranges are being moved.
+	Active bool
+	// Ranges is the number of ranges to move, RangesDone the number moved.
+	Ranges     int
+	RangesDone int
+	// Keys is the number of keys copied to their new replicas.
+	Keys      int64
+	StartedAt time.Time
+	// Err is why the last rebalance failed, if it did. It is retried.
+	Err error
+}
+
+type rebalancer struct {
+	interval time.Duration
+	rate     int
+	notifyCh chan struct{}
+	// runMu serializes the rebalances, mu guards the status
+	runMu  sync.Mutex
+	mu     sync.Mutex
+	status RebalanceStatus
+}
+
+// WithRebalanceInterval sets how often a failed rebalance is retried.
+func WithRebalanceInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.RebalanceInterval = interval
+	}
+}
+
+// WithRebalanceRate sets how many keys per second are copied to their new
+// replicas at most, 0 for no limit.
+func WithRebalanceRate(rate int) Option {
+	return func(cfg *Config) {
+		cfg.RebalanceRate = rate
+	}
+}
+
+// RebalanceStatus returns the progress of the current or last rebalance.
+func (c *Controller) RebalanceStatus() RebalanceStatus {
+	c.rebalancer.mu.Lock()
+	defer c.rebalancer.mu.Unlock()
+
+	return c.rebalancer.status
+}
+
+// Rebalance moves the ranges changing replicas, after nodes joined or left,
+// to their new replicas, then switches them over. Until then the keys are
+// served by their current replicas, new nodes being pending, and the writes
+// meant for the new replicas are kept as hints, replayed before the switch.
+// Only the leader of the controllers rebalances.
+func (c *Controller) Rebalance(ctx context.Context) error {
+	if !c.isLeader() {
+		return nil
+	}
+
+	c.rebalancer.runMu.Lock()
+	defer c.rebalancer.runMu.Unlock()
+
+	for {
+		epoch, moves, ok := c.pool.Moves()
+		if !ok {
+			return nil
+		}
+
+		c.updateRebalance(func(s *RebalanceStatus) {
+			*s = RebalanceStatus{Active: true, Ranges: len(moves), StartedAt: time.Now()}
+		})
+
+		c.logger.Info("rebalance: moving %d range(s)", len(moves))
+
+		if err := c.moveRanges(ctx, moves); err != nil {
+			c.updateRebalance(func(s *RebalanceStatus) {
+				s.Active = false
+				s.Err = err
+			})
+
+			return err
+		}
+
+		res, err := c.propose(ctx, membershipCmd{Op: commitOp, Epoch: epoch})
+		if err != nil {
+			c.updateRebalance(func(s *RebalanceStatus) {
+				s.Active = false
+				s.Err = err
+			})
+
+			return err
+		}
+
+		if !res.ok {
+			// nodes joined or left meanwhile, the moves changed
+			continue
+		}
+
+		status := c.updateRebalance(func(s *RebalanceStatus) {
+			s.Active = false
+		})
+
+		c.logger.Info(
+			"rebalance done: %d range(s), %d key(s) moved in %s, %d node(s) removed",
+			status.Ranges, status.Keys, time.Since(status.StartedAt), len(res.removed),
+		)
+
+		return nil
+	}
+}
+
+func (c *Controller) moveRanges(ctx context.Context, moves []node.Move) error {
+	t := newThrottle(c.rebalancer.rate)
+	targets := make(map[string]*node.Item)
+
+	for i, m := range moves {
+		n, err := c.moveRange(ctx, m, t)
+		if err != nil {
+			return fmt.Errorf("failed moving range %d of %d: %w", i+1, len(moves), err)
+		}
+
+		for _, item := range m.To {
+			targets[item.ID()] = item
+		}
+
+		status := c.updateRebalance(func(s *RebalanceStatus) {
+			s.RangesDone++
+			s.Keys += int64(n)
+		})
+
+		c.logger.Info("rebalance: moved range %d of %d, %d key(s) so far", status.RangesDone, status.Ranges, status.Keys)
+	}
+
+	// the writes made while the ranges moved, the ranges switching over once
+	// every target has them
+	for _, item := range targets {
+		// replayed again for the writes made during the replay
+		for replay := 1; ; replay++ {
+			if err := c.replayHints(item); err != nil {
+				return err
+			}
+
+			n := c.hints.pending(item.ID())
+			if n == 0 {
+				break
+			}
+
+			if replay == maxRebalanceReplays {
+				return fmt.Errorf("node %s still has %d hint(s) to replay", item.ID(), n)
+			}
+		}
+	}
+
+	return nil
+}
+
+// moveRange copies the keys of the range the new replicas miss, comparing
+// their Merkle trees with the ones of the current replicas. It returns the
+// number of keys copied.
+func (c *Controller) moveRange(ctx context.Context, m node.Move, t *throttle) (int, error) {
+	sources := make([]*node.Item, 0, len(m.From))
+
+	for _, item := range m.From {
+		if item.IsReady() {
+			sources = append(sources, item)
+		}
+	}
+
+	if len(sources) == 0 {
+		return 0, fmt.Errorf("no replica of the range is ready")
+	}
+
+	r := &v1.KeyRange{Start: m.Range.Start, End: m.Range.End}
+	var moved int
+
+	for _, target := range m.To {
+		if !target.IsReady() && !target.IsPending() {
+			return moved, fmt.Errorf("node %s is not ready", target.ID())
+		}
+
+		// a new node gets a copy of the range first, the comparison below
+		// then only finds the keys the copy missed
+		if target.IsPending() {
+			n, err := c.copySnapshot(ctx, sources[0], target, r, t)
+			if err != nil {
+				return moved, err
+			}
+
+			moved += n
+		}
+
+		keys := make(map[string]struct{})
+		items := make([]*node.Item, 0, len(sources)+1)
+
+		for _, source := range sources {
+			diff, err := c.diffReplicas(ctx, source, target, r)
+			if err != nil {
+				c.logger.Error("rebalance: compare nodes %s and %s failed: %v", source.ID(), target.ID(), err)
+
+				continue
+			}
+
+			items = append(items, source)
+
+			for _, key := range diff {
+				keys[key] = struct{}{}
+			}
+		}
+
+		if len(items) == 0 {
+			return moved, fmt.Errorf("no replica of the range could be compared with node %s", target.ID())
+		}
+
+		items = append(items, target)
+
+		for key := range keys {
+			if err := t.wait(ctx, 1); err != nil {
+				return moved, err
+			}
+
+			if _, err := c.reconcile(ctx, key, items); err != nil {
+				return moved, fmt.Errorf("failed moving %q to node %s: %w", key, target.ID(), err)
+			}
+
+			moved++
+		}
+	}
+
+	c.metrics.rebalanceKeys.Add(int64(moved))
+
+	return moved, nil
+}
+
+// copySnapshot streams a point-in-time copy of the range from the source into
+// the target. It returns the number of entries that changed on the target.
+func (c *Controller) copySnapshot(ctx context.Context, source, target *node.Item, r *v1.KeyRange, t *throttle) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	snapshot, err := source.Client().Snapshot(ctx, &v1.SnapshotRequest{Ranges: []*v1.KeyRange{r}})
+	if err != nil {
+		return 0, fmt.Errorf("failed getting snapshot from node %s: %w", source.ID(), err)
+	}
+
+	restore, err := target.Client().Restore(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed restoring snapshot on node %s: %w", target.ID(), err)
+	}
+
+	for {
+		res, err := snapshot.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("failed getting snapshot from node %s: %w", source.ID(), err)
+		}
+
+		if err := t.wait(ctx, len(res.Entries)); err != nil {
+			return 0, err
+		}
+
+		if err := restore.Send(&v1.RestoreRequest{Entries: res.Entries}); err != nil {
+			break
+		}
+	}
+
+	// a failed send is reported by the response
+	res, err := restore.CloseAndRecv()
+	if err != nil {
+		return 0, fmt.Errorf("failed restoring snapshot on node %s: %w", target.ID(), err)
+	}
+
+	return int(res.Restored), nil
+}
+
+func (c *Controller) updateRebalance(fn func(s *RebalanceStatus)) RebalanceStatus {
+	c.rebalancer.mu.Lock()
+	defer c.rebalancer.mu.Unlock()
+
+	fn(&c.rebalancer.status)
+
+	return c.rebalancer.status
+}
+
+// notifyRebalance starts a rebalance in the background.
+func (c *Controller) notifyRebalance() {
+	select {
+	case c.rebalancer.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Controller) startRebalancing() {
+	t := time.NewTicker(c.rebalancer.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-c.rebalancer.notifyCh:
+		case <-t.C:
+		}
+
+		if err := c.Rebalance(context.Background()); err != nil {
+			c.logger.Error("rebalance failed: %v", err)
+		}
+	}
+}
+
+// throttle paces a loop at rate items per second.
+type throttle struct {
+	rate  int
+	start time.Time
+	n     int
+}
+
+func newThrottle(rate int) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait blocks until n more items can go.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.rate <= 0 {
+		return nil
+	}
+
+	t.n += n
+	next := t.start.Add(time.Duration(t.n) * time.Second / time.Duration(t.rate))
+
+	d := time.Until(next)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
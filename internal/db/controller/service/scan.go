@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+	scanChunkSize    = 100
+)
+
+// Scan streams a page of the keys in key order. The keys are spread over the
+// nodes, so every ready node is scanned and the replies are merged: a key
+// replicated on several nodes takes its latest version, and deleted keys are
+// left out. Only the replicas of a key on the current ring are merged: the
+// nodes keep a copy of the ranges moved off them, which goes stale. The page ends early, with a token to resume from, where a node
+// has more keys than the page it sent.
+func (c *Controller) Scan(req *v1.ScanRequest, stream v1.Controller_ScanServer) error {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	items := c.pool.Select()
+	if len(items) == 0 {
+		return status.Error(codes.Unavailable, "no node ready")
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	nodeReq := &v1.ScanRequest{
+		Start:     req.Start,
+		End:       req.End,
+		Prefix:    req.Prefix,
+		Limit:     int32(limit),
+		PageToken: req.PageToken,
+	}
+
+	cursors := make([]*scanCursor, 0, len(items))
+
+	for _, item := range items {
+		cursors = append(cursors, c.openScan(ctx, item, nodeReq))
+	}
+
+	if failed := countFailed(cursors); failed == len(cursors) {
+		return status.Error(codes.Unavailable, fmt.Sprintf("scan failed on all %d nodes", failed))
+	}
+
+	if err := c.checkScanned(cursors); err != nil {
+		return err
+	}
+
+	var (
+		res   = &v1.ScanResponse{}
+		count int
+		last  string
+	)
+
+	for count < limit {
+		key, ok := nextScanKey(cursors)
+		if !ok {
+			if !anyTruncated(cursors) {
+				last = ""
+			}
+
+			break
+		}
+
+		latest := mergeScanKey(cursors, key, c.owners(key))
+		last = key
+
+		if latest == nil || latest.Tombstone {
+			continue
+		}
+
+		res.Items = append(res.Items, latest)
+		count++
+
+		if len(res.Items) == scanChunkSize && count < limit {
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+
+			res = &v1.ScanResponse{}
+		}
+	}
+
+	if count == limit && !hasMore(cursors) {
+		last = ""
+	}
+
+	// a node failing while streaming its page leaves keys out as well
+	if err := c.checkScanned(cursors); err != nil {
+		return err
+	}
+
+	res.NextPageToken = last
+
+	return stream.Send(res)
+}
+
+// checkScanned fails when every replica of a range of the ring failed or was
+// not scanned, the keys of the range missing from the page.
+func (c *Controller) checkScanned(cursors []*scanCursor) error {
+	scanned := make(map[string]bool, len(cursors))
+
+	for _, cur := range cursors {
+		if cur.err == nil {
+			scanned[cur.id] = true
+		}
+	}
+
+	for _, r := range c.pool.Ranges() {
+		var ok bool
+
+		for _, item := range r.Items {
+			ok = ok || scanned[item.ID()]
+		}
+
+		if !ok {
+			return status.Error(codes.Unavailable, fmt.Sprintf(
+				"no replica of range (%d, %d] could be scanned", r.Range.Start, r.Range.End,
+			))
+		}
+	}
+
+	return nil
+}
+
+func (c *Controller) openScan(ctx context.Context, item *node.Item, req *v1.ScanRequest) *scanCursor {
+	cur := &scanCursor{id: item.ID()}
+
+	cur.stream, cur.err = item.Client().Scan(ctx, req)
+	if cur.err == nil {
+		cur.fill()
+	}
+
+	if cur.err != nil {
+		c.logger.Error("failed scanning node %s: %v", cur.id, cur.err)
+	}
+
+	return cur
+}
+
+// scanCursor reads the page a node streams, chunk by chunk.
+type scanCursor struct {
+	id     string
+	stream v1.Node_ScanClient
+	items  []*v1.ScanItem
+	// next is the token of the node page, set when the node has more keys
+	next string
+	done bool
+	err  error
+}
+
+// head returns the next item of the node, nil when its page is over.
+func (cur *scanCursor) head() *v1.ScanItem {
+	if len(cur.items) == 0 {
+		cur.fill()
+	}
+
+	if len(cur.items) == 0 {
+		return nil
+	}
+
+	return cur.items[0]
+}
+
+func (cur *scanCursor) pop() {
+	cur.items = cur.items[1:]
+}
+
+func (cur *scanCursor) fill() {
+	for len(cur.items) == 0 && !cur.done && cur.err == nil {
+		res, err := cur.stream.Recv()
+		if err == io.EOF {
+			cur.done = true
+
+			return
+		}
+
+		if err != nil {
+			cur.err = err
+
+			return
+		}
+
+		cur.items = res.Items
+
+		if res.NextPageToken != "" {
+			cur.next = res.NextPageToken
+		}
+	}
+}
+
+// truncated reports whether the node page is over while the node has more
+// keys: the keys after it can't be merged before the next page.
+func (cur *scanCursor) truncated() bool {
+	return cur.head() == nil && cur.next != ""
+}
+
+// nextScanKey returns the smallest key of the nodes, unless a node page ends
+// before it.
+func nextScanKey(cursors []*scanCursor) (string, bool) {
+	var (
+		key   string
+		found bool
+	)
+
+	for _, cur := range cursors {
+		if cur.truncated() {
+			return "", false
+		}
+
+		if item := cur.head(); item != nil && (!found || item.Key < key) {
+			key = item.Key
+			found = true
+		}
+	}
+
+	return key, found
+}
+
+// mergeScanKey consumes the key from the nodes having it and returns the
+// latest version of its owners, nil when none of them has it.
+func mergeScanKey(cursors []*scanCursor, key string, owners map[string]bool) *v1.ScanItem {
+	var latest *v1.ScanItem
+
+	for _, cur := range cursors {
+		item := cur.head()
+		if item == nil || item.Key != key {
+			continue
+		}
+
+		if owners[cur.id] && (latest == nil || newer(scanReply(item), scanReply(latest))) {
+			latest = item
+		}
+
+		cur.pop()
+	}
+
+	return latest
+}
+
+func anyTruncated(cursors []*scanCursor) bool {
+	for _, cur := range cursors {
+		if cur.truncated() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasMore(cursors []*scanCursor) bool {
+	for _, cur := range cursors {
+		if cur.head() != nil || cur.next != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func countFailed(cursors []*scanCursor) int {
+	var n int
+
+	for _, cur := range cursors {
+		if cur.err != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+func scanReply(item *v1.ScanItem) *v1.GetResponse {
+	return &v1.GetResponse{
+		Value:     item.Value,
+		Version:   item.Version,
+		Tombstone: item.Tombstone,
+	}
+}
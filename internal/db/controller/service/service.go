@@ -4,11 +4,16 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"emag-homework/internal/db/api/v1"
 	"emag-homework/internal/db/controller"
 	"emag-homework/internal/db/controller/healthz"
 	"emag-homework/internal/db/controller/node"
+	"emag-homework/internal/db/hlc"
+	"emag-homework/internal/db/store"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -22,10 +27,58 @@ type HealthzChecker interface {
 	Events() <-chan healthz.CheckEvent
 }
 
+const defaultReplicaTimeout = time.Second * 5
+
+type Config struct {
+	ReplicaTimeout      time.Duration
+	DefaultConsistency  v1.Consistency
+	Clock               *hlc.Clock
+	TxnLog              TxnLog
+	TxnOwner            string
+	TxnTimeout          time.Duration
+	TxnRecoveryInterval time.Duration
+	MaxHints            int
+	HintTTL             time.Duration
+	HintReplayInterval  time.Duration
+	AntiEntropyInterval time.Duration
+	RebalanceInterval   time.Duration
+	RebalanceRate       int
+	GossipInterval      time.Duration
+	MetricsInterval     time.Duration
+	Replicator          Replicator
+}
+
+type Option func(cfg *Config)
+
 type Controller struct {
-	logger         controller.Logger
-	pool           NodePool
-	healthzChecker HealthzChecker
+	logger             controller.Logger
+	pool               NodePool
+	healthzChecker     HealthzChecker
+	replicaTimeout     time.Duration
+	defaultConsistency v1.Consistency
+	clock              *hlc.Clock
+	metrics            metrics
+
+	txnLog              TxnLog
+	txnOwner            string
+	txnTimeout          time.Duration
+	txnRecoveryInterval time.Duration
+	txns                map[string]*txn
+	committing          map[string]struct{}
+	txnMu               sync.Mutex
+	doneCh              chan struct{}
+
+	hints              *hintStore
+	hintReplayInterval time.Duration
+
+	antiEntropyInterval time.Duration
+	rebalancer          *rebalancer
+	replicator          Replicator
+
+	gossipInterval time.Duration
+	gossipSeeded   atomic.Bool
+
+	metricsInterval time.Duration
 }
 
 type NodePool interface {
@@ -35,95 +88,390 @@ type NodePool interface {
 	Remove(id string) error
 	Size() int
 	Select() []*node.Item
+	Preference(key string) []*node.Item
+	Ranges() []node.ItemRange
+	Get(id string) (*node.Item, bool)
+	Items() []*node.Item
+	Moves() (uint64, []node.Move, bool)
+	Pending(key string) []*node.Item
+	Commit(epoch uint64) ([]string, bool)
+	ReplicationFactor() int
 	MarkError(id string)
 	MarkReady(id string)
 }
 
-func NewController(logger controller.Logger, nodePool NodePool, healthzChecker HealthzChecker) *Controller {
+func NewController(
+	logger controller.Logger, nodePool NodePool, healthzChecker HealthzChecker, opts ...Option,
+) *Controller {
+	cfg := &Config{
+		ReplicaTimeout:      defaultReplicaTimeout,
+		DefaultConsistency:  v1.Consistency_CONSISTENCY_QUORUM,
+		Clock:               hlc.New(0),
+		TxnTimeout:          defaultTxnTimeout,
+		TxnRecoveryInterval: defaultTxnRecoveryInterval,
+		MaxHints:            defaultMaxHints,
+		HintTTL:             defaultHintTTL,
+		HintReplayInterval:  defaultHintReplayInterval,
+		AntiEntropyInterval: defaultAntiEntropyInterval,
+		RebalanceInterval:   defaultRebalanceInterval,
+		RebalanceRate:       defaultRebalanceRate,
+		GossipInterval:      defaultGossipInterval,
+		MetricsInterval:     defaultMetricsInterval,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.TxnLog == nil {
+		// a store without a file cannot fail to open
+		s, _ := store.New()
+		cfg.TxnLog = s
+	}
+
 	ctrl := &Controller{
-		logger:         logger,
-		pool:           nodePool,
-		healthzChecker: healthzChecker,
+		logger:             logger,
+		pool:               nodePool,
+		healthzChecker:     healthzChecker,
+		replicaTimeout:     cfg.ReplicaTimeout,
+		defaultConsistency: cfg.DefaultConsistency,
+		clock:              cfg.Clock,
+
+		txnLog:              cfg.TxnLog,
+		txnOwner:            cfg.TxnOwner,
+		txnTimeout:          cfg.TxnTimeout,
+		txnRecoveryInterval: cfg.TxnRecoveryInterval,
+		txns:                make(map[string]*txn),
+		committing:          make(map[string]struct{}),
+		doneCh:              make(chan struct{}),
+
+		hints:              newHintStore(cfg.MaxHints, cfg.HintTTL),
+		hintReplayInterval: cfg.HintReplayInterval,
+
+		antiEntropyInterval: cfg.AntiEntropyInterval,
+		rebalancer: &rebalancer{
+			interval: cfg.RebalanceInterval,
+			rate:     cfg.RebalanceRate,
+			notifyCh: make(chan struct{}, 1),
+		},
+		replicator: cfg.Replicator,
+
+		gossipInterval: cfg.GossipInterval,
+
+		metricsInterval: cfg.MetricsInterval,
 	}
 
-	go healthzChecker.Start()
+	ctrl.startHealthzChecker()
+	ctrl.reconcileNodes()
+
+	go ctrl.startTxnRecovery()
+	go ctrl.startHintReplay()
+	go ctrl.startAntiEntropy()
+	go ctrl.startRebalancing()
+	go ctrl.startGossipSync()
+	go ctrl.startMetricsLog()
 
 	return ctrl
 }
 
+// WithReplicaTimeout sets how long the controller waits for a single replica.
+func WithReplicaTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ReplicaTimeout = timeout
+	}
+}
+
+// WithDefaultConsistency sets the consistency level of the requests not
+// asking for a specific one.
+func WithDefaultConsistency(level v1.Consistency) Option {
+	return func(cfg *Config) {
+		cfg.DefaultConsistency = level
+	}
+}
+
+// WithClock sets the clock versions are assigned from. Controllers sharing the
+// cluster must use clocks with distinct node ids.
+func WithClock(clock *hlc.Clock) Option {
+	return func(cfg *Config) {
+		cfg.Clock = clock
+	}
+}
+
+// Put stores the value at a version assigned by the controller clock, so the
+// version the client sent is ignored. The response tells whether a replica
+// already had a newer version, the value then being dropped.
 func (c *Controller) Put(ctx context.Context, req *v1.PutRequest) (*v1.PutResponse, error) {
-	nodes := c.pool.Select()
-	if len(nodes) == 0 {
-		return nil, fmt.Errorf("nodes pool is empty")
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
 	}
 
-	var res *v1.PutResponse
-	var err error
+	if err := setExpiry(req); err != nil {
+		return nil, err
+	}
+
+	req.Version = c.clock.Now()
+	req.Clock = nil
+	w := c.writeQuorum(req.Consistency, c.pool.ReplicationFactor())
 
-	for _, item := range nodes {
-		if res, err = item.Client().Put(ctx, req); err != nil {
-			return nil, err
+	if req.Causal {
+		if req.ExpiresAt != 0 {
+			return nil, status.Error(codes.InvalidArgument, "expiration is not supported in causal mode")
 		}
+
+		return c.putCausal(ctx, req, w)
 	}
 
-	return res, nil
+	if req.Cas {
+		return c.compareAndSwap(ctx, req, w)
+	}
+
+	var superseded atomic.Bool
+
+	err := c.write(ctx, req.Key, w, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		res, err := client.Put(ctx, req)
+		if isSuperseded(err) {
+			superseded.Store(true)
+		}
+
+		return res, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.PutResponse{Version: req.Version, Superseded: superseded.Load()}, nil
 }
 
-func (c *Controller) Get(ctx context.Context, req *v1.GetRequest) (*v1.GetResponse, error) {
-	items := c.pool.Select()
-	if len(items) == 0 {
-		return nil, fmt.Errorf("nodes pool is empty")
+// compareAndSwap checks the expected version against the latest version of a
+// read quorum, then lets the first ready replica check it again and write the
+// value, which is then replicated to the other replicas. The replica is first
+// brought up to the latest version, so it does not compare with a version it
+// missed.
+func (c *Controller) compareAndSwap(ctx context.Context, req *v1.PutRequest, w int) (*v1.PutResponse, error) {
+	items := c.replicas(req.Key)
+	if len(items) == 0 || len(items) < w {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+			"write quorum not reachable: %d of %d replicas ready", len(items), w,
+		))
+	}
+
+	latest, err := c.read(ctx, req.Key, c.readQuorum(req.Consistency, c.pool.ReplicationFactor()))
+	if err != nil {
+		return nil, err
 	}
 
-	var res *v1.GetResponse
-	var err error
+	var current int64
 
-	for _, item := range items {
-		res, err = item.Client().Get(ctx, req)
-		if err != nil {
-			return nil, err
+	if latest != nil {
+		c.clock.Update(latest.Version)
+		req.Version = c.clock.Now()
+
+		if !latest.Tombstone {
+			current = latest.Version
 		}
 	}
 
-	return res, err
+	if current != req.ExpectedVersion {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf(
+			"%q has version %d, expected %d: %v", req.Key, current, req.ExpectedVersion, store.ErrVersionMismatch,
+		))
+	}
+
+	_, rest, err := c.coordinate(ctx, req.Key, items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		if latest != nil {
+			if _, err := writeBack(req.Key, latest)(ctx, client); err != nil && !isSuperseded(err) {
+				return nil, err
+			}
+		}
+
+		return client.Put(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	replica := &v1.PutRequest{
+		Key:       req.Key,
+		Value:     req.Value,
+		Version:   req.Version,
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	err = c.writeTo(ctx, req.Key, rest, w-1, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Put(ctx, replica)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.PutResponse{Version: req.Version}, nil
 }
 
-func (c *Controller) RegisterNode(_ context.Context, req *v1.RegisterNodeRequest) (*v1.RegisterNodeResponse, error) {
-	item, err := c.pool.Add(req.Id, req.Address)
+// setExpiry turns the TTL of the request into the time it expires at, so
+// every replica expires the value at the same time.
+func setExpiry(req *v1.PutRequest) error {
+	switch {
+	case req.Ttl < 0 || req.ExpiresAt < 0:
+		return status.Error(codes.InvalidArgument, "expiration cannot be negative")
+	case req.Ttl > 0 && req.ExpiresAt > 0:
+		return status.Error(codes.InvalidArgument, "either ttl or expires_at can be set")
+	case req.Ttl > 0:
+		req.ExpiresAt = time.Now().Add(time.Duration(req.Ttl) * time.Millisecond).UnixNano()
+		req.Ttl = 0
+	}
+
+	return nil
+}
+
+func (c *Controller) Get(ctx context.Context, req *v1.GetRequest) (*v1.GetResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	res, err := c.read(ctx, req.Key, c.readQuorum(req.Consistency, c.pool.ReplicationFactor()))
 	if err != nil {
-		return nil, fmt.Errorf("failed adding node to pool: %w", err)
+		return nil, err
 	}
 
-	c.healthzChecker.Add(req.Id, func(ctx context.Context, req *v1.HealthzRequest) (*v1.HealthzResponse, error) {
-		return item.Client().Healthz(ctx, req)
+	if res != nil {
+		c.clock.Update(res.Version)
+	}
+
+	if res == nil || res.Tombstone {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("%q not found", req.Key))
+	}
+
+	return res, nil
+}
+
+func (c *Controller) Delete(ctx context.Context, req *v1.DeleteRequest) (*v1.DeleteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	req.Version = c.clock.Now()
+	w := c.writeQuorum(v1.Consistency_CONSISTENCY_DEFAULT, c.pool.ReplicationFactor())
+
+	err := c.write(ctx, req.Key, w, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Delete(ctx, req)
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.DeleteResponse{}, nil
+}
+
+// replicas returns the ready nodes from the preference list of the key.
+func (c *Controller) replicas(key string) []*node.Item {
+	items := make([]*node.Item, 0)
+
+	for _, item := range c.pool.Preference(key) {
+		if item.IsReady() {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// owners returns the ids of the replicas of the key on the current ring,
+// whatever their status.
+func (c *Controller) owners(key string) map[string]bool {
+	items := c.pool.Preference(key)
+	owners := make(map[string]bool, len(items))
+
+	for _, item := range items {
+		owners[item.ID()] = true
+	}
+
+	return owners
+}
+
+func (c *Controller) RegisterNode(ctx context.Context, req *v1.RegisterNodeRequest) (*v1.RegisterNodeResponse, error) {
+	// nodes register again periodically, the membership did not change
+	if item, ok := c.pool.Get(req.Id); ok && item.Address() == req.Address {
+		c.checkNode(item)
+
+		return &v1.RegisterNodeResponse{}, nil
+	}
+
+	res, err := c.propose(ctx, membershipCmd{Op: addNodeOp, ID: req.Id, Address: req.Address})
+	if err == nil {
+		err = res.err
+	}
+
+	if err != nil {
+		return nil, err
+	}
 
 	return &v1.RegisterNodeResponse{}, nil
 }
 
 func (c *Controller) UnregisterNode(
-	_ context.Context, req *v1.UnregisterNodeRequest,
+	ctx context.Context, req *v1.UnregisterNodeRequest,
 ) (*v1.UnregisterNodeResponse, error) {
-	if err := c.pool.Remove(req.Id); err != nil {
-		return nil, fmt.Errorf("failed removing node from pool: %w", err)
+	res, err := c.propose(ctx, membershipCmd{Op: removeNodeOp, ID: req.Id})
+	if err == nil {
+		err = res.err
 	}
 
-	c.healthzChecker.Remove(req.Id)
+	if err != nil {
+		return nil, err
+	}
 
 	return &v1.UnregisterNodeResponse{}, nil
 }
 
-func (c *Controller) writeConsensus() int {
-	return (c.pool.Size() + 1) / 2
+// writeConsensus returns how many of the n replicas must acknowledge a write.
+// Together with readConsensus, a read always overlaps the latest write.
+func (c *Controller) writeConsensus(n int) int {
+	return n/2 + 1
+}
+
+func (c *Controller) readConsensus(n int) int {
+	return n/2 + 1
+}
+
+// writeQuorum returns how many of the n replicas must acknowledge a write
+// made at the consistency level.
+func (c *Controller) writeQuorum(level v1.Consistency, n int) int {
+	switch c.consistency(level) {
+	case v1.Consistency_CONSISTENCY_ONE:
+		return 1
+	case v1.Consistency_CONSISTENCY_ALL:
+		return n
+	default:
+		return c.writeConsensus(n)
+	}
+}
+
+// readQuorum returns how many of the n replicas must answer a read made at
+// the consistency level.
+func (c *Controller) readQuorum(level v1.Consistency, n int) int {
+	switch c.consistency(level) {
+	case v1.Consistency_CONSISTENCY_ONE:
+		return 1
+	case v1.Consistency_CONSISTENCY_ALL:
+		return n
+	default:
+		return c.readConsensus(n)
+	}
 }
 
-func (c *Controller) readConsensus() int {
-	return (c.pool.Size() + 1) / 2
+func (c *Controller) consistency(level v1.Consistency) v1.Consistency {
+	if level == v1.Consistency_CONSISTENCY_DEFAULT {
+		return c.defaultConsistency
+	}
+
+	return level
 }
 
 func (c *Controller) TearDown() {
+	close(c.doneCh)
 	c.healthzChecker.Stop()
 	_ = c.pool.Close()
+	_ = c.txnLog.Close()
 }
 
 func (c *Controller) startHealthzChecker() {
@@ -133,8 +481,9 @@ func (c *Controller) startHealthzChecker() {
 
 	go func() {
 		for evt := range c.healthzChecker.Events() {
+			// failing nodes are still checked, so they are back once healthy
+			// on every controller, whichever they register with
 			if evt.Err != nil {
-				c.healthzChecker.Remove(evt.ID)
 				c.pool.MarkError(evt.ID)
 
 				continue
@@ -143,14 +492,38 @@ func (c *Controller) startHealthzChecker() {
 			switch evt.Res.Code {
 			case v1.HealthzResponse_HEALTHZ_OK:
 				c.pool.MarkReady(evt.ID)
+				c.replayNode(evt.ID)
 			case v1.HealthzResponse_HEALTHZ_ERROR:
-				c.healthzChecker.Remove(evt.ID)
 				c.pool.MarkError(evt.ID)
 			}
 		}
 	}()
 }
 
+// reconcileNodes checks the health of the nodes the pool was restored with,
+// and resumes moving their keys.
+func (c *Controller) reconcileNodes() {
+	items := c.pool.Items()
+
+	for _, item := range items {
+		c.checkNode(item)
+	}
+
+	if _, _, ok := c.pool.Moves(); ok {
+		c.notifyRebalance()
+	}
+
+	if len(items) > 0 {
+		c.logger.Info("restored %d node(s)", len(items))
+	}
+}
+
+func (c *Controller) checkNode(item *node.Item) {
+	c.healthzChecker.Add(item.ID(), func(ctx context.Context, req *v1.HealthzRequest) (*v1.HealthzResponse, error) {
+		return item.Client().Healthz(ctx, req)
+	})
+}
+
 func isNotFound(err error) bool {
 	s := status.Convert(err)
 	if s == nil {
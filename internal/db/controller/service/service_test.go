@@ -0,0 +1,1280 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/bootstrap"
+	"emag-homework/internal/db/controller/healthz"
+	"emag-homework/internal/db/controller/node"
+	"emag-homework/internal/db/controller/redirect"
+	ctrlserver "emag-homework/internal/db/controller/server"
+	"emag-homework/internal/db/controller/service"
+	"emag-homework/internal/db/node/gossip"
+	"emag-homework/internal/db/node/server"
+	"emag-homework/internal/db/raft"
+	"emag-homework/internal/db/store"
+	"emag-homework/pkg/log"
+	"emag-homework/pkg/test/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestController_Put(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		nodes       int
+		stopped     int
+		consistency v1.Consistency
+		wantCode    codes.Code
+	}{
+		{
+			name:     "all replicas up",
+			nodes:    3,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "one replica down",
+			nodes:    3,
+			stopped:  1,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "quorum lost",
+			nodes:    3,
+			stopped:  2,
+			wantCode: codes.Unavailable,
+		},
+		{
+			name:        "consistency one",
+			nodes:       3,
+			stopped:     2,
+			consistency: v1.Consistency_CONSISTENCY_ONE,
+			wantCode:    codes.OK,
+		},
+		{
+			name:        "consistency all",
+			nodes:       3,
+			stopped:     1,
+			consistency: v1.Consistency_CONSISTENCY_ALL,
+			wantCode:    codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			ctrl, nodes, tearDown := setupCluster(t, tt.nodes)
+			defer tearDown()
+
+			for i := 0; i < tt.stopped; i++ {
+				nodes[i].stop()
+			}
+
+			_, err := ctrl.Put(ctx, &v1.PutRequest{
+				Key:         "foobar",
+				Value:       []byte("1"),
+				Consistency: tt.consistency,
+			})
+			require.Equal(t, tt.wantCode, status.Code(err), err)
+
+			if tt.wantCode != codes.OK {
+				return
+			}
+
+			got, err := ctrl.Get(ctx, &v1.GetRequest{Key: "foobar", Consistency: tt.consistency})
+			require.NoError(t, err)
+			require.Equal(t, []byte("1"), got.Value)
+		})
+	}
+}
+
+func TestController_CompareAndSwap(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, _, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foobar", Value: []byte("1"), Cas: true})
+	require.NoError(t, err, "missing key")
+
+	got, err := ctrl.Get(ctx, &v1.GetRequest{Key: "foobar"})
+	require.NoError(t, err)
+
+	_, err = ctrl.Put(ctx, &v1.PutRequest{Key: "foobar", Value: []byte("2"), Cas: true, ExpectedVersion: got.Version - 1})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), err)
+
+	_, err = ctrl.Put(ctx, &v1.PutRequest{Key: "foobar", Value: []byte("2"), Cas: true, ExpectedVersion: got.Version})
+	require.NoError(t, err, "expected version")
+
+	got, err = ctrl.Get(ctx, &v1.GetRequest{Key: "foobar"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), got.Value)
+}
+
+func TestController_CompareAndSwap_StaleReplica(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	// a replica misses the keys, checking the version of some of them, and
+	// still compares with the latest version
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+
+		for _, n := range nodes[1:] {
+			require.NoError(t, n.store.Put(store.Entry{Key: key, Value: []byte("1"), Version: 1}))
+		}
+
+		_, err := ctrl.Put(ctx, &v1.PutRequest{
+			Key:             key,
+			Value:           []byte("2"),
+			Cas:             true,
+			ExpectedVersion: 1,
+			Consistency:     v1.Consistency_CONSISTENCY_ALL,
+		})
+		require.NoError(t, err, key)
+	}
+}
+
+func TestController_Get(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foobar", Value: []byte("1")})
+	require.NoError(t, err)
+
+	var version int64
+
+	for _, n := range nodes {
+		if e := n.store.Get("foobar"); e != nil {
+			version = e.Version + 1
+		}
+	}
+
+	// any read quorum overlaps the two replicas having the latest version
+	for _, n := range nodes[:2] {
+		err := n.store.Put(store.Entry{Key: "foobar", Value: []byte("2"), Version: version})
+		require.NoError(t, err)
+	}
+
+	got, err := ctrl.Get(ctx, &v1.GetRequest{Key: "foobar"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), got.Value)
+	require.Equal(t, version, got.Version)
+
+	_, err = ctrl.Delete(ctx, &v1.DeleteRequest{Key: "foobar"})
+	require.NoError(t, err)
+
+	_, err = ctrl.Get(ctx, &v1.GetRequest{Key: "foobar"})
+	require.Equal(t, codes.NotFound, status.Code(err), err)
+}
+
+func TestController_ReadRepair(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	for _, n := range nodes[:2] {
+		err := n.store.Put(store.Entry{Key: "foobar", Value: []byte("2"), Version: 2})
+		require.NoError(t, err)
+	}
+
+	got, err := ctrl.Get(ctx, &v1.GetRequest{Key: "foobar"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), got.Value)
+
+	deadline := time.Now().Add(time.Second * 2)
+
+	for time.Now().Before(deadline) {
+		if e := nodes[2].store.Get("foobar"); e != nil && e.Version == 2 {
+			require.Equal(t, int64(1), ctrl.Metrics().ReadRepairs, "repairs")
+
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.True(t, false, "stale replica not repaired")
+}
+
+func TestController_PutCausal(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, _, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foobar", Value: []byte("1"), Causal: true})
+	require.NoError(t, err)
+
+	got, err := ctrl.Get(ctx, &v1.GetRequest{Key: "foobar"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(got.Siblings), "siblings")
+
+	// two clients update the value they both read
+	for _, v := range []string{"2", "3"} {
+		_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foobar", Value: []byte(v), Causal: true, Context: got.Context})
+		require.NoError(t, err)
+	}
+
+	got, err = ctrl.Get(ctx, &v1.GetRequest{Key: "foobar", Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(got.Siblings), "concurrent siblings")
+
+	_, err = ctrl.Put(ctx, &v1.PutRequest{Key: "foobar", Value: []byte("5"), Causal: true, Context: got.Context})
+	require.NoError(t, err)
+
+	got, err = ctrl.Get(ctx, &v1.GetRequest{Key: "foobar", Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(got.Siblings), "resolved")
+	require.Equal(t, []byte("5"), got.Value)
+}
+
+func TestController_Increment(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, _, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := ctrl.Increment(ctx, &v1.IncrementRequest{Key: "foobar", Delta: 2})
+			require.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+
+	got, err := ctrl.Get(ctx, &v1.GetRequest{Key: "foobar", Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+	require.Equal(t, []byte("20"), got.Value)
+	require.True(t, got.Counter, "counter")
+
+	_, err = ctrl.Put(ctx, &v1.PutRequest{Key: "foobar", Value: []byte("foobar")})
+	require.NoError(t, err)
+
+	_, err = ctrl.Increment(ctx, &v1.IncrementRequest{Key: "foobar", Delta: 1})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), err)
+}
+
+func TestController_Increment_StaleReplica(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	// a replica misses the counters, applying the delta of some of them, and
+	// still counts from the latest value
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+
+		for _, n := range nodes[1:] {
+			require.NoError(t, n.store.Put(store.Entry{Key: key, Kind: store.CounterKind, Counter: 5, Version: 1}))
+		}
+
+		res, err := ctrl.Increment(ctx, &v1.IncrementRequest{
+			Key:         key,
+			Delta:       1,
+			Consistency: v1.Consistency_CONSISTENCY_ALL,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(6), res.Value, key)
+	}
+}
+
+func TestController_Get_RepairCounter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	for _, n := range nodes[1:] {
+		require.NoError(t, n.store.Put(store.Entry{Key: "foobar", Kind: store.CounterKind, Counter: 5, Version: 1}))
+	}
+
+	got, err := ctrl.Get(ctx, &v1.GetRequest{Key: "foobar", Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+	require.True(t, got.Counter, "counter")
+
+	// the missing replica gets the counter back, not a plain value
+	deadline := time.Now().Add(time.Second * 2)
+
+	for time.Now().Before(deadline) {
+		if e := nodes[0].store.Get("foobar"); e != nil {
+			require.Equal(t, store.CounterKind, e.Kind)
+			require.Equal(t, int64(5), e.Counter)
+
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal("counter not repaired")
+}
+
+func TestController_IncrementCounter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	_, err := ctrl.IncrementCounter(ctx, &v1.IncrementCounterRequest{Key: "foobar", Delta: 3})
+	require.NoError(t, err)
+
+	// a replica counts on its own while the others cannot reach it
+	var version int64
+
+	for _, n := range nodes {
+		if e := n.store.Get("foobar"); e != nil && e.Version > version {
+			version = e.Version
+		}
+	}
+
+	_, err = nodes[2].store.IncrementPN("foobar", 4, version+1, nodes[2].id)
+	require.NoError(t, err)
+
+	got, err := ctrl.GetCounter(ctx, &v1.GetCounterRequest{
+		Key:         "foobar",
+		Consistency: v1.Consistency_CONSISTENCY_ALL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(7), got.Value)
+
+	deadline := time.Now().Add(time.Second * 2)
+
+	for time.Now().Before(deadline) {
+		if e := nodes[0].store.Get("foobar"); e != nil && e.PN.Value() == 7 {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.True(t, false, "counter not merged into the replicas")
+}
+
+func TestController_Batch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	nodes[0].stop()
+
+	res, err := ctrl.Batch(ctx, &v1.BatchRequest{Ops: []*v1.BatchOp{
+		{Type: v1.BatchOp_BATCH_OP_PUT, Key: "foo", Value: []byte("foo")},
+		{Type: v1.BatchOp_BATCH_OP_INCREMENT, Key: "bar", Delta: 2},
+		{Type: v1.BatchOp_BATCH_OP_INCREMENT, Key: "baz", Delta: 3},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res.Ops), "applied")
+
+	for key, want := range map[string]string{"foo": "foo", "bar": "2", "baz": "3"} {
+		got, err := ctrl.Get(ctx, &v1.GetRequest{Key: key})
+		require.NoError(t, err, key)
+		require.Equal(t, []byte(want), got.Value, key)
+	}
+
+	_, err = ctrl.Batch(ctx, &v1.BatchRequest{Ops: []*v1.BatchOp{
+		{Type: v1.BatchOp_BATCH_OP_COUNTER, Key: "foo", Counter: 1},
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), err)
+}
+
+func TestController_Batch_StaleReplica(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	// a replica misses the counters, coordinating some of them, and the batch
+	// still counts from the latest values
+	ops := make([]*v1.BatchOp, 0, 30)
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+
+		for _, n := range nodes[1:] {
+			require.NoError(t, n.store.Put(store.Entry{Key: key, Kind: store.CounterKind, Counter: 5, Version: 1}))
+		}
+
+		ops = append(ops, &v1.BatchOp{Type: v1.BatchOp_BATCH_OP_INCREMENT, Key: key, Delta: 1})
+	}
+
+	res, err := ctrl.Batch(ctx, &v1.BatchRequest{Ops: ops, Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+	require.Equal(t, 30, len(res.Ops), "applied")
+
+	for _, op := range res.Ops {
+		require.Equal(t, int64(6), op.Counter, op.Key)
+	}
+}
+
+func TestController_Commit(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, _, tearDown := setupCluster(t, 4)
+	defer tearDown()
+
+	_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foo", Value: []byte("1")})
+	require.NoError(t, err)
+
+	a, err := ctrl.Begin(ctx, &v1.BeginRequest{})
+	require.NoError(t, err)
+
+	got, err := ctrl.TxnGet(ctx, &v1.TxnGetRequest{TxnId: a.TxnId, Key: "foo"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), got.Value)
+
+	for _, key := range []string{"foo", "bar", "baz"} {
+		_, err := ctrl.TxnPut(ctx, &v1.TxnPutRequest{TxnId: a.TxnId, Key: key, Value: []byte("2")})
+		require.NoError(t, err, key)
+	}
+
+	// b read foo before a commits, so it must abort
+	b, err := ctrl.Begin(ctx, &v1.BeginRequest{})
+	require.NoError(t, err)
+
+	_, err = ctrl.TxnGet(ctx, &v1.TxnGetRequest{TxnId: b.TxnId, Key: "foo"})
+	require.NoError(t, err)
+
+	_, err = ctrl.TxnPut(ctx, &v1.TxnPutRequest{TxnId: b.TxnId, Key: "foo", Value: []byte("3")})
+	require.NoError(t, err)
+
+	_, err = ctrl.Commit(ctx, &v1.CommitRequest{TxnId: a.TxnId})
+	require.NoError(t, err, "commit")
+
+	for _, key := range []string{"foo", "bar", "baz"} {
+		got, err := ctrl.Get(ctx, &v1.GetRequest{Key: key})
+		require.NoError(t, err, key)
+		require.Equal(t, []byte("2"), got.Value, key)
+	}
+
+	_, err = ctrl.Commit(ctx, &v1.CommitRequest{TxnId: b.TxnId})
+	require.Equal(t, codes.Aborted, status.Code(err), err)
+
+	got, err = ctrl.Get(ctx, &v1.GetRequest{Key: "foo"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), got.Value, "aborted write")
+}
+
+func TestController_RecoverTxns(t *testing.T) {
+	t.Parallel()
+
+	txnLog, err := store.New()
+	require.NoError(t, err)
+
+	ctrl, nodes, tearDown := setupCluster(t, 3,
+		service.WithTxnLog(txnLog),
+		service.WithTxnTimeout(time.Millisecond),
+	)
+	defer tearDown()
+
+	// the controller crashed after recording the decision of txn-1, and
+	// before recording any for txn-2
+	err = txnLog.Put(store.Entry{Key: "txn-1", Value: []byte("committed"), Version: 10})
+	require.NoError(t, err)
+
+	err = nodes[0].store.Prepare(store.Intent{
+		TxnID:   "txn-1",
+		Version: 10,
+		Writes:  []store.Entry{{Key: "foo", Value: []byte("1")}},
+	})
+	require.NoError(t, err)
+
+	err = nodes[1].store.Prepare(store.Intent{
+		TxnID:   "txn-2",
+		Version: 11,
+		Writes:  []store.Entry{{Key: "bar", Value: []byte("1")}},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 5)
+
+	ctrl.RecoverTxns()
+
+	require.Equal(t, []byte("1"), nodes[0].store.Get("foo").Value)
+	require.Equal(t, 0, len(nodes[0].store.Intents()))
+	require.True(t, nodes[1].store.Get("bar") == nil, "aborted")
+	require.Equal(t, 0, len(nodes[1].store.Intents()))
+
+	ctrl.RecoverTxns()
+
+	require.True(t, txnLog.Get("txn-1") == nil, "commit record dropped")
+}
+
+func TestController_RecoverTxns_Owner(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3,
+		service.WithTxnOwner("ctrl-b"),
+		service.WithTxnTimeout(time.Millisecond),
+	)
+	defer tearDown()
+
+	begun, err := ctrl.Begin(ctx, &v1.BeginRequest{})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(begun.TxnId, "ctrl-b/"), begun.TxnId)
+
+	// the decision of ctrl-a/txn-1 is in the log of another controller
+	err = nodes[0].store.Prepare(store.Intent{
+		TxnID:   "ctrl-a/txn-1",
+		Version: 10,
+		Writes:  []store.Entry{{Key: "foo", Value: []byte("1")}},
+	})
+	require.NoError(t, err)
+
+	err = nodes[1].store.Prepare(store.Intent{
+		TxnID:   "ctrl-b/txn-2",
+		Version: 11,
+		Writes:  []store.Entry{{Key: "bar", Value: []byte("1")}},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 5)
+
+	ctrl.RecoverTxns()
+
+	require.Equal(t, 1, len(nodes[0].store.Intents()))
+	require.Equal(t, 0, len(nodes[1].store.Intents()))
+}
+
+type testNode struct {
+	id     string
+	addr   string
+	store  *store.Store
+	gossip *gossip.Gossip
+	stop   func()
+}
+
+func TestController_PutTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	res, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foo", Value: []byte("foo"), Ttl: 50})
+	require.NoError(t, err)
+
+	got, err := ctrl.Get(ctx, &v1.GetRequest{Key: "foo"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), got.Value)
+	require.True(t, got.ExpiresAt > 0, "expires at")
+
+	time.Sleep(60 * time.Millisecond)
+
+	_, err = ctrl.Get(ctx, &v1.GetRequest{Key: "foo"})
+	require.Equal(t, codes.NotFound, status.Code(err), err)
+
+	for _, n := range nodes {
+		_, err := n.store.ExpireEntries()
+		require.NoError(t, err, n.id)
+
+		e := n.store.Lookup("foo")
+		require.True(t, e.Tombstone, n.id)
+		require.Equal(t, res.Version, e.Version, n.id)
+	}
+
+	_, err = ctrl.Put(ctx, &v1.PutRequest{Key: "foo", Value: []byte("foo"), Ttl: 50, ExpiresAt: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), err)
+}
+
+func TestController_HintedHandoff(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3, service.WithHintReplayInterval(time.Hour))
+	defer tearDown()
+
+	nodes[0].stop()
+
+	_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foo", Value: []byte("foo")})
+	require.NoError(t, err)
+
+	_, err = ctrl.Delete(ctx, &v1.DeleteRequest{Key: "bar"})
+	require.NoError(t, err)
+
+	require.True(t, nodes[0].store.Lookup("foo") == nil, "missed while down")
+	require.Equal(t, int64(2), ctrl.Metrics().HintsPending, "hints")
+
+	nodes[0].restart(t)
+
+	// the connection to the node may take a moment to be established again
+	deadline := time.Now().Add(5 * time.Second)
+
+	for ctrl.Metrics().HintsPending > 0 && time.Now().Before(deadline) {
+		ctrl.ReplayHints()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	require.Equal(t, int64(0), ctrl.Metrics().HintsPending, "pending")
+	require.Equal(t, int64(2), ctrl.Metrics().HintsReplayed, "replayed")
+	require.Equal(t, []byte("foo"), nodes[0].store.Get("foo").Value)
+	require.True(t, nodes[0].store.Lookup("bar").Tombstone, "tombstone")
+}
+
+func TestController_AntiEntropy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3, service.WithAntiEntropyInterval(0))
+	defer tearDown()
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+
+		_, err := ctrl.Put(ctx, &v1.PutRequest{Key: key, Value: []byte(key), Consistency: v1.Consistency_CONSISTENCY_ALL})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 0, ctrl.AntiEntropy(ctx), "in sync")
+
+	// the first node lost some keys, the last one got a write the others missed
+	for i := 0; i < 100; i += 10 {
+		require.NoError(t, nodes[0].store.Del(fmt.Sprintf("key-%03d", i)))
+	}
+
+	latest := nodes[2].store.Get("key-005")
+	require.NoError(t, nodes[2].store.Put(store.Entry{Key: "key-005", Value: []byte("bar"), Version: latest.Version + 1}))
+
+	require.Equal(t, 11, ctrl.AntiEntropy(ctx), "repaired")
+	require.Equal(t, int64(11), ctrl.Metrics().AntiEntropyKeys, "metric")
+
+	for _, n := range nodes {
+		require.Equal(t, 200, len(n.store.Keys()), n.id)
+		require.Equal(t, []byte("bar"), n.store.Get("key-005").Value, n.id)
+	}
+
+	require.Equal(t, 0, ctrl.AntiEntropy(ctx), "converged")
+}
+
+func TestController_AntiEntropy_Counter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3, service.WithAntiEntropyInterval(0))
+	defer tearDown()
+
+	res, err := ctrl.Increment(ctx, &v1.IncrementRequest{
+		Key:         "foobar",
+		Delta:       5,
+		Consistency: v1.Consistency_CONSISTENCY_ALL,
+	})
+	require.NoError(t, err)
+
+	// a replica holds the counter as a plain value at the same version
+	require.NoError(t, nodes[0].store.Del("foobar"))
+	require.NoError(t, nodes[0].store.Put(store.Entry{Key: "foobar", Value: []byte("5"), Version: res.Version}))
+
+	require.Equal(t, 1, ctrl.AntiEntropy(ctx), "repaired")
+	require.Equal(t, store.CounterKind, nodes[0].store.Get("foobar").Kind)
+	require.Equal(t, 0, ctrl.AntiEntropy(ctx), "converged")
+	require.Equal(t, int64(1), ctrl.Metrics().AntiEntropyKeys, "metric")
+}
+
+func TestController_Rebalance(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 3, service.WithRebalanceInterval(time.Hour), service.WithRebalanceRate(0))
+	defer tearDown()
+
+	keys := make([]string, 0, 101)
+
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key-%03d", i))
+
+		_, err := ctrl.Put(ctx, &v1.PutRequest{Key: keys[i], Value: []byte("foo"), Consistency: v1.Consistency_CONSISTENCY_ALL})
+		require.NoError(t, err)
+	}
+
+	joined := startNode(t, "node-3")
+	defer joined.stop()
+
+	nodes = append(nodes, joined)
+
+	_, err := ctrl.RegisterNode(ctx, &v1.RegisterNodeRequest{Id: joined.id, Address: joined.addr})
+	require.NoError(t, err)
+
+	// written while the ranges move
+	keys = append(keys, "late")
+
+	_, err = ctrl.Put(ctx, &v1.PutRequest{Key: "late", Value: []byte("foo"), Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.Rebalance(ctx))
+
+	status := ctrl.RebalanceStatus()
+	require.False(t, status.Active, "active")
+	require.True(t, status.Ranges > 0, "ranges")
+	require.Equal(t, status.Ranges, status.RangesDone, "ranges done")
+	require.True(t, status.Keys > 0, "keys")
+
+	ring := node.NewRing(0)
+
+	for _, n := range nodes {
+		ring.Add(n.id)
+	}
+
+	assertOwners := func() {
+		t.Helper()
+
+		stores := make(map[string]*store.Store)
+
+		for _, n := range nodes {
+			stores[n.id] = n.store
+		}
+
+		for _, key := range keys {
+			for _, id := range ring.Lookup(key, 3) {
+				require.True(t, stores[id].Get(key) != nil, fmt.Sprintf("%s on %s", key, id))
+			}
+		}
+	}
+
+	assertOwners()
+
+	// decommission
+	_, err = ctrl.UnregisterNode(ctx, &v1.UnregisterNodeRequest{Id: nodes[0].id})
+	require.NoError(t, err)
+	require.NoError(t, ctrl.Rebalance(ctx))
+
+	ring.Remove(nodes[0].id)
+	assertOwners()
+}
+
+func TestController_Replicated(t *testing.T) {
+	t.Parallel()
+
+	type replica struct {
+		addr string
+		raft *raft.Raft
+		pool *node.Pool
+		ctrl *service.Controller
+		stop func()
+	}
+
+	listeners := make([]net.Listener, 0, 3)
+	peers := make([]raft.Peer, 0, 3)
+
+	for i := 0; i < 3; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		listeners = append(listeners, lis)
+		peers = append(peers, raft.Peer{ID: lis.Addr().String(), Address: lis.Addr().String()})
+	}
+
+	replicas := make([]*replica, 0, 3)
+
+	for i, lis := range listeners {
+		r, err := raft.New(peers[i].ID, peers, raft.WithElectionTimeout(time.Millisecond*150),
+			raft.WithHeartbeatInterval(time.Millisecond*30))
+		require.NoError(t, err)
+
+		pool := node.NewPool(node.WithReplicationFactor(3))
+		checker := healthz.NewChecker(healthz.WithCheckInterval(time.Hour))
+		ctrl := service.NewController(log.NewNopLogger(), pool, checker,
+			service.WithReplicaTimeout(time.Second), service.WithReplicator(r))
+		r.Start(ctrl)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+
+		go func(lis net.Listener) {
+			defer close(done)
+
+			_ = bootstrap.StartControllerGRPCServer(ctx, lis, ctrlserver.NewControllerServer(ctrl), r, log.NewNopLogger())
+		}(lis)
+
+		rep := &replica{addr: peers[i].Address, raft: r, pool: pool, ctrl: ctrl}
+		var once sync.Once
+
+		rep.stop = func() {
+			once.Do(func() {
+				cancel()
+				<-done
+				_ = r.Close()
+				ctrl.TearDown()
+			})
+		}
+		defer rep.stop()
+
+		replicas = append(replicas, rep)
+	}
+
+	waitLeader := func(replicas []*replica) *replica {
+		t.Helper()
+
+		for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			for _, r := range replicas {
+				if r.raft.IsLeader() {
+					return r
+				}
+			}
+		}
+
+		t.Fatal("no leader elected")
+
+		return nil
+	}
+
+	// every controller has the nodes, moved to the ring
+	waitMembership := func(replicas []*replica, size int) {
+		t.Helper()
+
+		for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			done := true
+
+			for _, r := range replicas {
+				if _, _, moving := r.pool.Moves(); moving || r.pool.Size() != size {
+					done = false
+				}
+			}
+
+			if done {
+				return
+			}
+		}
+
+		t.Fatalf("membership of %d node(s) not replicated", size)
+	}
+
+	ctx := context.Background()
+	leader := waitLeader(replicas)
+
+	var follower *replica
+
+	for _, r := range replicas {
+		if r != leader {
+			follower = r
+		}
+	}
+
+	// the follower redirects the registrations to the leader
+	conn, err := redirect.Dial([]string{follower.addr}, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := v1.NewControllerClient(conn)
+	nodes := make([]*testNode, 0, 4)
+
+	for i := 0; i < 3; i++ {
+		n := startNode(t, fmt.Sprintf("node-%d", i))
+		defer n.stop()
+
+		nodes = append(nodes, n)
+
+		_, err := client.RegisterNode(ctx, &v1.RegisterNodeRequest{Id: n.id, Address: n.addr})
+		require.NoError(t, err)
+	}
+
+	waitMembership(replicas, 3)
+
+	// any controller serves the keys
+	_, err = follower.ctrl.Put(ctx, &v1.PutRequest{Key: "key", Value: []byte("foo"), Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+
+	res, err := leader.ctrl.Get(ctx, &v1.GetRequest{Key: "key", Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), res.Value)
+
+	// the others take over from the leader
+	leader.stop()
+
+	rest := make([]*replica, 0, 2)
+	addrs := []string{leader.addr}
+
+	for _, r := range replicas {
+		if r != leader {
+			rest = append(rest, r)
+			addrs = append(addrs, r.addr)
+		}
+	}
+
+	waitLeader(rest)
+
+	conn, err = redirect.Dial(addrs, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	n := startNode(t, "node-3")
+	defer n.stop()
+
+	_, err = v1.NewControllerClient(conn).RegisterNode(ctx, &v1.RegisterNodeRequest{Id: n.id, Address: n.addr})
+	require.NoError(t, err)
+
+	waitMembership(rest, 4)
+}
+
+func TestController_Scan(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, _, tearDown := setupCluster(t, 5)
+	defer tearDown()
+
+	want := make([]string, 0)
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key/%02d", i)
+
+		_, err := ctrl.Put(ctx, &v1.PutRequest{Key: key, Value: []byte(key)})
+		require.NoError(t, err, key)
+
+		if i%10 == 3 {
+			_, err := ctrl.Delete(ctx, &v1.DeleteRequest{Key: key})
+			require.NoError(t, err, key)
+
+			continue
+		}
+
+		want = append(want, key)
+	}
+
+	_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "other", Value: []byte("other")})
+	require.NoError(t, err)
+
+	var (
+		got   []string
+		token string
+		pages int
+	)
+
+	for {
+		stream := &scanStream{ctx: ctx}
+
+		err := ctrl.Scan(&v1.ScanRequest{Prefix: "key/", Limit: 4, PageToken: token}, stream)
+		require.NoError(t, err, token)
+
+		for _, res := range stream.responses {
+			for _, item := range res.Items {
+				require.Equal(t, []byte(item.Key), item.Value, item.Key)
+				got = append(got, item.Key)
+			}
+
+			token = res.NextPageToken
+		}
+
+		pages++
+
+		if token == "" {
+			break
+		}
+	}
+
+	require.Equal(t, want, got)
+	require.True(t, pages > 1, "paginated")
+}
+
+func TestController_Scan_Unavailable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 5)
+	defer tearDown()
+
+	_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foo", Value: []byte("foo")})
+	require.NoError(t, err)
+
+	// the nodes fail without the controller noticing, a node left alone
+	// does not replicate every range
+	for _, n := range nodes[1:] {
+		n.stop()
+	}
+
+	err = ctrl.Scan(&v1.ScanRequest{}, &scanStream{ctx: ctx})
+	require.Equal(t, codes.Unavailable, status.Code(err), err)
+}
+
+func TestController_Scan_MovedRange(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctrl, nodes, tearDown := setupCluster(t, 4)
+	defer tearDown()
+
+	_, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foo", Value: []byte("foo"), Consistency: v1.Consistency_CONSISTENCY_ALL})
+	require.NoError(t, err)
+
+	// the node not replicating the key kept a copy from before the range
+	// moved off it, stale but for a newer version
+	var stale int
+
+	for _, n := range nodes {
+		if n.store.Get("foo") == nil {
+			require.NoError(t, n.store.Put(store.Entry{Key: "foo", Value: []byte("stale"), Version: math.MaxInt64}))
+			stale++
+		}
+	}
+
+	require.Equal(t, 1, stale, "stale copies")
+
+	stream := &scanStream{ctx: ctx}
+	require.NoError(t, ctrl.Scan(&v1.ScanRequest{}, stream))
+	require.Equal(t, 1, len(stream.responses), "responses")
+	require.Equal(t, 1, len(stream.responses[0].Items), "items")
+	require.Equal(t, []byte("foo"), stream.responses[0].Items[0].Value)
+}
+
+// scanStream collects what a scan sends.
+type scanStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses []*v1.ScanResponse
+}
+
+func (s *scanStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *scanStream) Send(res *v1.ScanResponse) error {
+	s.responses = append(s.responses, res)
+
+	return nil
+}
+
+func TestController_Watch(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctrl, _, tearDown := setupCluster(t, 3)
+	defer tearDown()
+
+	res, err := ctrl.Put(ctx, &v1.PutRequest{Key: "foo/1", Value: []byte("1")})
+	require.NoError(t, err)
+
+	stream := &watchStream{ctx: ctx, events: make(chan *v1.WatchEvent, 10)}
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- ctrl.Watch(&v1.WatchRequest{Prefix: "foo/", FromVersion: res.Version - 1}, stream)
+	}()
+
+	// written before the watch started, sent since it is after from_version
+	got := <-stream.events
+	require.Equal(t, "foo/1", got.Key)
+	require.Equal(t, v1.WatchEvent_WATCH_EVENT_PUT, got.Type)
+
+	_, err = ctrl.Put(ctx, &v1.PutRequest{Key: "bar", Value: []byte("bar")})
+	require.NoError(t, err)
+
+	_, err = ctrl.Put(ctx, &v1.PutRequest{Key: "foo/2", Value: []byte("2")})
+	require.NoError(t, err)
+
+	_, err = ctrl.Delete(ctx, &v1.DeleteRequest{Key: "foo/1"})
+	require.NoError(t, err)
+
+	events := make(map[string]v1.WatchEvent_Type)
+
+	for len(events) < 2 {
+		select {
+		case got := <-stream.events:
+			events[got.Key] = got.Type
+		case <-time.After(time.Second):
+			t.Fatalf("missing events, got %v", events)
+		}
+	}
+
+	require.Equal(t, v1.WatchEvent_WATCH_EVENT_PUT, events["foo/2"])
+	require.Equal(t, v1.WatchEvent_WATCH_EVENT_DELETE, events["foo/1"])
+
+	select {
+	case got := <-stream.events:
+		t.Fatalf("unexpected event %v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// watchStream forwards what a watch sends.
+type watchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *v1.WatchEvent
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchStream) Send(event *v1.WatchEvent) error {
+	s.events <- event
+
+	return nil
+}
+
+func TestController_SyncGossip(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	pool := node.NewPool(node.WithReplicationFactor(3))
+	checker := healthz.NewChecker(healthz.WithCheckInterval(time.Hour))
+	ctrl := service.NewController(log.NewNopLogger(), pool, checker, service.WithGossipInterval(0))
+	defer ctrl.TearDown()
+
+	nodes := make([]*testNode, 0, 4)
+
+	for i := 0; i < 4; i++ {
+		n := startNode(t, fmt.Sprintf("node-%d", i))
+		defer n.stop()
+
+		nodes = append(nodes, n)
+	}
+
+	for _, n := range nodes[:3] {
+		_, err := ctrl.RegisterNode(ctx, &v1.RegisterNodeRequest{Id: n.id, Address: n.addr})
+		require.NoError(t, err)
+	}
+
+	// node-0 heard that node-1 died and that node-3 joined, the controller
+	// never heard of node-3
+	cc, err := grpc.Dial(nodes[0].addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+
+	_, err = v1.NewGossipClient(cc).Ping(ctx, &v1.PingRequest{
+		From: nodes[3].id,
+		Updates: []*v1.Member{
+			{Id: nodes[1].id, Address: nodes[1].addr, State: v1.Member_STATE_DEAD, Incarnation: 1},
+			{Id: nodes[3].id, Address: nodes[3].addr, State: v1.Member_STATE_ALIVE},
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, ctrl.SyncGossip(ctx))
+
+	dead, ok := pool.Get(nodes[1].id)
+	require.True(t, ok, "node-1 in pool")
+	require.False(t, dead.IsReady(), "node-1 ready")
+
+	alive, ok := pool.Get(nodes[0].id)
+	require.True(t, ok, "node-0 in pool")
+	require.True(t, alive.IsReady(), "node-0 ready")
+
+	_, ok = pool.Get(nodes[3].id)
+	require.True(t, ok, "node-3 in pool")
+}
+
+func setupCluster(t *testing.T, size int, opts ...service.Option) (*service.Controller, []*testNode, func()) {
+	t.Helper()
+
+	logger := log.NewNopLogger()
+	pool := node.NewPool(node.WithReplicationFactor(3))
+	checker := healthz.NewChecker(healthz.WithCheckInterval(time.Hour))
+	opts = append([]service.Option{service.WithReplicaTimeout(time.Second)}, opts...)
+	ctrl := service.NewController(logger, pool, checker, opts...)
+
+	nodes := make([]*testNode, 0, size)
+
+	for i := 0; i < size; i++ {
+		n := startNode(t, fmt.Sprintf("node-%d", i))
+		nodes = append(nodes, n)
+
+		_, err := ctrl.RegisterNode(context.Background(), &v1.RegisterNodeRequest{Id: n.id, Address: n.addr})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, ctrl.Rebalance(context.Background()))
+
+	return ctrl, nodes, func() {
+		ctrl.TearDown()
+
+		for _, n := range nodes {
+			n.stop()
+		}
+	}
+}
+
+func startNode(t *testing.T, id string) *testNode {
+	t.Helper()
+
+	s, err := store.New()
+	require.NoError(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	n := &testNode{
+		id:     id,
+		addr:   lis.Addr().String(),
+		store:  s,
+		gossip: gossip.New(id, lis.Addr().String()),
+	}
+	n.serve(lis)
+
+	return n
+}
+
+func (n *testNode) serve(lis net.Listener) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		_ = bootstrap.StartNodeGRPCServer(
+			ctx, lis, server.NewNodeServer(n.store, n.id), gossip.NewServer(n.gossip), log.NewNopLogger(),
+		)
+	}()
+
+	n.stop = func() {
+		cancel()
+		<-done
+	}
+}
+
+// restart serves the node again on its address, with the data it had.
+func (n *testNode) restart(t *testing.T) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", n.addr)
+	require.NoError(t, err)
+
+	n.serve(lis)
+}
@@ -0,0 +1,501 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+	"emag-homework/internal/db/store"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultTxnTimeout          = time.Minute
+	defaultTxnRecoveryInterval = time.Second * 10
+
+	txnCommitted = "committed"
+	// txnOwnerSeparator ends the owner name the transaction ids start with
+	txnOwnerSeparator = "/"
+)
+
+// TxnLog durably records the transactions decided to commit, so the ones a
+// crash left in doubt are committed on recovery. A transaction prepared
+// without a record is presumed aborted.
+type TxnLog interface {
+	Get(k string) *store.Entry
+	Put(e store.Entry) error
+	Del(k string) error
+	Keys() []string
+	Close() error
+}
+
+// txn is a transaction being built: the versions it read and the writes it
+// will apply on commit.
+type txn struct {
+	mu        sync.Mutex
+	id        string
+	reads     map[string]int64
+	writes    map[string]*v1.BatchOp
+	touchedAt time.Time
+}
+
+// WithTxnLog sets where the commit decisions are recorded. By default they are
+// kept in memory, which only suits tests: a controller restart would presume
+// aborted the transactions it decided to commit, some replicas having applied
+// them already.
+func WithTxnLog(log TxnLog) Option {
+	return func(cfg *Config) {
+		cfg.TxnLog = log
+	}
+}
+
+// WithTxnOwner names the controller among several sharing the nodes. The ids
+// of the transactions it begins start with the name, and it recovers only
+// those, as their commit decisions are recorded in its log alone.
+func WithTxnOwner(owner string) Option {
+	return func(cfg *Config) {
+		cfg.TxnOwner = owner
+	}
+}
+
+// WithTxnTimeout sets how long a transaction may stay idle before it is
+// dropped, and how long a prepared transaction without a commit decision is
+// kept before it is aborted.
+func WithTxnTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.TxnTimeout = timeout
+	}
+}
+
+// WithTxnRecoveryInterval sets how often the nodes are checked for prepared
+// transactions left in doubt.
+func WithTxnRecoveryInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.TxnRecoveryInterval = interval
+	}
+}
+
+// Begin starts a transaction. Its writes are buffered on the controller until
+// it commits.
+func (c *Controller) Begin(_ context.Context, _ *v1.BeginRequest) (*v1.BeginResponse, error) {
+	id, err := newTxnID(c.txnOwner)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+
+	c.txns[id] = &txn{
+		id:        id,
+		reads:     make(map[string]int64),
+		writes:    make(map[string]*v1.BatchOp),
+		touchedAt: time.Now(),
+	}
+
+	return &v1.BeginResponse{TxnId: id}, nil
+}
+
+// TxnGet reads the key within the transaction, seeing its own writes. The
+// version read is checked again on commit.
+func (c *Controller) TxnGet(ctx context.Context, req *v1.TxnGetRequest) (*v1.GetResponse, error) {
+	t, err := c.txn(req.TxnId)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if op, ok := t.writes[req.Key]; ok {
+		if op.Type == v1.BatchOp_BATCH_OP_DELETE {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("%q not found", req.Key))
+		}
+
+		return &v1.GetResponse{Value: op.Value}, nil
+	}
+
+	res, err := c.Get(ctx, &v1.GetRequest{Key: req.Key, Consistency: req.Consistency})
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	if _, ok := t.reads[req.Key]; !ok {
+		t.reads[req.Key] = res.GetVersion()
+	}
+
+	return res, err
+}
+
+// TxnPut buffers a write of the transaction.
+func (c *Controller) TxnPut(_ context.Context, req *v1.TxnPutRequest) (*v1.TxnPutResponse, error) {
+	t, err := c.txn(req.TxnId)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	op := &v1.BatchOp{Type: v1.BatchOp_BATCH_OP_PUT, Key: req.Key, Value: req.Value}
+	if req.Delete {
+		op = &v1.BatchOp{Type: v1.BatchOp_BATCH_OP_DELETE, Key: req.Key}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.writes[req.Key] = op
+
+	return &v1.TxnPutResponse{}, nil
+}
+
+// Commit runs the two-phase commit of the transaction. Every replica of the
+// keys written prepares the writes, and the primary replica of every key read
+// checks it is still at the version read. Once all of them voted yes, the
+// decision is recorded and the replicas commit. Any no vote aborts the
+// transaction, which fails with Aborted. A replica votes no when a key written
+// already holds a newer version than the commit, and refuses the plain writes
+// to the keys while prepared, so the writes reported committed are not
+// superseded by writes racing with the commit.
+func (c *Controller) Commit(ctx context.Context, req *v1.CommitRequest) (*v1.CommitResponse, error) {
+	t, err := c.takeTxn(req.TxnId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(t.writes) == 0 && len(t.reads) == 0 {
+		return &v1.CommitResponse{}, nil
+	}
+
+	version := c.clock.Now()
+
+	participants, err := c.participants(t, version)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*node.Item, 0, len(participants))
+	for item := range participants {
+		items = append(items, item)
+	}
+
+	c.setCommitting(t.id, true)
+	defer c.setCommitting(t.id, false)
+
+	if err := c.prepare(ctx, t.id, items, participants); err != nil {
+		c.abort(t.id, items)
+
+		return nil, err
+	}
+
+	err = c.txnLog.Put(store.Entry{Key: t.id, Value: []byte(txnCommitted), Version: version})
+	if err != nil {
+		c.abort(t.id, items)
+
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed recording commit: %v", err))
+	}
+
+	var failed int
+
+	resultCh := c.broadcast(ctx, items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Commit(ctx, &v1.CommitRequest{TxnId: t.id})
+	})
+
+	for range items {
+		if r := <-resultCh; r.err != nil {
+			// the decision is recorded, recovery commits it later
+			c.logger.Error("commit %s on node %s failed: %v", t.id, r.item.ID(), r.err)
+			failed++
+		}
+	}
+
+	if failed == 0 {
+		if err := c.txnLog.Del(t.id); err != nil {
+			c.logger.Error("failed dropping commit record %s: %v", t.id, err)
+		}
+	}
+
+	return &v1.CommitResponse{Version: version}, nil
+}
+
+// Abort drops the transaction. Nothing was sent to the nodes before commit.
+func (c *Controller) Abort(_ context.Context, req *v1.AbortRequest) (*v1.AbortResponse, error) {
+	if _, err := c.takeTxn(req.TxnId); err != nil {
+		return nil, err
+	}
+
+	return &v1.AbortResponse{}, nil
+}
+
+// participants returns the prepare request of every node taking part in the
+// transaction.
+func (c *Controller) participants(t *txn, version int64) (map[*node.Item]*v1.PrepareRequest, error) {
+	participants := make(map[*node.Item]*v1.PrepareRequest)
+
+	request := func(item *node.Item) *v1.PrepareRequest {
+		req, ok := participants[item]
+		if !ok {
+			req = &v1.PrepareRequest{TxnId: t.id, Version: version}
+			participants[item] = req
+		}
+
+		return req
+	}
+
+	w := c.writeQuorum(v1.Consistency_CONSISTENCY_DEFAULT, c.pool.ReplicationFactor())
+
+	for key, op := range t.writes {
+		items := c.replicas(key)
+		if len(items) == 0 || len(items) < w {
+			return nil, status.Error(codes.Unavailable, fmt.Sprintf(
+				"write quorum not reachable for %q: %d of %d replicas ready", key, len(items), w,
+			))
+		}
+
+		for _, item := range items {
+			req := request(item)
+			req.Writes = append(req.Writes, op)
+		}
+	}
+
+	for key, version := range t.reads {
+		items := c.replicas(key)
+		if len(items) == 0 {
+			return nil, status.Error(codes.Unavailable, fmt.Sprintf("no replica ready for %q", key))
+		}
+
+		req := request(items[0])
+		req.Reads = append(req.Reads, &v1.ReadCheck{Key: key, Version: version})
+	}
+
+	return participants, nil
+}
+
+func (c *Controller) prepare(
+	ctx context.Context, id string, items []*node.Item, participants map[*node.Item]*v1.PrepareRequest,
+) error {
+	var err error
+
+	resultCh := c.broadcastEach(ctx, items, func(ctx context.Context, item *node.Item) (interface{}, error) {
+		return item.Client().Prepare(ctx, participants[item])
+	})
+
+	for range items {
+		r := <-resultCh
+		if r.err == nil || err != nil {
+			continue
+		}
+
+		if status.Code(r.err) == codes.FailedPrecondition {
+			err = status.Error(codes.Aborted, fmt.Sprintf("transaction %s aborted: %s", id, status.Convert(r.err).Message()))
+
+			continue
+		}
+
+		err = status.Error(codes.Unavailable, fmt.Sprintf(
+			"transaction %s aborted: prepare on node %s failed: %v", id, r.item.ID(), r.err,
+		))
+	}
+
+	return err
+}
+
+// abort releases the transaction on the participants in the background. The
+// ones not reached are aborted by recovery.
+func (c *Controller) abort(id string, items []*node.Item) {
+	resultCh := c.broadcast(context.Background(), items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Abort(ctx, &v1.AbortRequest{TxnId: id})
+	})
+
+	go func() {
+		for range items {
+			if r := <-resultCh; r.err != nil {
+				c.logger.Error("abort %s on node %s failed: %v", id, r.item.ID(), r.err)
+			}
+		}
+	}()
+}
+
+func (c *Controller) txn(id string) (*txn, error) {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+
+	t, ok := c.txns[id]
+	if !ok {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("transaction %q not found", id))
+	}
+
+	t.touchedAt = time.Now()
+
+	return t, nil
+}
+
+func (c *Controller) takeTxn(id string) (*txn, error) {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+
+	t, ok := c.txns[id]
+	if !ok {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("transaction %q not found", id))
+	}
+
+	delete(c.txns, id)
+
+	return t, nil
+}
+
+func (c *Controller) setCommitting(id string, committing bool) {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+
+	if committing {
+		c.committing[id] = struct{}{}
+	} else {
+		delete(c.committing, id)
+	}
+}
+
+func (c *Controller) isCommitting(id string) bool {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+
+	_, ok := c.committing[id]
+
+	return ok
+}
+
+func (c *Controller) startTxnRecovery() {
+	t := time.NewTicker(c.txnRecoveryInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-t.C:
+			c.RecoverTxns()
+		}
+	}
+}
+
+// RecoverTxns resolves the transactions a crash left prepared on the nodes:
+// the ones with a commit record are committed, the others are aborted once
+// older than the transaction timeout. It also drops the idle transactions and
+// the commit records no node refers to anymore. The transactions of the other
+// controllers are left to them, as only their owner knows whether they were
+// decided to commit.
+func (c *Controller) RecoverTxns() {
+	c.expireTxns()
+
+	items := c.pool.Select()
+	resultCh := c.broadcast(context.Background(), items, func(ctx context.Context, client v1.NodeClient) (interface{}, error) {
+		return client.Intents(ctx, &v1.IntentsRequest{})
+	})
+
+	seen := make(map[string]bool)
+	complete := len(items) == c.pool.Size()
+
+	for range items {
+		r := <-resultCh
+		if r.err != nil {
+			c.logger.Error("list intents on node %s failed: %v", r.item.ID(), r.err)
+			complete = false
+
+			continue
+		}
+
+		for _, intent := range r.res.(*v1.IntentsResponse).Intents {
+			seen[intent.TxnId] = true
+			c.resolveIntent(r.item, intent)
+		}
+	}
+
+	// a node not listed might still hold a prepared transaction
+	if !complete {
+		return
+	}
+
+	for _, id := range c.txnLog.Keys() {
+		if seen[id] || c.isCommitting(id) {
+			continue
+		}
+
+		if err := c.txnLog.Del(id); err != nil {
+			c.logger.Error("failed dropping commit record %s: %v", id, err)
+		}
+	}
+}
+
+func (c *Controller) resolveIntent(item *node.Item, intent *v1.Intent) {
+	if !c.ownsTxn(intent.TxnId) || c.isCommitting(intent.TxnId) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.replicaTimeout)
+	defer cancel()
+
+	if c.txnLog.Get(intent.TxnId) != nil {
+		c.logger.Info("recovery: committing %s on node %s", intent.TxnId, item.ID())
+
+		if _, err := item.Client().Commit(ctx, &v1.CommitRequest{TxnId: intent.TxnId}); err != nil {
+			c.logger.Error("recovery: commit %s on node %s failed: %v", intent.TxnId, item.ID(), err)
+		}
+
+		return
+	}
+
+	if time.Since(time.Unix(0, intent.PreparedAt)) < c.txnTimeout {
+		return
+	}
+
+	c.logger.Info("recovery: aborting %s on node %s", intent.TxnId, item.ID())
+
+	if _, err := item.Client().Abort(ctx, &v1.AbortRequest{TxnId: intent.TxnId}); err != nil {
+		c.logger.Error("recovery: abort %s on node %s failed: %v", intent.TxnId, item.ID(), err)
+	}
+}
+
+func (c *Controller) expireTxns() {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+
+	for id, t := range c.txns {
+		if time.Since(t.touchedAt) > c.txnTimeout {
+			delete(c.txns, id)
+		}
+	}
+}
+
+func newTxnID(owner string) (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed generating transaction id: %w", err)
+	}
+
+	if owner == "" {
+		return hex.EncodeToString(b), nil
+	}
+
+	return owner + txnOwnerSeparator + hex.EncodeToString(b), nil
+}
+
+// ownsTxn tells whether the transaction was begun by the controller. Without
+// an owner name, the controller is the only one and owns every transaction.
+func (c *Controller) ownsTxn(id string) bool {
+	return c.txnOwner == "" || strings.HasPrefix(id, c.txnOwner+txnOwnerSeparator)
+}
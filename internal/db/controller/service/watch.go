@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/node"
+	"emag-homework/internal/db/hlc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// watchDedupWindow is how long the version of a key is kept to drop the same
+// event from its other replicas, which send it within the replica timeout or
+// once they get a hint.
+const watchDedupWindow = time.Minute
+
+type watchResult struct {
+	item  *node.Item
+	event *v1.WatchEvent
+	err   error
+}
+
+// Watch streams the changes of the keys as the nodes apply them. Every
+// replica of a key reports its changes, so an event is only sent the first
+// time its version is seen. The versions older than the dedup window are
+// forgotten, so a replica sending an event later than that sends it again.
+// The events of the nodes no longer replicas of the key on the current ring
+// are left out. The watch ends when a node stream fails, for the client to
+// resume it from the last version it got.
+func (c *Controller) Watch(req *v1.WatchRequest, stream v1.Controller_WatchServer) error {
+	if req.Key != "" && req.Prefix != "" {
+		return status.Error(codes.InvalidArgument, "either key or prefix can be set")
+	}
+
+	items := c.pool.Select()
+	if req.Key != "" {
+		items = c.replicas(req.Key)
+	}
+
+	if len(items) == 0 {
+		return status.Error(codes.Unavailable, "no node ready")
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	resultCh := make(chan watchResult)
+
+	for _, item := range items {
+		go watchNode(ctx, item, req, resultCh)
+	}
+
+	latest := make(map[string]*v1.WatchEvent)
+
+	t := time.NewTicker(watchDedupWindow)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			floor := hlc.FromTime(time.Now().Add(-watchDedupWindow))
+
+			for key, event := range latest {
+				if event.Version < floor {
+					delete(latest, key)
+				}
+			}
+		case res := <-resultCh:
+			if res.err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+
+				c.logger.Error("watch on node %s failed: %v", res.item.ID(), res.err)
+
+				return status.Error(codes.Unavailable, fmt.Sprintf("watch on node %s failed", res.item.ID()))
+			}
+
+			if !c.owners(res.event.Key)[res.item.ID()] {
+				continue
+			}
+
+			if last, ok := latest[res.event.Key]; ok && !newer(watchReply(res.event), watchReply(last)) {
+				continue
+			}
+
+			latest[res.event.Key] = res.event
+
+			if err := stream.Send(res.event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func watchNode(ctx context.Context, item *node.Item, req *v1.WatchRequest, resultCh chan<- watchResult) {
+	send := func(res watchResult) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case resultCh <- res:
+			return true
+		}
+	}
+
+	stream, err := item.Client().Watch(ctx, req)
+	if err != nil {
+		send(watchResult{item: item, err: err})
+
+		return
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			send(watchResult{item: item, err: err})
+
+			return
+		}
+
+		if !send(watchResult{item: item, event: event}) {
+			return
+		}
+	}
+}
+
+func watchReply(event *v1.WatchEvent) *v1.GetResponse {
+	return &v1.GetResponse{
+		Value:     event.Value,
+		Version:   event.Version,
+		Tombstone: event.Type == v1.WatchEvent_WATCH_EVENT_DELETE,
+	}
+}
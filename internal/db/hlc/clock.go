@@ -0,0 +1,110 @@
+// Package hlc implements a hybrid logical clock. Timestamps follow the wall
+// clock in milliseconds, but never go backwards and never repeat: when the
+// wall clock stalls or lags behind a timestamp already seen, a logical counter
+// is incremented instead. The id of the clock owner is kept in the lowest bits,
+// so timestamps issued by different clocks never collide.
+//
+// A timestamp is laid out as [wall ms: 42 bits][logical: 13 bits][node: 8 bits].
+package hlc
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	nodeBits    = 8
+	logicalBits = 13
+
+	maxLogical = 1<<logicalBits - 1
+	nodeMask   = 1<<nodeBits - 1
+)
+
+type Clock struct {
+	mu      sync.Mutex
+	node    int64
+	wall    int64
+	logical int64
+	now     func() time.Time
+}
+
+// New creates the clock of the node. The node id must be unique among the
+// clocks issuing timestamps for the same keys, else their timestamps collide.
+func New(node uint8) *Clock {
+	return &Clock{
+		node: int64(node),
+		now:  time.Now,
+	}
+}
+
+// Now returns a timestamp greater than any timestamp issued or observed so far.
+func (c *Clock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.now().UnixMilli()
+
+	if pt > c.wall {
+		c.wall = pt
+		c.logical = 0
+	} else {
+		c.tick(c.logical + 1)
+	}
+
+	return c.timestamp()
+}
+
+// Update observes a timestamp issued by another clock, so the timestamps
+// issued afterwards are greater than it.
+func (c *Clock) Update(ts int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall, logical := Wall(ts), Logical(ts)
+
+	if wall < c.wall || (wall == c.wall && logical <= c.logical) {
+		return
+	}
+
+	c.wall = wall
+	c.logical = logical
+}
+
+func (c *Clock) tick(logical int64) {
+	if logical > maxLogical {
+		c.wall++
+		logical = 0
+	}
+
+	c.logical = logical
+}
+
+func (c *Clock) timestamp() int64 {
+	return c.wall<<(logicalBits+nodeBits) | c.logical<<nodeBits | c.node
+}
+
+// Wall returns the wall clock part of the timestamp in Unix milliseconds.
+func Wall(ts int64) int64 {
+	return ts >> (logicalBits + nodeBits)
+}
+
+// Logical returns the logical counter of the timestamp.
+func Logical(ts int64) int64 {
+	return ts >> nodeBits & maxLogical
+}
+
+// Node returns the id of the clock which issued the timestamp.
+func Node(ts int64) uint8 {
+	return uint8(ts & nodeMask)
+}
+
+// FromTime returns the lowest timestamp issued at the wall clock time, below
+// every timestamp issued afterwards.
+func FromTime(t time.Time) int64 {
+	return t.UnixMilli() << (logicalBits + nodeBits)
+}
+
+// Time converts the timestamp to wall clock time.
+func Time(ts int64) time.Time {
+	return time.UnixMilli(Wall(ts))
+}
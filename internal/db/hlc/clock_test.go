@@ -0,0 +1,117 @@
+package hlc
+
+import (
+	"testing"
+	"time"
+
+	"emag-homework/pkg/test/require"
+)
+
+func TestClock_Now(t *testing.T) {
+	t.Parallel()
+
+	wall := time.UnixMilli(1_700_000_000_000)
+
+	tests := []struct {
+		name  string
+		ticks []time.Time
+	}{
+		{
+			name:  "wall clock moves forward",
+			ticks: []time.Time{wall, wall.Add(time.Millisecond), wall.Add(time.Second)},
+		},
+		{
+			name:  "wall clock stalls",
+			ticks: []time.Time{wall, wall, wall, wall},
+		},
+		{
+			name:  "wall clock goes backwards",
+			ticks: []time.Time{wall, wall.Add(-time.Second), wall.Add(-time.Minute)},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var i int
+
+			c := New(7)
+			c.now = func() time.Time {
+				defer func() { i++ }()
+
+				return tt.ticks[i]
+			}
+
+			var prev int64
+
+			for range tt.ticks {
+				ts := c.Now()
+
+				require.True(t, ts > prev, "monotonic")
+				require.Equal(t, uint8(7), Node(ts), "node")
+				require.True(t, Wall(ts) >= wall.UnixMilli(), "never behind the highest wall clock")
+
+				prev = ts
+			}
+		})
+	}
+}
+
+func TestClock_Update(t *testing.T) {
+	t.Parallel()
+
+	wall := time.UnixMilli(1_700_000_000_000)
+
+	remote := New(1)
+	remote.now = func() time.Time { return wall.Add(time.Hour) }
+
+	local := New(2)
+	local.now = func() time.Time { return wall }
+
+	observed := remote.Now()
+	local.Update(observed)
+
+	got := local.Now()
+
+	require.True(t, got > observed, "ahead of the observed timestamp")
+	require.Equal(t, Wall(observed), Wall(got), "wall")
+	require.Equal(t, uint8(2), Node(got), "node")
+}
+
+func TestClock_Overflow(t *testing.T) {
+	t.Parallel()
+
+	wall := time.UnixMilli(1_700_000_000_000)
+
+	c := New(0)
+	c.now = func() time.Time { return wall }
+
+	var prev int64
+
+	for i := 0; i < maxLogical+10; i++ {
+		ts := c.Now()
+		require.True(t, ts > prev, "monotonic")
+
+		prev = ts
+	}
+
+	require.Equal(t, wall.UnixMilli()+1, Wall(prev), "logical overflow moves the wall clock")
+}
+
+func TestFromTime(t *testing.T) {
+	t.Parallel()
+
+	wall := time.UnixMilli(1_700_000_000_000)
+
+	c := New(9)
+	c.now = func() time.Time { return wall }
+
+	ts := c.Now()
+
+	require.True(t, FromTime(wall) <= ts, "at or before the timestamps of the same time")
+	require.True(t, FromTime(wall.Add(-time.Millisecond)) < ts, "before the earlier ones")
+	require.Equal(t, wall, Time(FromTime(wall)))
+}
@@ -0,0 +1,72 @@
+// Package keyspace places keys on the hash ring shared by the controller,
+// which partitions the keys, and the nodes, which summarize them by range.
+package keyspace
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Hash is fnv-1a followed by the murmur3 finalizer, which spreads the tokens
+// of similar names ("id#1", "id#2"...) evenly on the ring.
+func Hash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
+
+// Range is the arc of the ring from Start, excluded, to End, included, going
+// clockwise, so it wraps around when Start >= End. Start == End is the whole
+// ring.
+type Range struct {
+	Start uint64
+	End   uint64
+}
+
+// Full is the whole ring.
+var Full = Range{}
+
+func (r Range) Contains(pos uint64) bool {
+	if r.Start == r.End {
+		return true
+	}
+
+	// shifting the range to start at 0 handles the wrap around
+	return pos-r.Start-1 < r.End-r.Start
+}
+
+// Split cuts the range in n consecutive ranges of about the same length.
+func (r Range) Split(n int) []Range {
+	if n <= 1 {
+		return []Range{r}
+	}
+
+	length := r.End - r.Start
+	step := length / uint64(n)
+
+	if length == 0 {
+		step = math.MaxUint64/uint64(n) + 1
+	}
+
+	if step == 0 {
+		return []Range{r}
+	}
+
+	parts := make([]Range, 0, n)
+	start := r.Start
+
+	for i := 0; i < n-1; i++ {
+		parts = append(parts, Range{Start: start, End: start + step})
+		start += step
+	}
+
+	return append(parts, Range{Start: start, End: r.End})
+}
@@ -0,0 +1,169 @@
+// Package merkle summarizes the keys of a replica by ranges of the hash ring,
+// so two replicas can find the keys they disagree on by comparing a few
+// hashes instead of every key.
+package merkle
+
+import (
+	"sort"
+
+	"emag-homework/internal/db/keyspace"
+)
+
+const (
+	bucketBits  = 12
+	bucketCount = 1 << bucketBits
+	bucketShift = 64 - bucketBits
+)
+
+// Tree keeps the digests of the keys in fixed buckets of the ring, the hash of
+// a bucket being the XOR of its digests, so it is updated in constant time on
+// every write. The hash of any range, and of the parts of a range down to
+// single keys, is then derived from the buckets it covers: the upper levels
+// of the tree are computed when asked for. Tree is not safe for concurrent
+// use.
+type Tree struct {
+	buckets []bucket
+}
+
+type bucket struct {
+	hash uint64
+	keys map[string]leaf
+}
+
+type leaf struct {
+	pos    uint64
+	digest uint64
+}
+
+// Part is the summary of a range: the XOR of the digests of its keys.
+type Part struct {
+	Range keyspace.Range
+	Hash  uint64
+	Count int
+}
+
+// Key is a key along with the digest of its value.
+type Key struct {
+	Key    string
+	Digest uint64
+}
+
+func New() *Tree {
+	return &Tree{
+		buckets: make([]bucket, bucketCount),
+	}
+}
+
+// Set sets the digest of the key.
+func (t *Tree) Set(key string, digest uint64) {
+	pos := keyspace.Hash(key)
+	b := &t.buckets[pos>>bucketShift]
+
+	if b.keys == nil {
+		b.keys = make(map[string]leaf)
+	}
+
+	if old, ok := b.keys[key]; ok {
+		b.hash ^= old.digest
+	}
+
+	b.keys[key] = leaf{pos: pos, digest: digest}
+	b.hash ^= digest
+}
+
+func (t *Tree) Remove(key string) {
+	pos := keyspace.Hash(key)
+	b := &t.buckets[pos>>bucketShift]
+
+	if old, ok := b.keys[key]; ok {
+		b.hash ^= old.digest
+		delete(b.keys, key)
+	}
+}
+
+// Hash returns the summary of the range.
+func (t *Tree) Hash(r keyspace.Range) Part {
+	part := Part{Range: r}
+
+	t.walk(r, func(b *bucket, full bool) {
+		if full {
+			part.Hash ^= b.hash
+			part.Count += len(b.keys)
+
+			return
+		}
+
+		for _, l := range b.keys {
+			if r.Contains(l.pos) {
+				part.Hash ^= l.digest
+				part.Count++
+			}
+		}
+	})
+
+	return part
+}
+
+// Hashes returns the summaries of the range split in n parts, the children of
+// the range in the tree.
+func (t *Tree) Hashes(r keyspace.Range, n int) []Part {
+	ranges := r.Split(n)
+	parts := make([]Part, 0, len(ranges))
+
+	for _, sub := range ranges {
+		parts = append(parts, t.Hash(sub))
+	}
+
+	return parts
+}
+
+// Keys returns the keys of the range along with their digests, in key order.
+func (t *Tree) Keys(r keyspace.Range) []Key {
+	keys := make([]Key, 0)
+
+	t.walk(r, func(b *bucket, full bool) {
+		for k, l := range b.keys {
+			if full || r.Contains(l.pos) {
+				keys = append(keys, Key{Key: k, Digest: l.digest})
+			}
+		}
+	})
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Key < keys[j].Key
+	})
+
+	return keys
+}
+
+// walk calls fn with the buckets overlapping the range, telling whether the
+// range covers all of the bucket.
+func (t *Tree) walk(r keyspace.Range, fn func(b *bucket, full bool)) {
+	if r.Start == r.End {
+		for i := range t.buckets {
+			fn(&t.buckets[i], true)
+		}
+
+		return
+	}
+
+	first := (r.Start + 1) >> bucketShift
+	last := r.End >> bucketShift
+	count := int((last-first)&(bucketCount-1)) + 1
+
+	// a range wrapping around within a single bucket overlaps all of them
+	if first == last && r.End-r.Start >= 1<<bucketShift {
+		count = bucketCount
+	}
+
+	for i := 0; i < count; i++ {
+		idx := (first + uint64(i)) & (bucketCount - 1)
+		full := i > 0 && i < count-1
+
+		if count == bucketCount && first == last {
+			full = idx != first
+		}
+
+		fn(&t.buckets[idx], full)
+	}
+}
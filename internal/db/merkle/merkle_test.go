@@ -0,0 +1,72 @@
+package merkle_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"emag-homework/internal/db/keyspace"
+	"emag-homework/internal/db/merkle"
+	"emag-homework/pkg/test/require"
+)
+
+func TestTree_Hash(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	tree := merkle.New()
+	digests := make(map[string]uint64)
+
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		digests[k] = rand.Uint64()
+		tree.Set(k, digests[k])
+	}
+
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		delete(digests, k)
+		tree.Remove(k)
+	}
+
+	ranges := []keyspace.Range{
+		keyspace.Full,
+		{Start: 0, End: math.MaxUint64 / 3},
+		{Start: math.MaxUint64 / 2, End: 10},
+		{Start: math.MaxUint64, End: 1 << 40},
+		{Start: 1<<60 + 5, End: 1<<60 + 3},
+	}
+
+	for i := 0; i < 20; i++ {
+		ranges = append(ranges, keyspace.Range{Start: rand.Uint64(), End: rand.Uint64()})
+	}
+
+	for _, r := range ranges {
+		var want merkle.Part
+
+		for k, d := range digests {
+			if r.Contains(keyspace.Hash(k)) {
+				want.Hash ^= d
+				want.Count++
+			}
+		}
+
+		got := tree.Hash(r)
+		require.Equal(t, want.Hash, got.Hash, r)
+		require.Equal(t, want.Count, got.Count, r)
+		require.Equal(t, want.Count, len(tree.Keys(r)), r)
+
+		var sum merkle.Part
+
+		for _, part := range tree.Hashes(r, 16) {
+			sum.Hash ^= part.Hash
+			sum.Count += part.Count
+		}
+
+		require.Equal(t, want.Hash, sum.Hash, r)
+		require.Equal(t, want.Count, sum.Count, r)
+	}
+}
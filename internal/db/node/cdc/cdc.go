@@ -0,0 +1,494 @@
+// Package cdc exports the mutations applied to a node store as NDJSON files,
+// for downstream consumers to follow the changes of the node.
+package cdc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"emag-homework/internal/db/store"
+	"emag-homework/pkg/fileutil"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 1000
+	defaultMaxFileSize  = 64 << 20
+
+	checkpointName = "checkpoint.json"
+	filePrefix     = "changes-"
+	fileSuffix     = ".ndjson"
+)
+
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+	// OpPurge is a key removed from the store, such as a collected tombstone.
+	OpPurge = "purge"
+)
+
+type Logger interface {
+	Info(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+// Source is the store the changes are read from.
+type Source interface {
+	Changes(after uint64, limit int) ([]store.Change, uint64, error)
+	Retain(seq uint64)
+}
+
+// Event is a line of the export files. Value is base64 encoded, as usual for
+// bytes in JSON, and Seq orders the events, several events of a batch sharing
+// the same Seq.
+type Event struct {
+	Seq       uint64 `json:"seq"`
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+	Version   int64  `json:"version,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+type Config struct {
+	Logger       Logger
+	PollInterval time.Duration
+	BatchSize    int
+	MaxFileSize  int64
+	MaxFiles     int
+}
+
+type Option func(cfg *Config)
+
+func WithLogger(logger Logger) Option {
+	return func(cfg *Config) {
+		cfg.Logger = logger
+	}
+}
+
+// WithPollInterval sets how often the store is checked for new changes.
+func WithPollInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.PollInterval = interval
+	}
+}
+
+// WithBatchSize sets how many log records are exported at most per
+// checkpoint.
+func WithBatchSize(size int) Option {
+	return func(cfg *Config) {
+		cfg.BatchSize = size
+	}
+}
+
+// WithMaxFileSize sets the size after which a new export file is started.
+func WithMaxFileSize(size int64) Option {
+	return func(cfg *Config) {
+		cfg.MaxFileSize = size
+	}
+}
+
+// WithMaxFiles removes the oldest export files beyond n. By default, files
+// are kept until the consumers remove them.
+func WithMaxFiles(n int) Option {
+	return func(cfg *Config) {
+		cfg.MaxFiles = n
+	}
+}
+
+// checkpoint is the last log record exported and where its last event ends.
+type checkpoint struct {
+	Seq    uint64 `json:"seq"`
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+}
+
+// Exporter follows the log of a store and appends its changes to files named
+// after the sequence of their first event, in dir. A checkpoint is saved
+// after every batch of changes, once they are synced, and the log is kept
+// from it: after a restart, the export resumes from the checkpoint and drops
+// the events written after it, so every change is exported exactly once.
+type Exporter struct {
+	source       Source
+	dir          string
+	logger       Logger
+	pollInterval time.Duration
+	batchSize    int
+	maxFileSize  int64
+	maxFiles     int
+	checkpoint   checkpoint
+	fd           *os.File
+	mu           sync.Mutex
+	doneCh       chan struct{}
+	wg           sync.WaitGroup
+}
+
+func New(source Source, dir string, opts ...Option) (*Exporter, error) {
+	cfg := &Config{
+		Logger:       noOpLogger{},
+		PollInterval: defaultPollInterval,
+		BatchSize:    defaultBatchSize,
+		MaxFileSize:  defaultMaxFileSize,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	e := &Exporter{
+		source:       source,
+		dir:          dir,
+		logger:       cfg.Logger,
+		pollInterval: cfg.PollInterval,
+		batchSize:    cfg.BatchSize,
+		maxFileSize:  cfg.MaxFileSize,
+		maxFiles:     cfg.MaxFiles,
+		doneCh:       make(chan struct{}),
+	}
+
+	if err := e.setup(); err != nil {
+		return nil, err
+	}
+
+	e.wg.Add(1)
+
+	go e.start()
+
+	return e, nil
+}
+
+func (e *Exporter) setup() error {
+	if err := os.MkdirAll(e.dir, 0o755); err != nil {
+		return fmt.Errorf("failed creating export dir %q: %w", e.dir, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(e.dir, checkpointName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed reading checkpoint: %w", err)
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &e.checkpoint); err != nil {
+			return fmt.Errorf("failed decoding checkpoint: %w", err)
+		}
+	}
+
+	if err := e.removeOrphans(); err != nil {
+		return err
+	}
+
+	if e.checkpoint.File != "" {
+		fd, err := os.OpenFile(filepath.Join(e.dir, e.checkpoint.File), os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed opening export file: %w", err)
+		}
+
+		// the events written after the checkpoint are exported again
+		if err := fd.Truncate(e.checkpoint.Offset); err != nil {
+			fd.Close()
+
+			return fmt.Errorf("failed truncating export file: %w", err)
+		}
+
+		if _, err := fd.Seek(e.checkpoint.Offset, 0); err != nil {
+			fd.Close()
+
+			return fmt.Errorf("failed seeking export file: %w", err)
+		}
+
+		e.fd = fd
+	}
+
+	e.source.Retain(e.checkpoint.Seq)
+
+	return nil
+}
+
+// removeOrphans removes the export files started after the checkpoint was
+// saved, as after a crash while rotating. Their events are exported again from
+// the checkpoint.
+func (e *Exporter) removeOrphans() error {
+	files, err := Files(e.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file)
+
+		// the names sort by the sequence of their first event
+		if e.checkpoint.File != "" && name <= e.checkpoint.File {
+			continue
+		}
+
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed removing export file: %w", err)
+		}
+
+		e.logger.Info("removed export file %s started after the checkpoint", name)
+	}
+
+	return nil
+}
+
+// Export writes the changes logged since the checkpoint and returns how many
+// events were written.
+func (e *Exporter) Export() (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var count int
+
+	for {
+		changes, last, err := e.source.Changes(e.checkpoint.Seq, e.batchSize)
+		if errors.Is(err, store.ErrLogCompacted) {
+			e.logger.Error("changes lost, resuming the export after sequence %d: %v", last, err)
+
+			e.checkpoint.Seq = last
+
+			continue
+		}
+
+		if err != nil {
+			return count, fmt.Errorf("failed reading changes: %w", err)
+		}
+
+		if last == e.checkpoint.Seq {
+			return count, nil
+		}
+
+		if err := e.write(changes); err != nil {
+			return count, err
+		}
+
+		if err := e.saveCheckpoint(last); err != nil {
+			return count, err
+		}
+
+		count += len(changes)
+	}
+}
+
+func (e *Exporter) write(changes []store.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var w *bufio.Writer
+
+	for _, c := range changes {
+		if e.fd == nil || e.checkpoint.Offset >= e.maxFileSize {
+			if w != nil {
+				if err := w.Flush(); err != nil {
+					return fmt.Errorf("failed writing export file: %w", err)
+				}
+			}
+
+			if err := e.rotate(c.Seq); err != nil {
+				return err
+			}
+
+			w = nil
+		}
+
+		if w == nil {
+			w = bufio.NewWriter(e.fd)
+		}
+
+		line, err := json.Marshal(toEvent(c))
+		if err != nil {
+			return fmt.Errorf("failed encoding event: %w", err)
+		}
+
+		line = append(line, '\n')
+
+		if _, err := w.Write(line); err != nil {
+			return fmt.Errorf("failed writing export file: %w", err)
+		}
+
+		e.checkpoint.Offset += int64(len(line))
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed writing export file: %w", err)
+	}
+
+	if err := e.fd.Sync(); err != nil {
+		return fmt.Errorf("failed syncing export file: %w", err)
+	}
+
+	return nil
+}
+
+// rotate starts a new export file with the event at the sequence.
+func (e *Exporter) rotate(seq uint64) error {
+	if e.fd != nil {
+		if err := e.fd.Sync(); err != nil {
+			return fmt.Errorf("failed syncing export file: %w", err)
+		}
+
+		if err := e.fd.Close(); err != nil {
+			return fmt.Errorf("failed closing export file: %w", err)
+		}
+
+		e.fd = nil
+	}
+
+	name := fmt.Sprintf("%s%020d%s", filePrefix, seq, fileSuffix)
+
+	fd, err := os.OpenFile(filepath.Join(e.dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed creating export file: %w", err)
+	}
+
+	e.fd = fd
+	e.checkpoint.File = name
+	e.checkpoint.Offset = 0
+
+	return e.removeOldFiles()
+}
+
+func (e *Exporter) removeOldFiles() error {
+	if e.maxFiles <= 0 {
+		return nil
+	}
+
+	files, err := Files(e.dir)
+	if err != nil {
+		return err
+	}
+
+	for len(files) > e.maxFiles {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed removing export file: %w", err)
+		}
+
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// saveCheckpoint atomically replaces the checkpoint, then lets the store
+// compact the records exported.
+func (e *Exporter) saveCheckpoint(seq uint64) error {
+	e.checkpoint.Seq = seq
+
+	data, err := json.Marshal(e.checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed encoding checkpoint: %w", err)
+	}
+
+	if err := fileutil.WriteFile(filepath.Join(e.dir, checkpointName), data); err != nil {
+		return fmt.Errorf("failed saving checkpoint: %w", err)
+	}
+
+	e.source.Retain(seq)
+
+	return nil
+}
+
+// Files returns the export files of the dir, oldest first.
+func Files(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing export dir: %w", err)
+	}
+
+	files := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func toEvent(c store.Change) Event {
+	ev := Event{
+		Seq:     c.Seq,
+		Key:     c.Entry.Key,
+		Version: c.Entry.Version,
+	}
+
+	switch {
+	case c.Purged:
+		ev.Op = OpPurge
+	case c.Entry.Tombstone:
+		ev.Op = OpDelete
+	default:
+		ev.Op = OpPut
+		ev.Value = c.Entry.Value
+	}
+
+	if c.Time != 0 {
+		ev.Timestamp = time.Unix(0, c.Time).UTC().Format(time.RFC3339Nano)
+	}
+
+	return ev
+}
+
+func (e *Exporter) start() {
+	defer e.wg.Done()
+
+	t := time.NewTicker(e.pollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-e.doneCh:
+			return
+		case <-t.C:
+			count, err := e.Export()
+			if err != nil {
+				e.logger.Error("failed exporting changes: %v", err)
+
+				continue
+			}
+
+			if count > 0 {
+				e.logger.Info("exported %d change(s)", count)
+			}
+		}
+	}
+}
+
+// Close exports the pending changes and stops the exporter.
+func (e *Exporter) Close() error {
+	close(e.doneCh)
+	e.wg.Wait()
+
+	_, err := e.Export()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.fd != nil {
+		if cerr := e.fd.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+
+		e.fd = nil
+	}
+
+	return err
+}
+
+type noOpLogger struct{}
+
+func (noOpLogger) Info(string, ...interface{})  {}
+func (noOpLogger) Error(string, ...interface{}) {}
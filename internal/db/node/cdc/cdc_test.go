@@ -0,0 +1,126 @@
+package cdc_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"emag-homework/internal/db/node/cdc"
+	"emag-homework/internal/db/store"
+	"emag-homework/pkg/test/require"
+)
+
+func TestExporter_Export(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+	dir := filename + ".cdc"
+
+	s, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	defer s.Clean()
+	defer os.RemoveAll(dir)
+
+	opts := []cdc.Option{cdc.WithPollInterval(time.Hour), cdc.WithMaxFileSize(200)}
+
+	exporter, err := cdc.New(s, dir, opts...)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Put(store.Entry{Key: "a", Value: []byte("a"), Version: 1}))
+	require.NoError(t, s.Put(store.Entry{Key: "b", Value: []byte("b"), Version: 1}))
+	require.NoError(t, s.Delete("a", 2))
+
+	_, err = s.ApplyBatch(store.NewBatch().
+		Put(store.Entry{Key: "c", Value: []byte("c"), Version: 3}).
+		Put(store.Entry{Key: "d", Value: []byte("d"), Version: 3}))
+	require.NoError(t, err)
+
+	count, err := exporter.Export()
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+
+	require.NoError(t, exporter.Close())
+	require.NoError(t, s.Put(store.Entry{Key: "e", Value: []byte("e"), Version: 4}))
+
+	// resumes from the checkpoint
+	exporter, err = cdc.New(s, dir, opts...)
+	require.NoError(t, err)
+
+	count, err = exporter.Export()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.NoError(t, exporter.Close())
+
+	// a file started after the checkpoint, left by a crash while rotating
+	orphan := dir + "/changes-99999999999999999999.ndjson"
+	require.NoError(t, os.WriteFile(orphan, []byte(`{"seq":7,"op":"put","key":"e"}`+"\n"), 0o644))
+
+	exporter, err = cdc.New(s, dir, opts...)
+	require.NoError(t, err)
+	require.NoError(t, exporter.Close())
+
+	_, err = os.Stat(orphan)
+	require.True(t, os.IsNotExist(err), "orphan removed")
+
+	files, err := cdc.Files(dir)
+	require.NoError(t, err)
+	require.True(t, len(files) > 1, "rotated")
+
+	var events []cdc.Event
+
+	for _, file := range files {
+		events = append(events, readEvents(t, file)...)
+	}
+
+	require.Equal(t, 6, len(events))
+
+	var ops, keys, values string
+
+	for i, ev := range events {
+		ops += ev.Op + " "
+		keys += ev.Key
+		values += string(ev.Value)
+
+		require.True(t, ev.Timestamp != "", "timestamp")
+
+		if i > 0 {
+			require.True(t, ev.Seq >= events[i-1].Seq, "ordered")
+		}
+	}
+
+	require.Equal(t, "put put delete put put put ", ops)
+	require.Equal(t, "abacde", keys)
+	require.Equal(t, "abcde", values)
+}
+
+func readEvents(t *testing.T, file string) []cdc.Event {
+	t.Helper()
+
+	fd, err := os.Open(file)
+	require.NoError(t, err, file)
+
+	defer fd.Close()
+
+	var events []cdc.Event
+
+	scanner := bufio.NewScanner(fd)
+
+	for scanner.Scan() {
+		var ev cdc.Event
+
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &ev), scanner.Text())
+
+		events = append(events, ev)
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return events
+}
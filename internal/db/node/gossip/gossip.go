@@ -0,0 +1,322 @@
+// Package gossip is a SWIM membership protocol between the nodes. Every probe
+// interval a node pings another one, asks a few others to ping it on its
+// behalf when it does not answer, and suspects it when none of them could.
+// A suspected node refutes the suspicion by raising its incarnation, else it
+// is declared dead after the suspicion timeout. The membership changes are
+// piggybacked on the pings, so they spread to every node in a few intervals.
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultProbeInterval    = time.Second
+	defaultProbeTimeout     = time.Millisecond * 300
+	defaultIndirectChecks   = 3
+	defaultSuspicionTimeout = time.Second * 5
+	defaultDeadRetention    = time.Minute
+
+	// maxPiggyback is how many membership changes a message carries at most.
+	maxPiggyback = 8
+	// retransmitMult scales how many times a change is sent, times the log of
+	// the cluster size.
+	retransmitMult = 3
+)
+
+type State = v1.Member_State
+
+const (
+	Alive   = v1.Member_STATE_ALIVE
+	Suspect = v1.Member_STATE_SUSPECT
+	Dead    = v1.Member_STATE_DEAD
+)
+
+// Member is a node as seen by the local one.
+type Member struct {
+	ID          string
+	Address     string
+	State       State
+	Incarnation uint64
+}
+
+type Logger interface {
+	Info(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+type Config struct {
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	IndirectChecks   int
+	SuspicionTimeout time.Duration
+	DeadRetention    time.Duration
+	Logger           Logger
+}
+
+type Option func(cfg *Config)
+
+// WithProbeInterval sets how often a member is pinged.
+func WithProbeInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ProbeInterval = interval
+	}
+}
+
+// WithProbeTimeout sets how long a ping waits for the answer, the indirect
+// pings waiting twice as long.
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ProbeTimeout = timeout
+	}
+}
+
+// WithIndirectChecks sets how many members are asked to ping a member not
+// answering.
+func WithIndirectChecks(n int) Option {
+	return func(cfg *Config) {
+		cfg.IndirectChecks = n
+	}
+}
+
+// WithSuspicionTimeout sets how long a suspected member has to refute the
+// suspicion before being declared dead.
+func WithSuspicionTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.SuspicionTimeout = timeout
+	}
+}
+
+// WithDeadRetention sets how long a dead member is remembered before being
+// forgotten. It must outlast the spreading of its death, else a late rumour of
+// the member being alive brings it back.
+func WithDeadRetention(retention time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.DeadRetention = retention
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(cfg *Config) {
+		cfg.Logger = logger
+	}
+}
+
+type member struct {
+	Member
+	suspectedAt time.Time
+	diedAt      time.Time
+}
+
+// update is a membership change to piggyback, along with how many times it
+// was sent.
+type update struct {
+	member Member
+	sent   int
+}
+
+// Gossip is the membership protocol of a node, the other nodes reaching it
+// through its Server.
+type Gossip struct {
+	mu               sync.Mutex
+	self             Member
+	members          map[string]*member
+	updates          map[string]*update
+	probes           []string
+	conns            map[string]*grpc.ClientConn
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	indirectChecks   int
+	suspicionTimeout time.Duration
+	deadRetention    time.Duration
+	logger           Logger
+	doneCh           chan struct{}
+	closed           bool
+}
+
+// New creates the membership protocol of the node with the id, served at the
+// address. The node knows no other until it joins them.
+func New(id, address string, opts ...Option) *Gossip {
+	cfg := &Config{
+		ProbeInterval:    defaultProbeInterval,
+		ProbeTimeout:     defaultProbeTimeout,
+		IndirectChecks:   defaultIndirectChecks,
+		SuspicionTimeout: defaultSuspicionTimeout,
+		DeadRetention:    defaultDeadRetention,
+		Logger:           noOpLogger{},
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &Gossip{
+		self:             Member{ID: id, Address: address, State: Alive},
+		members:          make(map[string]*member),
+		updates:          make(map[string]*update),
+		conns:            make(map[string]*grpc.ClientConn),
+		probeInterval:    cfg.ProbeInterval,
+		probeTimeout:     cfg.ProbeTimeout,
+		indirectChecks:   cfg.IndirectChecks,
+		suspicionTimeout: cfg.SuspicionTimeout,
+		deadRetention:    cfg.DeadRetention,
+		logger:           cfg.Logger,
+		doneCh:           make(chan struct{}),
+	}
+}
+
+// Join announces the node to the members at the addresses and learns their
+// membership. It succeeds when one of them answered.
+func (g *Gossip) Join(ctx context.Context, addrs ...string) error {
+	var joined int
+	var lastErr error
+
+	for _, addr := range addrs {
+		client, err := g.client(addr)
+		if err != nil {
+			lastErr = err
+
+			continue
+		}
+
+		res, err := client.Join(ctx, &v1.JoinRequest{Member: toMember(g.Self())})
+		if err != nil {
+			lastErr = fmt.Errorf("failed joining %s: %w", addr, err)
+
+			continue
+		}
+
+		g.merge(res.Members)
+		joined++
+	}
+
+	if joined == 0 && lastErr != nil {
+		return lastErr
+	}
+
+	return nil
+}
+
+// Start probes the members until closed.
+func (g *Gossip) Start() {
+	t := time.NewTicker(g.probeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-g.doneCh:
+			return
+		case <-t.C:
+		}
+
+		g.expireSuspects()
+		g.forgetDead()
+
+		if target, ok := g.nextProbe(); ok {
+			g.probe(target)
+		}
+	}
+}
+
+// Self returns the node as the others see it.
+func (g *Gossip) Self() Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.self
+}
+
+// Members returns the membership known to the node, itself included, sorted
+// by id.
+func (g *Gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	members := make([]Member, 0, len(g.members)+1)
+	members = append(members, g.self)
+
+	for _, m := range g.members {
+		members = append(members, m.Member)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+
+	return members
+}
+
+func (g *Gossip) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return nil
+	}
+
+	g.closed = true
+	close(g.doneCh)
+
+	for addr, conn := range g.conns {
+		_ = conn.Close()
+		delete(g.conns, addr)
+	}
+
+	return nil
+}
+
+var _ v1.GossipServer = (*Server)(nil)
+
+// Server serves the Gossip service of the node to the others.
+type Server struct {
+	gossip *Gossip
+}
+
+func NewServer(g *Gossip) *Server {
+	return &Server{gossip: g}
+}
+
+func (s *Server) Join(_ context.Context, req *v1.JoinRequest) (*v1.JoinResponse, error) {
+	if req.Member == nil || req.Member.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "member is required")
+	}
+
+	s.gossip.merge([]*v1.Member{req.Member})
+
+	return &v1.JoinResponse{Members: toMembers(s.gossip.Members())}, nil
+}
+
+func (s *Server) Ping(_ context.Context, req *v1.PingRequest) (*v1.PingResponse, error) {
+	s.gossip.merge(req.Updates)
+
+	return &v1.PingResponse{Updates: s.gossip.piggyback()}, nil
+}
+
+func (s *Server) PingReq(ctx context.Context, req *v1.PingReqRequest) (*v1.PingResponse, error) {
+	s.gossip.merge(req.Updates)
+
+	target, ok := s.gossip.member(req.Target)
+	if !ok {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("member %s not found", req.Target))
+	}
+
+	if err := s.gossip.ping(ctx, target.Address); err != nil {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("member %s did not answer: %v", req.Target, err))
+	}
+
+	return &v1.PingResponse{Updates: s.gossip.piggyback()}, nil
+}
+
+func (s *Server) Members(context.Context, *v1.MembersRequest) (*v1.MembersResponse, error) {
+	return &v1.MembersResponse{Members: toMembers(s.gossip.Members())}, nil
+}
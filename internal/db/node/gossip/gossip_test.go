@@ -0,0 +1,160 @@
+package gossip_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	v1 "emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/node/gossip"
+	"emag-homework/pkg/test/require"
+
+	"google.golang.org/grpc"
+)
+
+type testNode struct {
+	gossip *gossip.Gossip
+	srv    *grpc.Server
+}
+
+func (n *testNode) stop() {
+	n.srv.Stop()
+	_ = n.gossip.Close()
+}
+
+func TestGossip(t *testing.T) {
+	t.Parallel()
+
+	nodes := make([]*testNode, 0, 4)
+
+	for i := 0; i < 4; i++ {
+		n := startNode(t, fmt.Sprintf("node-%d", i))
+		defer n.stop()
+
+		nodes = append(nodes, n)
+	}
+
+	ctx := context.Background()
+
+	// every node knows a single seed, the others are learnt from the gossip
+	for _, n := range nodes[1:] {
+		require.NoError(t, n.gossip.Join(ctx, nodes[0].gossip.Self().Address))
+	}
+
+	waitStates(t, nodes, map[string]gossip.State{
+		"node-0": gossip.Alive,
+		"node-1": gossip.Alive,
+		"node-2": gossip.Alive,
+		"node-3": gossip.Alive,
+	})
+
+	// a failed node is suspected, then declared dead everywhere
+	nodes[3].stop()
+
+	waitStates(t, nodes[:3], map[string]gossip.State{
+		"node-0": gossip.Alive,
+		"node-1": gossip.Alive,
+		"node-2": gossip.Alive,
+		"node-3": gossip.Dead,
+	})
+
+	// then forgotten
+	waitStates(t, nodes[:3], map[string]gossip.State{
+		"node-0": gossip.Alive,
+		"node-1": gossip.Alive,
+		"node-2": gossip.Alive,
+	})
+}
+
+func TestGossip_Refute(t *testing.T) {
+	t.Parallel()
+
+	n := startNode(t, "node-0")
+	defer n.stop()
+
+	cc, err := grpc.Dial(n.gossip.Self().Address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+
+	self := n.gossip.Self()
+
+	res, err := v1.NewGossipClient(cc).Ping(context.Background(), &v1.PingRequest{
+		From: "node-1",
+		Updates: []*v1.Member{
+			{Id: self.ID, Address: self.Address, State: v1.Member_STATE_SUSPECT, Incarnation: self.Incarnation},
+			{Id: "node-1", Address: "127.0.0.1:1", State: v1.Member_STATE_ALIVE},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, self.Incarnation+1, n.gossip.Self().Incarnation, "incarnation")
+	require.Equal(t, 2, len(n.gossip.Members()), "members")
+
+	var refuted bool
+
+	for _, u := range res.Updates {
+		if u.Id == self.ID && u.State == v1.Member_STATE_ALIVE && u.Incarnation == self.Incarnation+1 {
+			refuted = true
+		}
+	}
+
+	require.True(t, refuted, "refutation piggybacked")
+}
+
+func startNode(t *testing.T, id string) *testNode {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	g := gossip.New(id, lis.Addr().String(),
+		gossip.WithProbeInterval(time.Millisecond*20),
+		gossip.WithProbeTimeout(time.Millisecond*50),
+		gossip.WithSuspicionTimeout(time.Millisecond*200),
+		gossip.WithDeadRetention(time.Second),
+	)
+
+	srv := grpc.NewServer()
+	v1.RegisterGossipServer(srv, gossip.NewServer(g))
+
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+
+	go g.Start()
+
+	return &testNode{gossip: g, srv: srv}
+}
+
+// waitStates waits until every node sees the members in the states.
+func waitStates(t *testing.T, nodes []*testNode, want map[string]gossip.State) {
+	t.Helper()
+
+	var got map[string]gossip.State
+
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		done := true
+
+		for _, n := range nodes {
+			got = make(map[string]gossip.State)
+
+			for _, m := range n.gossip.Members() {
+				got[m.ID] = m.State
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				done = false
+
+				break
+			}
+		}
+
+		if done {
+			return
+		}
+	}
+
+	require.Equal(t, want, got)
+}
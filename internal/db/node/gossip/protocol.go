@@ -0,0 +1,350 @@
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+
+	"google.golang.org/grpc"
+)
+
+// probe pings the target, then has other members ping it, and suspects it
+// when none of them could reach it.
+func (g *Gossip) probe(target Member) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.probeTimeout)
+	err := g.ping(ctx, target.Address)
+	cancel()
+
+	if err == nil {
+		return
+	}
+
+	helpers := g.helpers(target.ID)
+
+	ctx, cancel = context.WithTimeout(context.Background(), g.probeTimeout*2)
+	defer cancel()
+
+	ackCh := make(chan bool, len(helpers))
+
+	for _, h := range helpers {
+		go func(h Member) {
+			ackCh <- g.pingReq(ctx, h.Address, target.ID) == nil
+		}(h)
+	}
+
+	for range helpers {
+		if <-ackCh {
+			return
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if m, ok := g.members[target.ID]; ok && m.State == Alive {
+		g.apply(Member{ID: m.ID, Address: m.Address, State: Suspect, Incarnation: m.Incarnation})
+	}
+}
+
+func (g *Gossip) ping(ctx context.Context, addr string) error {
+	client, err := g.client(addr)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Ping(ctx, &v1.PingRequest{From: g.Self().ID, Updates: g.piggyback()})
+	if err != nil {
+		return err
+	}
+
+	g.merge(res.Updates)
+
+	return nil
+}
+
+func (g *Gossip) pingReq(ctx context.Context, addr, target string) error {
+	client, err := g.client(addr)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.PingReq(ctx, &v1.PingReqRequest{From: g.Self().ID, Target: target, Updates: g.piggyback()})
+	if err != nil {
+		return err
+	}
+
+	g.merge(res.Updates)
+
+	return nil
+}
+
+// nextProbe returns the next member to probe. The members are probed in a
+// random order, each once per round.
+func (g *Gossip) nextProbe() (Member, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for round := 0; round < 2; round++ {
+		for len(g.probes) > 0 {
+			id := g.probes[0]
+			g.probes = g.probes[1:]
+
+			if m, ok := g.members[id]; ok && m.State != Dead {
+				return m.Member, true
+			}
+		}
+
+		for id, m := range g.members {
+			if m.State != Dead {
+				g.probes = append(g.probes, id)
+			}
+		}
+
+		rand.Shuffle(len(g.probes), func(i, j int) {
+			g.probes[i], g.probes[j] = g.probes[j], g.probes[i]
+		})
+	}
+
+	return Member{}, false
+}
+
+// helpers returns up to indirectChecks random alive members other than the
+// target.
+func (g *Gossip) helpers(target string) []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	helpers := make([]Member, 0, len(g.members))
+
+	for id, m := range g.members {
+		if id != target && m.State == Alive {
+			helpers = append(helpers, m.Member)
+		}
+	}
+
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+
+	if len(helpers) > g.indirectChecks {
+		helpers = helpers[:g.indirectChecks]
+	}
+
+	return helpers
+}
+
+// expireSuspects declares dead the members that did not refute the suspicion
+// in time.
+func (g *Gossip) expireSuspects() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, m := range g.members {
+		if m.State == Suspect && time.Since(m.suspectedAt) >= g.suspicionTimeout {
+			g.apply(Member{ID: m.ID, Address: m.Address, State: Dead, Incarnation: m.Incarnation})
+		}
+	}
+}
+
+// forgetDead removes the members dead for longer than the retention, along
+// with their connection.
+func (g *Gossip) forgetDead() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for id, m := range g.members {
+		if m.State != Dead || time.Since(m.diedAt) < g.deadRetention {
+			continue
+		}
+
+		delete(g.members, id)
+		delete(g.updates, id)
+
+		if conn, ok := g.conns[m.Address]; ok {
+			_ = conn.Close()
+			delete(g.conns, m.Address)
+		}
+
+		g.logger.Info("gossip: forgot dead member %s at %s", m.ID, m.Address)
+	}
+}
+
+func (g *Gossip) member(id string) (Member, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	m, ok := g.members[id]
+	if !ok {
+		return Member{}, false
+	}
+
+	return m.Member, true
+}
+
+func (g *Gossip) merge(updates []*v1.Member) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, u := range updates {
+		g.apply(fromMember(u))
+	}
+}
+
+// apply applies the membership change if it overrides what the node knows,
+// and spreads it further. The node must be locked.
+func (g *Gossip) apply(u Member) {
+	if u.ID == "" {
+		return
+	}
+
+	// the node refutes being suspected or declared dead
+	if u.ID == g.self.ID {
+		if u.State != Alive && u.Incarnation >= g.self.Incarnation {
+			g.self.Incarnation = u.Incarnation + 1
+			g.enqueue(g.self)
+
+			g.logger.Info("gossip: refuting %s at incarnation %d", stateName(u.State), g.self.Incarnation)
+		}
+
+		return
+	}
+
+	m, ok := g.members[u.ID]
+	if ok && !overrides(u, m.Member) {
+		return
+	}
+
+	if !ok {
+		m = &member{}
+		g.members[u.ID] = m
+	}
+
+	if u.State == Suspect && m.State != Suspect {
+		m.suspectedAt = time.Now()
+	}
+
+	if u.State == Dead && m.State != Dead {
+		m.diedAt = time.Now()
+	}
+
+	if !ok || m.State != u.State {
+		g.logger.Info("gossip: member %s at %s is %s", u.ID, u.Address, stateName(u.State))
+	}
+
+	m.Member = u
+	g.enqueue(u)
+}
+
+// overrides tells whether the change is newer than what is known of the
+// member: a higher incarnation, or a worse state at the same one.
+func overrides(u, known Member) bool {
+	switch {
+	case u.Incarnation > known.Incarnation:
+		return true
+	case u.Incarnation < known.Incarnation:
+		return false
+	default:
+		return u.State > known.State
+	}
+}
+
+func (g *Gossip) enqueue(m Member) {
+	g.updates[m.ID] = &update{member: m}
+}
+
+// piggyback returns the changes to send along with a message, the least sent
+// first. A change is sent a number of times growing with the log of the
+// cluster size, enough to reach every member.
+func (g *Gossip) piggyback() []*v1.Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	updates := make([]*update, 0, len(g.updates))
+
+	for _, u := range g.updates {
+		updates = append(updates, u)
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].sent < updates[j].sent
+	})
+
+	if len(updates) > maxPiggyback {
+		updates = updates[:maxPiggyback]
+	}
+
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(g.members)+2))))
+	members := make([]*v1.Member, 0, len(updates))
+
+	for _, u := range updates {
+		members = append(members, toMember(u.member))
+
+		if u.sent++; u.sent >= limit {
+			delete(g.updates, u.member.ID)
+		}
+	}
+
+	return members
+}
+
+func (g *Gossip) client(addr string) (v1.GossipClient, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return nil, fmt.Errorf("gossip is closed")
+	}
+
+	conn, ok := g.conns[addr]
+	if !ok {
+		var err error
+
+		conn, err = grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to member %s: %w", addr, err)
+		}
+
+		g.conns[addr] = conn
+	}
+
+	return v1.NewGossipClient(conn), nil
+}
+
+func stateName(s State) string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+func toMember(m Member) *v1.Member {
+	return &v1.Member{Id: m.ID, Address: m.Address, State: m.State, Incarnation: m.Incarnation}
+}
+
+func toMembers(members []Member) []*v1.Member {
+	out := make([]*v1.Member, 0, len(members))
+
+	for _, m := range members {
+		out = append(out, toMember(m))
+	}
+
+	return out
+}
+
+func fromMember(m *v1.Member) Member {
+	return Member{ID: m.Id, Address: m.Address, State: m.State, Incarnation: m.Incarnation}
+}
+
+type noOpLogger struct{}
+
+func (noOpLogger) Info(string, ...interface{})  {}
+func (noOpLogger) Error(string, ...interface{}) {}
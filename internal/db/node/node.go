@@ -1,6 +1,11 @@
 package node
 
-import "emag-homework/internal/db/store"
+import (
+	"emag-homework/internal/db/keyspace"
+	"emag-homework/internal/db/merkle"
+	"emag-homework/internal/db/store"
+	"emag-homework/internal/db/vclock"
+)
 
 type Logger interface {
 	Info(format string, v ...interface{})
@@ -9,5 +14,25 @@ type Logger interface {
 
 type Store interface {
 	Get(k string) *store.Entry
+	Lookup(k string) *store.Entry
 	Put(e store.Entry) error
+	CompareAndSwap(e store.Entry, expected int64) error
+	ApplyBatch(b *store.Batch) ([]store.Entry, error)
+	Prepare(intent store.Intent) error
+	CommitIntent(txnID string) error
+	AbortIntent(txnID string) error
+	Intents() []store.Intent
+	Scan(start, end, prefix string, limit int) []store.Entry
+	Watch(prefix string) (<-chan store.Entry, func())
+	MerkleHash(r keyspace.Range) merkle.Part
+	MerkleHashes(r keyspace.Range, n int) []merkle.Part
+	MerkleKeys(r keyspace.Range) []merkle.Key
+	Dump(ranges ...keyspace.Range) []store.Entry
+	Restore(entries []store.Entry) (int, error)
+	Delete(k string, version int64) error
+	Increment(k string, delta, version int64) (store.Entry, error)
+	IncrementPN(k string, delta, version int64, actor string) (store.Entry, error)
+	MergePN(k string, counter store.PNCounter, version int64) (store.Entry, error)
+	PutCausal(k string, value []byte, version int64, context vclock.VectorClock, actor string) (store.Sibling, error)
+	MergeCausal(k string, siblings ...store.Sibling) error
 }
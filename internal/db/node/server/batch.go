@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/store"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Batch applies the operations atomically and returns them as applied, the
+// increments being resolved to the counters they resulted in so they can be
+// replicated as is.
+func (s *NodeServer) Batch(_ context.Context, req *v1.BatchRequest) (*v1.BatchResponse, error) {
+	if len(req.Ops) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no operations")
+	}
+
+	if !req.Replica && req.Version == 0 {
+		return nil, status.Error(codes.InvalidArgument, "version is missing")
+	}
+
+	b := store.NewBatch()
+
+	for _, op := range req.Ops {
+		if err := s.addBatchOp(b, req, op); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := s.store.ApplyBatch(b)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	res := &v1.BatchResponse{
+		Ops: make([]*v1.BatchOp, 0, len(entries)),
+	}
+
+	for _, e := range entries {
+		res.Ops = append(res.Ops, toBatchOp(e))
+	}
+
+	return res, nil
+}
+
+func (s *NodeServer) addBatchOp(b *store.Batch, req *v1.BatchRequest, op *v1.BatchOp) error {
+	if op.Key == "" {
+		return status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	version := req.Version
+
+	if req.Replica {
+		if op.Version == 0 {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("%q: version is missing", op.Key))
+		}
+
+		version = op.Version
+	}
+
+	switch op.Type {
+	case v1.BatchOp_BATCH_OP_PUT:
+		b.Put(store.Entry{Key: op.Key, Value: op.Value, Version: version})
+	case v1.BatchOp_BATCH_OP_DELETE:
+		b.Delete(op.Key, version)
+	case v1.BatchOp_BATCH_OP_INCREMENT:
+		b.Increment(op.Key, op.Delta, version)
+	case v1.BatchOp_BATCH_OP_INCREMENT_COUNTER:
+		b.IncrementPN(op.Key, op.Delta, version, s.id)
+	case v1.BatchOp_BATCH_OP_COUNTER:
+		if !req.Replica {
+			return status.Error(codes.InvalidArgument, "counter operations are only replicated")
+		}
+
+		b.Put(store.Entry{Key: op.Key, Version: version, Kind: store.CounterKind, Counter: op.Counter})
+	case v1.BatchOp_BATCH_OP_MERGE_COUNTER:
+		if !req.Replica {
+			return status.Error(codes.InvalidArgument, "counter operations are only replicated")
+		}
+
+		b.MergePN(op.Key, store.PNCounter{P: op.State.GetP(), N: op.State.GetN()}, version)
+	default:
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("unknown operation %s", op.Type))
+	}
+
+	return nil
+}
+
+func toBatchOp(e store.Entry) *v1.BatchOp {
+	op := &v1.BatchOp{
+		Key:     e.Key,
+		Version: e.Version,
+	}
+
+	switch {
+	case e.Tombstone:
+		op.Type = v1.BatchOp_BATCH_OP_DELETE
+	case e.Kind == store.CounterKind:
+		op.Type = v1.BatchOp_BATCH_OP_COUNTER
+		op.Counter = e.Counter
+	case e.Kind == store.PNCounterKind:
+		op.Type = v1.BatchOp_BATCH_OP_MERGE_COUNTER
+		op.State = &v1.PNCounter{P: e.PN.P, N: e.PN.N}
+	default:
+		op.Type = v1.BatchOp_BATCH_OP_PUT
+		op.Value = e.Value
+	}
+
+	return op
+}
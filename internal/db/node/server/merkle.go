@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/keyspace"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxMerkleParts     = 256
+	merkleKeyChunkSize = 500
+)
+
+// MerkleRoot returns the hash of the keys in the range, nil for the whole ring.
+func (s *NodeServer) MerkleRoot(_ context.Context, req *v1.MerkleRootRequest) (*v1.MerkleRootResponse, error) {
+	part := s.store.MerkleHash(toKeyRange(req.Range))
+
+	return &v1.MerkleRootResponse{Hash: part.Hash, Count: int64(part.Count)}, nil
+}
+
+// MerkleRange streams the summaries of the parts of the range, or the keys of
+// the range in chunks.
+func (s *NodeServer) MerkleRange(req *v1.MerkleRangeRequest, stream v1.Node_MerkleRangeServer) error {
+	if req.Parts < 0 || req.Parts > maxMerkleParts {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("parts must be between 0 and %d", maxMerkleParts))
+	}
+
+	r := toKeyRange(req.Range)
+
+	if req.Parts > 0 {
+		res := &v1.MerkleRangeResponse{}
+
+		for _, part := range s.store.MerkleHashes(r, int(req.Parts)) {
+			res.Parts = append(res.Parts, &v1.MerklePart{
+				Range: fromKeyRange(part.Range),
+				Hash:  part.Hash,
+				Count: int64(part.Count),
+			})
+		}
+
+		return stream.Send(res)
+	}
+
+	keys := s.store.MerkleKeys(r)
+	res := &v1.MerkleRangeResponse{}
+
+	for i, k := range keys {
+		res.Keys = append(res.Keys, &v1.MerkleKey{Key: k.Key, Digest: k.Digest})
+
+		if len(res.Keys) == merkleKeyChunkSize && i < len(keys)-1 {
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+
+			res = &v1.MerkleRangeResponse{}
+		}
+	}
+
+	return stream.Send(res)
+}
+
+func toKeyRange(r *v1.KeyRange) keyspace.Range {
+	if r == nil {
+		return keyspace.Full
+	}
+
+	return keyspace.Range{Start: r.Start, End: r.End}
+}
+
+func fromKeyRange(r keyspace.Range) *v1.KeyRange {
+	return &v1.KeyRange{Start: r.Start, End: r.End}
+}
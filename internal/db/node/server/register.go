@@ -4,8 +4,11 @@ import (
 	"context"
 	v1 "emag-homework/internal/db/api/v1"
 	"emag-homework/internal/db/node"
+	"emag-homework/pkg/fileutil"
 	"fmt"
 	"math/rand"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -15,6 +18,30 @@ func GenerateID() string {
 	return fmt.Sprint(rnd.Int63())
 }
 
+// LoadID returns the id kept in the file, generating and keeping one the first
+// time. A node restarted with its data keeps its id, so the controllers find
+// it where it was on the ring.
+func LoadID(filename string) (string, error) {
+	b, err := os.ReadFile(filename)
+	if err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id, nil
+		}
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed reading node id %q: %w", filename, err)
+	}
+
+	id := GenerateID()
+
+	if err := fileutil.WriteFile(filename, []byte(id+"\n")); err != nil {
+		return "", fmt.Errorf("failed saving node id: %w", err)
+	}
+
+	return id, nil
+}
+
 type NodeInfo struct {
 	ID      string
 	Address string
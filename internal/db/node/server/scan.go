@@ -0,0 +1,65 @@
+package server
+
+import (
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/store"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+	scanChunkSize    = 100
+)
+
+// Scan streams a page of the keys of the store in key order, tombstones
+// included so the controller can merge the replicas. The page is sent in
+// chunks; the last one has the token to resume the scan from, if any.
+func (s *NodeServer) Scan(req *v1.ScanRequest, stream v1.Node_ScanServer) error {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	start := req.Start
+	if req.PageToken != "" && store.After(req.PageToken) > start {
+		start = store.After(req.PageToken)
+	}
+
+	// one more entry tells whether there is a next page
+	entries := s.store.Scan(start, req.End, req.Prefix, limit+1)
+
+	var next string
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+		next = entries[limit-1].Key
+	}
+
+	res := &v1.ScanResponse{}
+
+	for i, e := range entries {
+		res.Items = append(res.Items, &v1.ScanItem{
+			Key:       e.Key,
+			Value:     e.Value,
+			Version:   e.Version,
+			Tombstone: e.Tombstone,
+			Counter:   e.Kind == store.CounterKind,
+		})
+
+		if len(res.Items) == scanChunkSize && i < len(entries)-1 {
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+
+			res = &v1.ScanResponse{}
+		}
+	}
+
+	res.NextPageToken = next
+
+	return stream.Send(res)
+}
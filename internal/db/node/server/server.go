@@ -5,6 +5,8 @@ import (
 	"emag-homework/internal/db/api/v1"
 	"emag-homework/internal/db/node"
 	"emag-homework/internal/db/store"
+	"emag-homework/internal/db/vclock"
+	"errors"
 	"fmt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -33,16 +35,68 @@ func (s *NodeServer) Put(_ context.Context, req *v1.PutRequest) (*v1.PutResponse
 		return nil, status.Error(codes.InvalidArgument, "version is missing")
 	}
 
-	err := s.store.Put(store.Entry{
-		Key:     req.Key,
-		Value:   req.Value,
-		Version: req.Version,
-	})
+	if req.Causal {
+		if req.Cas {
+			return nil, status.Error(codes.InvalidArgument, "compare-and-swap is not supported in causal mode")
+		}
+
+		return s.putCausal(req)
+	}
+
+	entry := store.Entry{
+		Key:       req.Key,
+		Value:     req.Value,
+		Version:   req.Version,
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	var err error
+
+	if req.Cas {
+		err = s.store.CompareAndSwap(entry, req.ExpectedVersion)
+	} else {
+		err = s.store.Put(entry)
+	}
+
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, storeError(err)
 	}
 
-	return &v1.PutResponse{}, nil
+	return &v1.PutResponse{Version: req.Version}, nil
+}
+
+// putCausal coordinates a causal write, or stores a value another node
+// coordinated when the request carries its clock.
+func (s *NodeServer) putCausal(req *v1.PutRequest) (*v1.PutResponse, error) {
+	if len(req.Clock) > 0 {
+		clock, err := vclock.DecodeDotted(req.Clock)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		err = s.store.MergeCausal(req.Key, store.Sibling{
+			Value:   req.Value,
+			Version: req.Version,
+			Clock:   clock,
+		})
+		if err != nil {
+			return nil, storeError(err)
+		}
+
+		return &v1.PutResponse{Clock: req.Clock}, nil
+	}
+
+	context, err := vclock.Decode(req.Context)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sib, err := s.store.PutCausal(req.Key, req.Value, req.Version, context, s.id)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	return &v1.PutResponse{Clock: sib.Clock.Encode()}, nil
 }
 
 func (s *NodeServer) Get(_ context.Context, req *v1.GetRequest) (*v1.GetResponse, error) {
@@ -50,14 +104,138 @@ func (s *NodeServer) Get(_ context.Context, req *v1.GetRequest) (*v1.GetResponse
 		return nil, status.Error(codes.InvalidArgument, "key is missing")
 	}
 
+	entry := s.store.Lookup(req.Key)
+	if entry == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("%q not found", req.Key))
+	}
+
+	res := &v1.GetResponse{
+		Value:     entry.Value,
+		Version:   entry.Version,
+		Tombstone: entry.Tombstone,
+		Context:   entry.Clock.Encode(),
+		Counter:   entry.Kind == store.CounterKind,
+		PnCounter: entry.Kind == store.PNCounterKind,
+		ExpiresAt: entry.ExpiresAt,
+	}
+
+	for _, sib := range entry.Siblings {
+		res.Siblings = append(res.Siblings, &v1.Sibling{
+			Value:   sib.Value,
+			Version: sib.Version,
+			Clock:   sib.Clock.Encode(),
+		})
+	}
+
+	return res, nil
+}
+
+func (s *NodeServer) Delete(_ context.Context, req *v1.DeleteRequest) (*v1.DeleteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	if req.Version == 0 {
+		return nil, status.Error(codes.InvalidArgument, "version is missing")
+	}
+
+	if err := s.store.Delete(req.Key, req.Version); err != nil {
+		return nil, storeError(err)
+	}
+
+	return &v1.DeleteResponse{}, nil
+}
+
+// Increment adds the delta to the counter of the key, or stores the counter
+// value another node computed when the request is a replica.
+func (s *NodeServer) Increment(_ context.Context, req *v1.IncrementRequest) (*v1.IncrementResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	if req.Version == 0 {
+		return nil, status.Error(codes.InvalidArgument, "version is missing")
+	}
+
+	if req.Replica {
+		err := s.store.Put(store.Entry{
+			Key:     req.Key,
+			Version: req.Version,
+			Kind:    store.CounterKind,
+			Counter: req.Value,
+		})
+		if err != nil {
+			return nil, storeError(err)
+		}
+
+		return &v1.IncrementResponse{Value: req.Value, Version: req.Version}, nil
+	}
+
+	entry, err := s.store.Increment(req.Key, req.Delta, req.Version)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	return &v1.IncrementResponse{Value: entry.Counter, Version: entry.Version}, nil
+}
+
+// IncrementCounter adds the delta to this node's slots of the PN-counter of
+// the key, or merges the counter of another node when the request has one.
+func (s *NodeServer) IncrementCounter(
+	_ context.Context, req *v1.IncrementCounterRequest,
+) (*v1.IncrementCounterResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
+	if req.Version == 0 {
+		return nil, status.Error(codes.InvalidArgument, "version is missing")
+	}
+
+	var entry store.Entry
+	var err error
+
+	if req.State != nil {
+		entry, err = s.store.MergePN(req.Key, store.PNCounter{P: req.State.P, N: req.State.N}, req.Version)
+	} else {
+		entry, err = s.store.IncrementPN(req.Key, req.Delta, req.Version, s.id)
+	}
+
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	counter, err := entry.ToPNCounter()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &v1.IncrementCounterResponse{
+		Value:   counter.Value(),
+		Version: entry.Version,
+		State:   &v1.PNCounter{P: counter.P, N: counter.N},
+	}, nil
+}
+
+func (s *NodeServer) GetCounter(_ context.Context, req *v1.GetCounterRequest) (*v1.GetCounterResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+
 	entry := s.store.Get(req.Key)
 	if entry == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("%q not found", req.Key))
 	}
 
-	return &v1.GetResponse{
-		Value:   entry.Value,
+	counter, err := entry.ToPNCounter()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	return &v1.GetCounterResponse{
+		Value:   counter.Value(),
 		Version: entry.Version,
+		State:   &v1.PNCounter{P: counter.P, N: counter.N},
 	}, nil
 }
 
@@ -67,3 +245,17 @@ func (s *NodeServer) Healthz(_ context.Context, _ *v1.HealthzRequest) (*v1.Healt
 		Id:   s.id,
 	}, nil
 }
+
+// storeError maps the store errors to the status codes the controller expects:
+// FailedPrecondition for the requests that can never succeed as they are, and
+// Aborted for the writes superseded by a newer version.
+func storeError(err error) error {
+	switch {
+	case errors.Is(err, store.ErrVersionMismatch), errors.Is(err, store.ErrNotCounter), errors.Is(err, store.ErrLocked):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, store.ErrStaleVersion):
+		return status.Error(codes.Aborted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"path/filepath"
 	"testing"
 
 	v1 "emag-homework/internal/db/api/v1"
@@ -15,6 +16,8 @@ import (
 	"emag-homework/pkg/test/require"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestNodeServer_Put(t *testing.T) {
@@ -92,6 +95,116 @@ func TestNodeServer_Put(t *testing.T) {
 	}
 }
 
+func TestNodeServer_Delete(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := store.New()
+	require.NoError(t, err)
+
+	srv := server.NewNodeServer(s, "100")
+	client, tearDown := setupTest(t, srv, log.NewNopLogger())
+	defer tearDown()
+
+	_, err = client.Put(ctx, &v1.PutRequest{Key: "key-1", Value: []byte("1"), Version: 1})
+	require.NoError(t, err)
+
+	_, err = client.Delete(ctx, &v1.DeleteRequest{Key: "key-1", Version: 2})
+	require.NoError(t, err)
+
+	_, err = client.Put(ctx, &v1.PutRequest{Key: "key-1", Value: []byte("2"), Version: 1})
+	require.Equal(t, codes.Aborted, status.Code(err), "older put")
+
+	got, err := client.Get(ctx, &v1.GetRequest{Key: "key-1"})
+	require.NoError(t, err)
+	require.True(t, got.Tombstone, "tombstone")
+	require.Equal(t, int64(2), got.Version, "version")
+
+	// a key locked by a transaction is refused, not failed
+	require.NoError(t, s.Prepare(store.Intent{
+		TxnID: "txn-1", Version: 3, Writes: []store.Entry{{Key: "key-1", Value: []byte("3")}},
+	}))
+
+	_, err = client.Delete(ctx, &v1.DeleteRequest{Key: "key-1", Version: 4})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "locked delete")
+}
+
+func TestLoadID(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "store.id")
+
+	id, err := server.LoadID(filename)
+	require.NoError(t, err)
+	require.True(t, id != "", "generated")
+
+	again, err := server.LoadID(filename)
+	require.NoError(t, err)
+	require.Equal(t, id, again, "kept")
+}
+
+func TestNodeServer_Snapshot(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	src, err := store.New()
+	require.NoError(t, err)
+
+	dst, err := store.New()
+	require.NoError(t, err)
+
+	srcClient, tearDown := setupTest(t, server.NewNodeServer(src, "100"), log.NewNopLogger())
+	defer tearDown()
+
+	dstClient, tearDown := setupTest(t, server.NewNodeServer(dst, "200"), log.NewNopLogger())
+	defer tearDown()
+
+	for i := 0; i < 1200; i++ {
+		require.NoError(t, src.Put(store.Entry{Key: fmt.Sprintf("key-%d", i), Value: []byte("foo"), Version: 1}))
+	}
+
+	require.NoError(t, src.Delete("key-0", 2))
+
+	_, err = src.IncrementPN("counter", 5, 3, "100")
+	require.NoError(t, err)
+
+	_, err = dst.IncrementPN("counter", 2, 1, "200")
+	require.NoError(t, err)
+
+	snapshot, err := srcClient.Snapshot(ctx, &v1.SnapshotRequest{})
+	require.NoError(t, err)
+
+	restore, err := dstClient.Restore(ctx)
+	require.NoError(t, err)
+
+	var chunks int
+
+	for {
+		res, err := snapshot.Recv()
+		if err != nil {
+			break
+		}
+
+		chunks++
+
+		require.NoError(t, restore.Send(&v1.RestoreRequest{Entries: res.Entries}))
+	}
+
+	res, err := restore.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, 3, chunks, "chunks")
+	require.Equal(t, int64(1201), res.Restored, "restored")
+
+	require.Equal(t, 1200, len(dst.Keys()), "keys")
+	require.True(t, dst.Lookup("key-0").Tombstone, "tombstone")
+
+	counter, err := dst.Get("counter").ToPNCounter()
+	require.NoError(t, err)
+	require.Equal(t, int64(7), counter.Value(), "merged counter")
+}
+
 func setupTest(t *testing.T, srv v1.NodeServer, logger node.Logger) (client v1.NodeClient, tearDown func()) {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
@@ -102,7 +215,7 @@ func setupTest(t *testing.T, srv v1.NodeServer, logger node.Logger) (client v1.N
 	addr := lis.Addr().String()
 
 	go func() {
-		err := bootstrap.StartNodeGRPCServer(ctx, lis, srv, logger)
+		err := bootstrap.StartNodeGRPCServer(ctx, lis, srv, nil, logger)
 		require.NoError(t, err)
 	}()
 
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"io"
+
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/keyspace"
+	"emag-homework/internal/db/store"
+	"emag-homework/internal/db/vclock"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const snapshotChunkSize = 500
+
+// Snapshot streams a point-in-time copy of the entries of the ranges in chunks,
+// so a new replica can catch up.
+func (s *NodeServer) Snapshot(req *v1.SnapshotRequest, stream v1.Node_SnapshotServer) error {
+	ranges := make([]keyspace.Range, 0, len(req.Ranges))
+
+	for _, r := range req.Ranges {
+		ranges = append(ranges, toKeyRange(r))
+	}
+
+	entries := s.store.Dump(ranges...)
+	res := &v1.SnapshotResponse{}
+
+	for _, e := range entries {
+		res.Entries = append(res.Entries, toEntry(e))
+
+		if len(res.Entries) == snapshotChunkSize {
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+
+			res = &v1.SnapshotResponse{}
+		}
+	}
+
+	if len(res.Entries) == 0 {
+		return nil
+	}
+
+	return stream.Send(res)
+}
+
+// Restore merges the entries of a snapshot of another replica, one chunk at a
+// time.
+func (s *NodeServer) Restore(stream v1.Node_RestoreServer) error {
+	var restored int64
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&v1.RestoreResponse{Restored: restored})
+		}
+
+		if err != nil {
+			return err
+		}
+
+		entries := make([]store.Entry, 0, len(req.Entries))
+
+		for _, e := range req.Entries {
+			entry, err := fromEntry(e)
+			if err != nil {
+				return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid entry %q: %v", e.Key, err))
+			}
+
+			entries = append(entries, entry)
+		}
+
+		n, err := s.store.Restore(entries)
+		if err != nil {
+			return storeError(err)
+		}
+
+		restored += int64(n)
+	}
+}
+
+func toEntry(e store.Entry) *v1.Entry {
+	res := &v1.Entry{
+		Key:       e.Key,
+		Value:     e.Value,
+		Version:   e.Version,
+		Tombstone: e.Tombstone,
+		DeletedAt: e.DeletedAt,
+		ExpiresAt: e.ExpiresAt,
+		Kind:      int32(e.Kind),
+		Counter:   e.Counter,
+		Clock:     e.Clock.Encode(),
+	}
+
+	if e.Kind == store.PNCounterKind {
+		res.Pn = &v1.PNCounter{P: e.PN.P, N: e.PN.N}
+	}
+
+	for _, sib := range e.Siblings {
+		res.Siblings = append(res.Siblings, &v1.Sibling{
+			Value:   sib.Value,
+			Version: sib.Version,
+			Clock:   sib.Clock.Encode(),
+		})
+	}
+
+	return res
+}
+
+func fromEntry(e *v1.Entry) (store.Entry, error) {
+	entry := store.Entry{
+		Key:       e.Key,
+		Value:     e.Value,
+		Version:   e.Version,
+		Tombstone: e.Tombstone,
+		DeletedAt: e.DeletedAt,
+		ExpiresAt: e.ExpiresAt,
+		Kind:      store.Kind(e.Kind),
+		Counter:   e.Counter,
+	}
+
+	if e.Pn != nil {
+		entry.PN = store.PNCounter{P: e.Pn.P, N: e.Pn.N}
+	}
+
+	if len(e.Clock) > 0 {
+		clock, err := vclock.Decode(e.Clock)
+		if err != nil {
+			return store.Entry{}, err
+		}
+
+		entry.Clock = clock
+	}
+
+	for _, sib := range e.Siblings {
+		clock, err := vclock.DecodeDotted(sib.Clock)
+		if err != nil {
+			return store.Entry{}, err
+		}
+
+		entry.Siblings = append(entry.Siblings, store.Sibling{Value: sib.Value, Version: sib.Version, Clock: clock})
+	}
+
+	return entry, nil
+}
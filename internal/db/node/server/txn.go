@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/store"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Prepare votes on a transaction: it succeeds once the intent is persisted and
+// the keys are locked, and fails with FailedPrecondition when the transaction
+// conflicts with another one or read a version since replaced.
+func (s *NodeServer) Prepare(_ context.Context, req *v1.PrepareRequest) (*v1.PrepareResponse, error) {
+	if req.TxnId == "" {
+		return nil, status.Error(codes.InvalidArgument, "transaction id is missing")
+	}
+
+	if req.Version == 0 {
+		return nil, status.Error(codes.InvalidArgument, "version is missing")
+	}
+
+	intent := store.Intent{
+		TxnID:   req.TxnId,
+		Version: req.Version,
+		Writes:  make([]store.Entry, 0, len(req.Writes)),
+		Reads:   make(map[string]int64, len(req.Reads)),
+	}
+
+	for _, op := range req.Writes {
+		if op.Key == "" {
+			return nil, status.Error(codes.InvalidArgument, "key is missing")
+		}
+
+		switch op.Type {
+		case v1.BatchOp_BATCH_OP_PUT:
+			intent.Writes = append(intent.Writes, store.Entry{Key: op.Key, Value: op.Value})
+		case v1.BatchOp_BATCH_OP_DELETE:
+			intent.Writes = append(intent.Writes, store.Entry{Key: op.Key, Tombstone: true})
+		default:
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%q: unsupported operation %s", op.Key, op.Type))
+		}
+	}
+
+	for _, read := range req.Reads {
+		intent.Reads[read.Key] = read.Version
+	}
+
+	if err := s.store.Prepare(intent); err != nil {
+		return nil, storeError(err)
+	}
+
+	return &v1.PrepareResponse{}, nil
+}
+
+func (s *NodeServer) Commit(_ context.Context, req *v1.CommitRequest) (*v1.CommitResponse, error) {
+	if req.TxnId == "" {
+		return nil, status.Error(codes.InvalidArgument, "transaction id is missing")
+	}
+
+	if err := s.store.CommitIntent(req.TxnId); err != nil {
+		return nil, storeError(err)
+	}
+
+	return &v1.CommitResponse{}, nil
+}
+
+func (s *NodeServer) Abort(_ context.Context, req *v1.AbortRequest) (*v1.AbortResponse, error) {
+	if req.TxnId == "" {
+		return nil, status.Error(codes.InvalidArgument, "transaction id is missing")
+	}
+
+	if err := s.store.AbortIntent(req.TxnId); err != nil {
+		return nil, storeError(err)
+	}
+
+	return &v1.AbortResponse{}, nil
+}
+
+// Intents lists the prepared transactions, for the controller to resolve the
+// ones left in doubt.
+func (s *NodeServer) Intents(_ context.Context, _ *v1.IntentsRequest) (*v1.IntentsResponse, error) {
+	intents := s.store.Intents()
+	res := &v1.IntentsResponse{
+		Intents: make([]*v1.Intent, 0, len(intents)),
+	}
+
+	for _, intent := range intents {
+		res.Intents = append(res.Intents, &v1.Intent{
+			TxnId:      intent.TxnID,
+			Version:    intent.Version,
+			PreparedAt: intent.PreparedAt,
+		})
+	}
+
+	return res, nil
+}
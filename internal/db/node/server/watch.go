@@ -0,0 +1,91 @@
+package server
+
+import (
+	"emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Watch streams the changes of the keys as the store applies them. With a
+// from_version, the keys changed since are sent first at their latest version,
+// so a watch can resume where a previous one stopped.
+func (s *NodeServer) Watch(req *v1.WatchRequest, stream v1.Node_WatchServer) error {
+	if req.Key != "" && req.Prefix != "" {
+		return status.Error(codes.InvalidArgument, "either key or prefix can be set")
+	}
+
+	prefix := req.Prefix
+	if req.Key != "" {
+		prefix = req.Key
+	}
+
+	// watching before reading the keys, no change is missed in between
+	entries, unwatch := s.store.Watch(prefix)
+	defer unwatch()
+
+	sent := make(map[string]int64)
+
+	if req.FromVersion > 0 {
+		for _, e := range s.changedSince(req) {
+			if err := stream.Send(toWatchEvent(e)); err != nil {
+				return err
+			}
+
+			sent[e.Key] = e.Version
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-entries:
+			if !ok {
+				return status.Error(codes.Unavailable, "watch interrupted, resume it from the last version")
+			}
+
+			if req.Key != "" && e.Key != req.Key {
+				continue
+			}
+
+			if e.Version <= req.FromVersion || e.Version <= sent[e.Key] {
+				continue
+			}
+
+			if err := stream.Send(toWatchEvent(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *NodeServer) changedSince(req *v1.WatchRequest) []store.Entry {
+	var entries []store.Entry
+
+	if req.Key != "" {
+		if e := s.store.Lookup(req.Key); e != nil {
+			entries = append(entries, *e)
+		}
+	} else {
+		entries = s.store.Scan("", "", req.Prefix, 0)
+	}
+
+	changed := entries[:0]
+
+	for _, e := range entries {
+		if e.Version > req.FromVersion {
+			changed = append(changed, e)
+		}
+	}
+
+	return changed
+}
+
+func toWatchEvent(e store.Entry) *v1.WatchEvent {
+	if e.Tombstone {
+		return &v1.WatchEvent{Type: v1.WatchEvent_WATCH_EVENT_DELETE, Key: e.Key, Version: e.Version}
+	}
+
+	return &v1.WatchEvent{Type: v1.WatchEvent_WATCH_EVENT_PUT, Key: e.Key, Value: e.Value, Version: e.Version}
+}
@@ -0,0 +1,742 @@
+// Package raft is a small implementation of the Raft consensus algorithm, to
+// replicate the membership of the cluster between the controllers: leader
+// election, log replication and commitment. The members are fixed and the log
+// is never compacted, which is fine for a log only growing when nodes join or
+// leave.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"emag-homework/internal/db/api/v1"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultElectionTimeout   = time.Millisecond * 300
+	defaultHeartbeatInterval = time.Millisecond * 50
+
+	maxAppendEntries = 100
+)
+
+var (
+	ErrNotLeader = errors.New("not the leader")
+	ErrClosed    = errors.New("raft is closed")
+)
+
+// NotLeaderError is returned by the members asked to propose a command while
+// another member leads, or while no leader is known.
+type NotLeaderError struct {
+	LeaderID      string
+	LeaderAddress string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderID == "" {
+		return "not the leader, no leader elected"
+	}
+
+	return fmt.Sprintf("not the leader, leader is %s at %s", e.LeaderID, e.LeaderAddress)
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+// Entry is a command of the log, along with the term it was proposed in.
+type Entry struct {
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+// FSM is the state machine the committed commands are applied to, in the
+// same order on every member.
+type FSM interface {
+	Apply(cmd []byte) interface{}
+}
+
+// Peer is a member of the cluster, the address being the one its Raft
+// service is served at.
+type Peer struct {
+	ID      string
+	Address string
+}
+
+type Logger interface {
+	Info(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+type Config struct {
+	Storage           Storage
+	Logger            Logger
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+}
+
+type Option func(cfg *Config)
+
+// WithStorage sets where the state of the member is kept, in memory by
+// default.
+func WithStorage(storage Storage) Option {
+	return func(cfg *Config) {
+		cfg.Storage = storage
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(cfg *Config) {
+		cfg.Logger = logger
+	}
+}
+
+// WithElectionTimeout sets how long a follower waits for the leader before
+// starting an election. The actual timeout is randomized up to twice as long.
+func WithElectionTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ElectionTimeout = timeout
+	}
+}
+
+// WithHeartbeatInterval sets how often the leader reaches the followers. It
+// must be well below the election timeout.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.HeartbeatInterval = interval
+	}
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+type applied struct {
+	term uint64
+	res  interface{}
+}
+
+// Raft is a member of the cluster. It serves the Raft service of the other
+// members, and proposes the commands of its owner while it leads.
+type Raft struct {
+	mu                sync.Mutex
+	applyCond         *sync.Cond
+	id                string
+	members           map[string]string
+	clients           map[string]v1.RaftClient
+	conns             []*grpc.ClientConn
+	storage           Storage
+	logger            Logger
+	fsm               FSM
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+
+	role        role
+	term        uint64
+	votedFor    string
+	leaderID    string
+	log         []Entry
+	commitIndex uint64
+	lastApplied uint64
+	deadline    time.Time
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	sending     map[string]bool
+	waiters     map[uint64]chan applied
+
+	doneCh chan struct{}
+	closed bool
+}
+
+// New creates the member with the id among the peers, which include every
+// member of the cluster. It does not take part until started.
+func New(id string, peers []Peer, opts ...Option) (*Raft, error) {
+	cfg := &Config{
+		Storage:           &MemoryStorage{},
+		Logger:            noOpLogger{},
+		ElectionTimeout:   defaultElectionTimeout,
+		HeartbeatInterval: defaultHeartbeatInterval,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	r := &Raft{
+		id:                id,
+		members:           make(map[string]string, len(peers)),
+		clients:           make(map[string]v1.RaftClient, len(peers)),
+		storage:           cfg.Storage,
+		logger:            cfg.Logger,
+		electionTimeout:   cfg.ElectionTimeout,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		nextIndex:         make(map[string]uint64),
+		matchIndex:        make(map[string]uint64),
+		sending:           make(map[string]bool),
+		waiters:           make(map[uint64]chan applied),
+		doneCh:            make(chan struct{}),
+	}
+	r.applyCond = sync.NewCond(&r.mu)
+
+	for _, p := range peers {
+		r.members[p.ID] = p.Address
+	}
+
+	if _, ok := r.members[id]; !ok {
+		return nil, fmt.Errorf("member %s is not among the peers", id)
+	}
+
+	state, err := r.storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed loading raft state: %w", err)
+	}
+
+	r.term = state.Term
+	r.votedFor = state.VotedFor
+	// the first entry is a sentinel, so the index of an entry is its position
+	r.log = append([]Entry{{}}, state.Entries...)
+
+	for _, p := range peers {
+		if p.ID == id {
+			continue
+		}
+
+		conn, err := grpc.Dial(p.Address, grpc.WithInsecure())
+		if err != nil {
+			r.closeConns()
+
+			return nil, fmt.Errorf("cannot connect to member %s at %s: %w", p.ID, p.Address, err)
+		}
+
+		r.conns = append(r.conns, conn)
+		r.clients[p.ID] = v1.NewRaftClient(conn)
+	}
+
+	return r, nil
+}
+
+// Start applies the committed commands to the state machine, the ones of the
+// log kept in storage first, and takes part in the elections.
+func (r *Raft) Start(fsm FSM) {
+	r.mu.Lock()
+	r.fsm = fsm
+	r.resetDeadline()
+	r.mu.Unlock()
+
+	go r.run()
+	go r.applyCommitted()
+}
+
+// Propose appends the command to the log and waits until it is committed and
+// applied on this member, returning what the state machine returned. Only
+// the leader accepts commands, the others return a NotLeaderError.
+func (r *Raft) Propose(ctx context.Context, cmd []byte) (interface{}, error) {
+	r.mu.Lock()
+
+	if r.closed {
+		r.mu.Unlock()
+
+		return nil, ErrClosed
+	}
+
+	if r.role != leader {
+		err := r.notLeader()
+		r.mu.Unlock()
+
+		return nil, err
+	}
+
+	e := Entry{Index: uint64(len(r.log)), Term: r.term, Command: cmd}
+	r.log = append(r.log, e)
+
+	if err := r.persist(); err != nil {
+		r.log = r.log[:e.Index]
+		r.mu.Unlock()
+
+		return nil, err
+	}
+
+	ch := make(chan applied, 1)
+	r.waiters[e.Index] = ch
+	r.advanceCommit()
+	r.mu.Unlock()
+
+	r.broadcast()
+
+	select {
+	case res := <-ch:
+		// another leader overwrote the entry
+		if res.term != e.Term {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			return nil, r.notLeader()
+		}
+
+		return res.res, nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		delete(r.waiters, e.Index)
+		r.mu.Unlock()
+
+		return nil, ctx.Err()
+	case <-r.doneCh:
+		return nil, ErrClosed
+	}
+}
+
+// IsLeader tells whether the member currently leads the cluster.
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.role == leader
+}
+
+// Leader returns the id and address of the leader, empty when unknown.
+func (r *Raft) Leader() (string, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.leaderID, r.members[r.leaderID]
+}
+
+func (r *Raft) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+	close(r.doneCh)
+	r.applyCond.Broadcast()
+	r.closeConns()
+
+	return nil
+}
+
+func (r *Raft) RequestVote(_ context.Context, req *v1.RequestVoteRequest) (*v1.RequestVoteResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term > r.term {
+		r.stepDown(req.Term)
+	}
+
+	res := &v1.RequestVoteResponse{Term: r.term}
+
+	if req.Term < r.term || (r.votedFor != "" && r.votedFor != req.CandidateId) {
+		return res, nil
+	}
+
+	// the candidate must hold every committed entry
+	last := r.log[len(r.log)-1]
+	if req.LastLogTerm < last.Term || (req.LastLogTerm == last.Term && req.LastLogIndex < last.Index) {
+		return res, nil
+	}
+
+	r.votedFor = req.CandidateId
+
+	if err := r.persist(); err != nil {
+		return nil, err
+	}
+
+	r.resetDeadline()
+	res.VoteGranted = true
+
+	return res, nil
+}
+
+func (r *Raft) AppendEntries(_ context.Context, req *v1.AppendEntriesRequest) (*v1.AppendEntriesResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term < r.term {
+		return &v1.AppendEntriesResponse{Term: r.term}, nil
+	}
+
+	if req.Term > r.term || r.role != follower {
+		r.stepDown(req.Term)
+	}
+
+	if r.leaderID != req.LeaderId {
+		r.logger.Info("raft: %s leads term %d", req.LeaderId, req.Term)
+	}
+
+	r.leaderID = req.LeaderId
+	r.resetDeadline()
+
+	res := &v1.AppendEntriesResponse{Term: r.term}
+	lastIndex := uint64(len(r.log) - 1)
+
+	if req.PrevLogIndex > lastIndex {
+		res.ConflictIndex = lastIndex + 1
+
+		return res, nil
+	}
+
+	// the leader skips the whole conflicting term at once
+	if term := r.log[req.PrevLogIndex].Term; term != req.PrevLogTerm {
+		i := req.PrevLogIndex
+		for i > 1 && r.log[i-1].Term == term {
+			i--
+		}
+
+		res.ConflictIndex = i
+
+		return res, nil
+	}
+
+	var changed bool
+
+	for i, e := range req.Entries {
+		index := req.PrevLogIndex + 1 + uint64(i)
+
+		if index < uint64(len(r.log)) {
+			if r.log[index].Term == e.Term {
+				continue
+			}
+
+			r.log = r.log[:index]
+		}
+
+		r.log = append(r.log, Entry{Index: index, Term: e.Term, Command: e.Command})
+		changed = true
+	}
+
+	if changed {
+		if err := r.persist(); err != nil {
+			return nil, err
+		}
+	}
+
+	if last := req.PrevLogIndex + uint64(len(req.Entries)); req.LeaderCommit > r.commitIndex && last > r.commitIndex {
+		r.commitIndex = min(req.LeaderCommit, last)
+		r.applyCond.Broadcast()
+	}
+
+	res.Success = true
+
+	return res, nil
+}
+
+func (r *Raft) run() {
+	t := time.NewTicker(r.heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.doneCh:
+			return
+		case <-t.C:
+		}
+
+		r.mu.Lock()
+		isLeader := r.role == leader
+		timedOut := time.Now().After(r.deadline)
+		r.mu.Unlock()
+
+		switch {
+		case isLeader:
+			r.broadcast()
+		case timedOut:
+			r.startElection()
+		}
+	}
+}
+
+func (r *Raft) startElection() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.role = candidate
+	r.term++
+	r.votedFor = r.id
+	r.leaderID = ""
+	r.resetDeadline()
+
+	if err := r.persist(); err != nil {
+		r.logger.Error("raft: failed starting election: %v", err)
+
+		return
+	}
+
+	r.logger.Info("raft: %s starts election for term %d", r.id, r.term)
+
+	term := r.term
+	last := r.log[len(r.log)-1]
+	req := &v1.RequestVoteRequest{
+		Term:         term,
+		CandidateId:  r.id,
+		LastLogIndex: last.Index,
+		LastLogTerm:  last.Term,
+	}
+
+	votes := 1
+
+	if r.isQuorum(votes) {
+		r.becomeLeader()
+
+		return
+	}
+
+	for id, client := range r.clients {
+		go func(id string, client v1.RaftClient) {
+			ctx, cancel := context.WithTimeout(context.Background(), r.electionTimeout)
+			defer cancel()
+
+			res, err := client.RequestVote(ctx, req)
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if res.Term > r.term {
+				r.stepDown(res.Term)
+
+				return
+			}
+
+			if r.role != candidate || r.term != term || !res.VoteGranted {
+				return
+			}
+
+			votes++
+
+			if r.isQuorum(votes) {
+				r.becomeLeader()
+			}
+		}(id, client)
+	}
+}
+
+func (r *Raft) becomeLeader() {
+	r.role = leader
+	r.leaderID = r.id
+
+	for id := range r.clients {
+		r.nextIndex[id] = uint64(len(r.log))
+		r.matchIndex[id] = 0
+	}
+
+	// the entries of the previous terms are committed along with one of the
+	// current term
+	r.log = append(r.log, Entry{Index: uint64(len(r.log)), Term: r.term})
+
+	if err := r.persist(); err != nil {
+		r.logger.Error("raft: failed persisting state: %v", err)
+	}
+
+	r.logger.Info("raft: %s is the leader of term %d", r.id, r.term)
+	r.advanceCommit()
+
+	go r.broadcast()
+}
+
+// stepDown turns the member into a follower, of a newer term if given.
+func (r *Raft) stepDown(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+
+		if err := r.persist(); err != nil {
+			r.logger.Error("raft: failed persisting state: %v", err)
+		}
+	}
+
+	if r.role == leader {
+		r.logger.Info("raft: %s steps down in term %d", r.id, r.term)
+	}
+
+	r.role = follower
+}
+
+// broadcast sends the entries the followers miss, or a heartbeat.
+func (r *Raft) broadcast() {
+	for id := range r.clients {
+		go r.replicate(id)
+	}
+}
+
+func (r *Raft) replicate(id string) {
+	r.mu.Lock()
+
+	if r.role != leader || r.sending[id] {
+		r.mu.Unlock()
+
+		return
+	}
+
+	r.sending[id] = true
+	term := r.term
+	next := r.nextIndex[id]
+
+	if next < 1 {
+		next = 1
+	}
+
+	end := uint64(len(r.log))
+	if end > next+maxAppendEntries {
+		end = next + maxAppendEntries
+	}
+
+	prev := r.log[next-1]
+	req := &v1.AppendEntriesRequest{
+		Term:         term,
+		LeaderId:     r.id,
+		PrevLogIndex: prev.Index,
+		PrevLogTerm:  prev.Term,
+		LeaderCommit: r.commitIndex,
+	}
+
+	for _, e := range r.log[next:end] {
+		req.Entries = append(req.Entries, &v1.LogEntry{Index: e.Index, Term: e.Term, Command: e.Command})
+	}
+
+	client := r.clients[id]
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.electionTimeout)
+	res, err := client.AppendEntries(ctx, req)
+	cancel()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sending[id] = false
+
+	if err != nil {
+		return
+	}
+
+	if res.Term > r.term {
+		r.stepDown(res.Term)
+
+		return
+	}
+
+	if r.role != leader || r.term != term {
+		return
+	}
+
+	if !res.Success {
+		r.nextIndex[id] = max(res.ConflictIndex, 1)
+
+		go r.replicate(id)
+
+		return
+	}
+
+	match := prev.Index + uint64(len(req.Entries))
+	if match > r.matchIndex[id] {
+		r.matchIndex[id] = match
+	}
+
+	r.nextIndex[id] = match + 1
+	r.advanceCommit()
+
+	if r.nextIndex[id] < uint64(len(r.log)) {
+		go r.replicate(id)
+	}
+}
+
+// advanceCommit commits the entries of the current term stored by a quorum,
+// and the ones before them.
+func (r *Raft) advanceCommit() {
+	for n := uint64(len(r.log) - 1); n > r.commitIndex && r.log[n].Term == r.term; n-- {
+		count := 1
+
+		for id := range r.clients {
+			if r.matchIndex[id] >= n {
+				count++
+			}
+		}
+
+		if r.isQuorum(count) {
+			r.commitIndex = n
+			r.applyCond.Broadcast()
+
+			return
+		}
+	}
+}
+
+// applyCommitted applies the committed entries in order, and hands the
+// results to the proposers waiting for them.
+func (r *Raft) applyCommitted() {
+	for {
+		r.mu.Lock()
+
+		for r.lastApplied >= r.commitIndex && !r.closed {
+			r.applyCond.Wait()
+		}
+
+		if r.closed {
+			r.mu.Unlock()
+
+			return
+		}
+
+		entries := append([]Entry(nil), r.log[r.lastApplied+1:r.commitIndex+1]...)
+		r.mu.Unlock()
+
+		for _, e := range entries {
+			var res interface{}
+
+			if len(e.Command) > 0 {
+				res = r.fsm.Apply(e.Command)
+			}
+
+			r.mu.Lock()
+			r.lastApplied = e.Index
+			ch := r.waiters[e.Index]
+			delete(r.waiters, e.Index)
+			r.mu.Unlock()
+
+			if ch != nil {
+				ch <- applied{term: e.Term, res: res}
+			}
+		}
+	}
+}
+
+func (r *Raft) persist() error {
+	return r.storage.Save(State{Term: r.term, VotedFor: r.votedFor, Entries: r.log[1:]})
+}
+
+func (r *Raft) resetDeadline() {
+	r.deadline = time.Now().Add(r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout))))
+}
+
+func (r *Raft) isQuorum(n int) bool {
+	return n > len(r.members)/2
+}
+
+func (r *Raft) notLeader() error {
+	return &NotLeaderError{LeaderID: r.leaderID, LeaderAddress: r.members[r.leaderID]}
+}
+
+func (r *Raft) closeConns() {
+	for _, conn := range r.conns {
+		_ = conn.Close()
+	}
+}
+
+type noOpLogger struct{}
+
+func (noOpLogger) Info(string, ...interface{})  {}
+func (noOpLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,223 @@
+package raft_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/raft"
+	"emag-homework/pkg/test/require"
+
+	"google.golang.org/grpc"
+)
+
+type fsm struct {
+	mu   sync.Mutex
+	cmds []string
+}
+
+func (f *fsm) Apply(cmd []byte) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cmds = append(f.cmds, string(cmd))
+
+	return len(f.cmds)
+}
+
+func (f *fsm) applied() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.cmds...)
+}
+
+type member struct {
+	raft *raft.Raft
+	fsm  *fsm
+	srv  *grpc.Server
+}
+
+func (m *member) stop() {
+	m.srv.Stop()
+	_ = m.raft.Close()
+}
+
+func TestRaft(t *testing.T) {
+	t.Parallel()
+
+	members := setupCluster(t, 3)
+	defer func() {
+		for _, m := range members {
+			m.stop()
+		}
+	}()
+
+	ctx := context.Background()
+	leader := waitLeader(t, members)
+
+	for i := 0; i < 10; i++ {
+		res, err := leader.raft.Propose(ctx, []byte(fmt.Sprintf("cmd-%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, i+1, res)
+	}
+
+	waitApplied(t, members, 10)
+
+	// the followers know the leader once they replicated its commands
+	for i, m := range members {
+		if m == leader {
+			continue
+		}
+
+		_, err := m.raft.Propose(ctx, []byte("cmd"))
+
+		var notLeader *raft.NotLeaderError
+		require.True(t, errors.As(err, &notLeader), fmt.Sprintf("member %d: %v", i, err))
+
+		id, addr := leader.raft.Leader()
+		require.Equal(t, id, notLeader.LeaderID)
+		require.Equal(t, addr, notLeader.LeaderAddress)
+	}
+
+	// the others elect a new leader holding every committed command
+	leader.stop()
+
+	rest := make([]*member, 0, len(members)-1)
+	for _, m := range members {
+		if m != leader {
+			rest = append(rest, m)
+		}
+	}
+
+	newLeader := waitLeader(t, rest)
+
+	res, err := newLeader.raft.Propose(ctx, []byte("cmd-10"))
+	require.NoError(t, err)
+	require.Equal(t, 11, res)
+
+	waitApplied(t, rest, 11)
+}
+
+func TestRaft_Restart(t *testing.T) {
+	t.Parallel()
+
+	storage := &raft.MemoryStorage{}
+	require.NoError(t, storage.Save(raft.State{
+		Term: 2,
+		Entries: []raft.Entry{
+			{Index: 1, Term: 1},
+			{Index: 2, Term: 1, Command: []byte("cmd-0")},
+			{Index: 3, Term: 2, Command: []byte("cmd-1")},
+		},
+	}))
+
+	r, err := raft.New("a", []raft.Peer{{ID: "a", Address: "127.0.0.1:0"}}, raft.WithStorage(storage),
+		raft.WithElectionTimeout(time.Millisecond*50), raft.WithHeartbeatInterval(time.Millisecond*10))
+	require.NoError(t, err)
+	defer r.Close()
+
+	f := &fsm{}
+	r.Start(f)
+
+	// a single member commits its log once elected
+	m := []*member{{raft: r, fsm: f}}
+	waitLeader(t, m)
+	waitApplied(t, m, 2)
+	require.Equal(t, []string{"cmd-0", "cmd-1"}, f.applied())
+
+	state, err := storage.Load()
+	require.NoError(t, err)
+	require.True(t, state.Term > 2)
+}
+
+func setupCluster(t *testing.T, n int) []*member {
+	t.Helper()
+
+	listeners := make([]net.Listener, 0, n)
+	peers := make([]raft.Peer, 0, n)
+
+	for i := 0; i < n; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		listeners = append(listeners, lis)
+		peers = append(peers, raft.Peer{ID: fmt.Sprintf("member-%d", i), Address: lis.Addr().String()})
+	}
+
+	members := make([]*member, 0, n)
+
+	for i, lis := range listeners {
+		r, err := raft.New(peers[i].ID, peers, raft.WithElectionTimeout(time.Millisecond*150),
+			raft.WithHeartbeatInterval(time.Millisecond*30))
+		require.NoError(t, err)
+
+		srv := grpc.NewServer()
+		v1.RegisterRaftServer(srv, r)
+
+		go func(lis net.Listener) {
+			_ = srv.Serve(lis)
+		}(lis)
+
+		m := &member{raft: r, fsm: &fsm{}, srv: srv}
+		r.Start(m.fsm)
+
+		members = append(members, m)
+	}
+
+	return members
+}
+
+func waitLeader(t *testing.T, members []*member) *member {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+
+	for time.Now().Before(deadline) {
+		for _, m := range members {
+			if m.raft.IsLeader() {
+				return m
+			}
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal("no leader elected")
+
+	return nil
+}
+
+func waitApplied(t *testing.T, members []*member, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+
+	for time.Now().Before(deadline) {
+		done := true
+
+		for _, m := range members {
+			if len(m.fsm.applied()) < n {
+				done = false
+			}
+		}
+
+		if done {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	want := members[0].fsm.applied()
+	require.Equal(t, n, len(want))
+
+	for _, m := range members[1:] {
+		require.Equal(t, want, m.fsm.applied())
+	}
+}
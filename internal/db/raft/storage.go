@@ -0,0 +1,88 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"emag-homework/pkg/fileutil"
+)
+
+// State is what a member must not forget across restarts: its term, the
+// candidate it voted for in the term, and its log.
+type State struct {
+	Term     uint64  `json:"term"`
+	VotedFor string  `json:"voted_for,omitempty"`
+	Entries  []Entry `json:"entries,omitempty"`
+}
+
+// Storage keeps the state of a member. Save must be durable before it
+// returns.
+type Storage interface {
+	Load() (State, error)
+	Save(state State) error
+}
+
+// MemoryStorage keeps the state in memory. A member using it must not rejoin
+// the cluster after a restart under the same id, as it forgets its votes.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	state State
+}
+
+func (s *MemoryStorage) Load() (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state, nil
+}
+
+func (s *MemoryStorage) Save(state State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the log of the member changes in place
+	state.Entries = append([]Entry(nil), state.Entries...)
+	s.state = state
+
+	return nil
+}
+
+// FileStorage keeps the state in a JSON file, replaced atomically on every
+// save. The membership log is small, so it is rewritten as a whole.
+type FileStorage struct {
+	filename string
+}
+
+func NewFileStorage(filename string) *FileStorage {
+	return &FileStorage{filename: filename}
+}
+
+func (s *FileStorage) Load() (State, error) {
+	var state State
+
+	b, err := os.ReadFile(s.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+
+		return state, fmt.Errorf("failed reading raft state %q: %w", s.filename, err)
+	}
+
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, fmt.Errorf("failed json decoding raft state: %w", err)
+	}
+
+	return state, nil
+}
+
+func (s *FileStorage) Save(state State) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed json encoding raft state: %w", err)
+	}
+
+	return fileutil.WriteFile(s.filename, b)
+}
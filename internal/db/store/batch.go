@@ -0,0 +1,170 @@
+package store
+
+import "fmt"
+
+type batchKind uint8
+
+const (
+	batchPut batchKind = iota
+	batchDelete
+	batchIncrement
+	batchIncrementPN
+	batchMergePN
+)
+
+type batchWrite struct {
+	kind    batchKind
+	entry   Entry
+	delta   int64
+	actor   string
+	counter PNCounter
+}
+
+// Batch is a set of writes ApplyBatch applies atomically.
+type Batch struct {
+	writes []batchWrite
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Put(entry Entry) *Batch {
+	b.writes = append(b.writes, batchWrite{kind: batchPut, entry: entry})
+
+	return b
+}
+
+func (b *Batch) Delete(k string, version int64) *Batch {
+	b.writes = append(b.writes, batchWrite{kind: batchDelete, entry: Entry{Key: k, Version: version}})
+
+	return b
+}
+
+func (b *Batch) Increment(k string, delta, version int64) *Batch {
+	b.writes = append(b.writes, batchWrite{kind: batchIncrement, entry: Entry{Key: k, Version: version}, delta: delta})
+
+	return b
+}
+
+func (b *Batch) IncrementPN(k string, delta, version int64, actor string) *Batch {
+	b.writes = append(b.writes, batchWrite{
+		kind:  batchIncrementPN,
+		entry: Entry{Key: k, Version: version},
+		delta: delta,
+		actor: actor,
+	})
+
+	return b
+}
+
+func (b *Batch) MergePN(k string, counter PNCounter, version int64) *Batch {
+	b.writes = append(b.writes, batchWrite{
+		kind:    batchMergePN,
+		entry:   Entry{Key: k, Version: version},
+		counter: counter,
+	})
+
+	return b
+}
+
+func (b *Batch) Len() int {
+	return len(b.writes)
+}
+
+// ApplyBatch applies every write of the batch under one lock and appends them
+// to the log as a single record, so either all of them survive a crash or
+// none does. If any write fails, nothing is applied. The writes behave like
+// the methods of the same name, except that puts and deletes superseded by a
+// newer version are skipped instead of failing the batch, as a batch is
+// replicated as a whole. The entries written are returned in batch order.
+func (s *Store) ApplyBatch(b *Batch) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range b.writes {
+		if err := s.checkLock(w.entry.Key, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := s.resolveBatch(b)
+	if err != nil || len(entries) == 0 {
+		return entries, err
+	}
+
+	if err := s.write(record{Op: batchOp, Entries: entries}); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		s.set(e)
+	}
+
+	return entries, nil
+}
+
+// resolveBatch returns the entries the batch writes, without applying them.
+func (s *Store) resolveBatch(b *Batch) ([]Entry, error) {
+	// later writes of the batch see the earlier ones
+	pending := make(map[string]Entry, len(b.writes))
+	entries := make([]Entry, 0, len(b.writes))
+
+	for _, w := range b.writes {
+		if w.entry.Key == "" {
+			return nil, fmt.Errorf("key cannot be empty")
+		}
+
+		if w.entry.Version == 0 {
+			return nil, fmt.Errorf("version cannot be empty")
+		}
+
+		found, ok := pending[w.entry.Key]
+		if !ok {
+			found, ok = s.lookup(w.entry.Key)
+		}
+
+		entry, changed, err := w.resolve(found, ok)
+		if err != nil {
+			return nil, err
+		}
+
+		if !changed {
+			continue
+		}
+
+		pending[entry.Key] = entry
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// resolve returns the entry the write results in, given the entry found for
+// the key, and whether it changes anything.
+func (w batchWrite) resolve(found Entry, ok bool) (Entry, bool, error) {
+	k, version := w.entry.Key, w.entry.Version
+
+	switch w.kind {
+	case batchPut:
+		entry := putEntry(w.entry)
+
+		return entry, !ok || entry.newerThan(found), nil
+	case batchDelete:
+		entry := tombstone(k, version, found.Clock)
+
+		return entry, !ok || entry.newerThan(found), nil
+	case batchIncrement:
+		entry, err := incremented(found, ok, k, w.delta, version)
+
+		return entry, err == nil, err
+	case batchIncrementPN:
+		entry, err := incrementedPN(found, ok, k, w.delta, version, w.actor)
+
+		return entry, err == nil, err
+	case batchMergePN:
+		return mergedPN(found, ok, k, w.counter, version)
+	default:
+		return Entry{}, false, fmt.Errorf("unknown batch write %d", w.kind)
+	}
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrStaleVersion    = errors.New("a newer version is stored")
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
+// CompareAndSwap stores the entry only if the version of the key is expected,
+// an expected version of 0 meaning the key must not exist. ErrVersionMismatch
+// is returned otherwise.
+func (s *Store) CompareAndSwap(entry Entry, expected int64) error {
+	if entry.Key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	if entry.Version == 0 {
+		return fmt.Errorf("version cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current int64
+
+	if found, ok := s.lookup(entry.Key); ok && !found.Tombstone {
+		current = found.Version
+	}
+
+	if current != expected {
+		return fmt.Errorf("%q has version %d, expected %d: %w", entry.Key, current, expected, ErrVersionMismatch)
+	}
+
+	return s.put(entry)
+}
+
+func (e Entry) sameAs(other Entry) bool {
+	return e.Version == other.Version &&
+		e.Tombstone == other.Tombstone &&
+		e.Kind == other.Kind &&
+		e.ExpiresAt == other.ExpiresAt &&
+		bytes.Equal(e.Value, other.Value)
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+
+	"emag-homework/internal/db/vclock"
+)
+
+// Sibling is one of the values of a key written in causal mode. A key keeps
+// every sibling no other sibling descends from, so concurrent writes are all
+// kept until a client resolves them.
+type Sibling struct {
+	Value   []byte
+	Version int64
+	Clock   vclock.Dotted
+}
+
+// PutCausal writes a value descending from the causal context the client read.
+// The store acts as the coordinator of the write: it stamps the new sibling
+// with the next counter of actor, and the new sibling replaces the siblings
+// seen in the context. The new sibling is returned so it can be replicated
+// with MergeCausal.
+func (s *Store) PutCausal(k string, value []byte, version int64, context vclock.VectorClock, actor string) (Sibling, error) {
+	if k == "" {
+		return Sibling{}, fmt.Errorf("key cannot be empty")
+	}
+
+	if version == 0 {
+		return Sibling{}, fmt.Errorf("version cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, _ := s.lookup(k)
+
+	if found.Tombstone && version <= found.Version {
+		return Sibling{}, fmt.Errorf("%q was deleted at version %d: %w", k, found.Version, ErrStaleVersion)
+	}
+
+	sibling := Sibling{
+		Value:   value,
+		Version: version,
+		Clock:   vclock.NewDotted(actor, found.Clock[actor], context),
+	}
+
+	if err := s.mergeCausal(k, found, []Sibling{sibling}); err != nil {
+		return Sibling{}, err
+	}
+
+	return sibling, nil
+}
+
+// MergeCausal adds siblings created by another replica.
+func (s *Store) MergeCausal(k string, siblings ...Sibling) error {
+	if k == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, _ := s.lookup(k)
+
+	return s.mergeCausal(k, found, siblings)
+}
+
+func (s *Store) mergeCausal(k string, found Entry, siblings []Sibling) error {
+	if err := s.checkLock(k, ""); err != nil {
+		return err
+	}
+
+	if siblings = afterDelete(found, siblings); len(siblings) == 0 {
+		return nil
+	}
+
+	entry := causalEntry(k, MergeSiblings(found.Siblings, siblings))
+	// the counters of the actors outlive deletes, so their dots are not reused
+	entry.Clock = entry.Clock.Merge(found.Clock)
+
+	if len(found.Siblings) == len(entry.Siblings) && found.Clock.Compare(entry.Clock) == vclock.Equal {
+		return nil
+	}
+
+	if err := s.write(record{Op: putOp, Entry: entry}); err != nil {
+		return err
+	}
+
+	s.set(entry)
+
+	return nil
+}
+
+// afterDelete returns the siblings a deleted key takes: the ones written after
+// the delete.
+func afterDelete(found Entry, siblings []Sibling) []Sibling {
+	if !found.Tombstone {
+		return siblings
+	}
+
+	kept := make([]Sibling, 0, len(siblings))
+
+	for _, sib := range siblings {
+		if sib.Version > found.Version {
+			kept = append(kept, sib)
+		}
+	}
+
+	return kept
+}
+
+// MergeSiblings returns the siblings not replaced by another sibling.
+func MergeSiblings(a, b []Sibling) []Sibling {
+	all := make([]Sibling, 0, len(a)+len(b))
+	all = append(all, a...)
+	all = append(all, b...)
+
+	out := make([]Sibling, 0, len(all))
+
+	for i, si := range all {
+		var dominated bool
+
+		for j, sj := range all {
+			if i == j {
+				continue
+			}
+
+			if sj.Clock.Obsoletes(si.Clock) || (sj.Clock.Dot == si.Clock.Dot && j < i) {
+				dominated = true
+
+				break
+			}
+		}
+
+		if !dominated {
+			out = append(out, si)
+		}
+	}
+
+	return out
+}
+
+// causalEntry builds the entry holding the siblings. Its clock is the causal
+// context of the key, and its value is the sibling with the highest version,
+// for the readers not aware of siblings.
+func causalEntry(k string, siblings []Sibling) Entry {
+	e := Entry{
+		Key:      k,
+		Clock:    vclock.VectorClock{},
+		Siblings: siblings,
+	}
+
+	for _, sib := range siblings {
+		e.Clock = e.Clock.Merge(sib.Clock.Clock())
+
+		if sib.Version > e.Version || (sib.Version == e.Version && bytes.Compare(sib.Value, e.Value) > 0) {
+			e.Version = sib.Version
+			e.Value = sib.Value
+		}
+	}
+
+	return e
+}
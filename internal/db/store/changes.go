@@ -0,0 +1,140 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrLogCompacted is returned by Changes when the records asked for were
+// already compacted into a snapshot.
+var ErrLogCompacted = errors.New("log compacted")
+
+// Change is a mutation read back from the log.
+type Change struct {
+	Seq uint64
+	// Time is when the mutation was logged, in unix nanoseconds.
+	Time int64
+	// Entry is the entry stored, a tombstone for deletes.
+	Entry Entry
+	// Purged is set when the key was removed from the store, such as a
+	// tombstone being collected; only the key of the entry is set then.
+	Purged bool
+}
+
+// Changes reads the mutations logged after the sequence, going through at
+// most limit records, and returns the sequence of the last record read, to
+// read the next changes from. Records not changing entries, like transaction
+// intents, are read but not returned. When the records after the sequence
+// were compacted away, ErrLogCompacted is returned along with the sequence
+// the log now starts after.
+func (s *Store) Changes(after uint64, limit int) ([]Change, uint64, error) {
+	s.mu.Lock()
+
+	if s.wal == nil {
+		s.mu.Unlock()
+
+		return nil, after, fmt.Errorf("store is not persisted or closed")
+	}
+
+	w := s.wal
+	segments := append([]uint64(nil), w.segments...)
+	last := w.seq
+	s.mu.Unlock()
+
+	if len(segments) > 0 && segments[0] > after+1 {
+		return nil, segments[0] - 1, fmt.Errorf("records %d to %d: %w", after+1, segments[0]-1, ErrLogCompacted)
+	}
+
+	changes := make([]Change, 0)
+	read := after
+
+	for i, first := range segments {
+		// the next segment starts before the records asked for
+		if i < len(segments)-1 && segments[i+1] <= after+1 {
+			continue
+		}
+
+		err := readChanges(w.segmentPath(first), func(rec record) bool {
+			if rec.Seq <= read {
+				return true
+			}
+
+			if rec.Seq > last || (limit > 0 && int(read-after) >= limit) {
+				return false
+			}
+
+			changes = append(changes, recordChanges(rec)...)
+			read = rec.Seq
+
+			return true
+		})
+		if err != nil {
+			return nil, after, err
+		}
+
+		if read == last || (limit > 0 && int(read-after) >= limit) {
+			break
+		}
+	}
+
+	return changes, read, nil
+}
+
+// readChanges reads the records of the segment until fn returns false. A
+// torn record can only be the one being written, so it ends the segment.
+func readChanges(path string, fn func(rec record) bool) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed opening segment: %w", err)
+	}
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+
+	for {
+		rec, _, err := readRecord(r)
+		if err == io.EOF || errors.Is(err, errCorruptRecord) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("segment %q: %w", path, err)
+		}
+
+		if !fn(rec) {
+			return nil
+		}
+	}
+}
+
+func recordChanges(rec record) []Change {
+	switch rec.Op {
+	case putOp:
+		return []Change{{Seq: rec.Seq, Time: rec.Time, Entry: rec.Entry}}
+	case delOp:
+		return []Change{{Seq: rec.Seq, Time: rec.Time, Entry: rec.Entry, Purged: true}}
+	case batchOp, commitOp:
+		changes := make([]Change, 0, len(rec.Entries))
+
+		for _, e := range rec.Entries {
+			changes = append(changes, Change{Seq: rec.Seq, Time: rec.Time, Entry: e})
+		}
+
+		return changes
+	default:
+		return nil
+	}
+}
+
+// Retain keeps the log records after the sequence from being compacted away,
+// for a reader following the log with Changes.
+func (s *Store) Retain(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retain = seq
+	s.retaining = true
+}
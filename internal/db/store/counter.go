@@ -0,0 +1,100 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var ErrNotCounter = errors.New("value is not a counter")
+
+// Kind is the type of the value held by an entry.
+type Kind uint8
+
+const (
+	ValueKind Kind = iota
+	// CounterKind entries hold an int64 in Counter. Their Value is the decimal
+	// representation of the counter, for the readers not aware of counters.
+	CounterKind
+	// PNCounterKind entries hold a PNCounter in PN, their Value being the
+	// decimal representation of its total.
+	PNCounterKind
+)
+
+// Increment atomically adds delta to the counter stored under the key and
+// returns the updated entry. A missing or deleted key starts from 0, and a
+// plain value holding a decimal integer is converted to a counter. The entry
+// version is moved past the current one if needed, so increments are never
+// ignored.
+func (s *Store) Increment(k string, delta, version int64) (Entry, error) {
+	if k == "" {
+		return Entry{}, fmt.Errorf("key cannot be empty")
+	}
+
+	if version == 0 {
+		return Entry{}, fmt.Errorf("version cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLock(k, ""); err != nil {
+		return Entry{}, err
+	}
+
+	found, ok := s.lookup(k)
+
+	entry, err := incremented(found, ok, k, delta, version)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return s.commit(entry)
+}
+
+// incremented returns the entry resulting from adding delta to the counter of
+// the entry found for the key.
+func incremented(found Entry, ok bool, k string, delta, version int64) (Entry, error) {
+	var counter int64
+
+	if ok && !found.Tombstone {
+		n, err := found.counter()
+		if err != nil {
+			return Entry{}, err
+		}
+
+		counter = n
+	}
+
+	if ok && version <= found.Version {
+		version = found.Version + 1
+	}
+
+	return counterEntry(k, counter+delta, version), nil
+}
+
+func (e Entry) counter() (int64, error) {
+	switch e.Kind {
+	case CounterKind:
+		return e.Counter, nil
+	case PNCounterKind:
+		return e.PN.Value(), nil
+	}
+
+	n, err := strconv.ParseInt(string(e.Value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q: %w", e.Key, ErrNotCounter)
+	}
+
+	return n, nil
+}
+
+func counterEntry(k string, counter, version int64) Entry {
+	return Entry{
+		Key:     k,
+		Value:   []byte(strconv.FormatInt(counter, 10)),
+		Version: version,
+		Kind:    CounterKind,
+		Counter: counter,
+	}
+}
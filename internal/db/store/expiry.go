@@ -0,0 +1,89 @@
+package store
+
+import "time"
+
+const defaultExpireInterval = time.Second
+
+// WithExpireInterval sets how often the expired entries are turned into
+// tombstones.
+func WithExpireInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ExpireInterval = interval
+	}
+}
+
+func (e Entry) expired(now int64) bool {
+	return !e.Tombstone && e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
+
+// expiredEntry returns the tombstone an entry expires to. It only depends on
+// the entry, deletes winning over writes of the same version, so the replicas
+// of the entry all expire it to the same tombstone, whenever they sweep it.
+func expiredEntry(e Entry) Entry {
+	return Entry{
+		Key:       e.Key,
+		Version:   e.Version,
+		Tombstone: true,
+		DeletedAt: e.ExpiresAt,
+		Clock:     e.Clock,
+	}
+}
+
+// lookup returns the entry of the key, an expired entry being returned as its
+// tombstone even before it is swept.
+func (s *Store) lookup(k string) (Entry, bool) {
+	e, ok := s.data[k]
+	if ok && e.expired(time.Now().UnixNano()) {
+		e = expiredEntry(e)
+	}
+
+	return e, ok
+}
+
+// ExpireEntries replaces the expired entries with their tombstones and returns
+// how many expired.
+func (s *Store) ExpireEntries() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixNano()
+
+	var count int
+
+	for _, e := range s.data {
+		if !e.expired(now) {
+			continue
+		}
+
+		if _, err := s.commit(expiredEntry(e)); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+func (s *Store) startExpiring() {
+	t := time.NewTicker(s.expireInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-t.C:
+			count, err := s.ExpireEntries()
+			if err != nil {
+				s.logger.Error("failed expiring entries: %v", err)
+
+				continue
+			}
+
+			if count > 0 {
+				s.logger.Info("expired %d entries", count)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"sort"
+	"strings"
+)
+
+// index keeps the keys of the store sorted, for range scans. Keys are kept in
+// a sorted slice: lookups are O(log n) and inserting or removing a key moves
+// the keys after it, which is cheap next to the log write every mutation does.
+type index struct {
+	keys []string
+}
+
+func (idx *index) insert(k string) {
+	i := sort.SearchStrings(idx.keys, k)
+	if i < len(idx.keys) && idx.keys[i] == k {
+		return
+	}
+
+	idx.keys = append(idx.keys, "")
+	copy(idx.keys[i+1:], idx.keys[i:])
+	idx.keys[i] = k
+}
+
+func (idx *index) remove(k string) {
+	i := sort.SearchStrings(idx.keys, k)
+	if i == len(idx.keys) || idx.keys[i] != k {
+		return
+	}
+
+	idx.keys = append(idx.keys[:i], idx.keys[i+1:]...)
+}
+
+// ascend calls fn with the keys from start, included, to end, excluded, having
+// the prefix, in order, until fn returns false. An empty end means no bound.
+func (idx *index) ascend(start, end, prefix string, fn func(k string) bool) {
+	if prefix > start {
+		start = prefix
+	}
+
+	for i := sort.SearchStrings(idx.keys, start); i < len(idx.keys); i++ {
+		k := idx.keys[i]
+
+		if end != "" && k >= end {
+			return
+		}
+
+		if !strings.HasPrefix(k, prefix) {
+			return
+		}
+
+		if !fn(k) {
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"emag-homework/internal/db/keyspace"
+	"emag-homework/internal/db/merkle"
+)
+
+// MerkleHash returns the summary of the entries of the range, tombstones
+// included, for replicas to compare.
+func (s *Store) MerkleHash(r keyspace.Range) merkle.Part {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tree.Hash(r)
+}
+
+// MerkleHashes returns the summaries of the range split in n parts.
+func (s *Store) MerkleHashes(r keyspace.Range, n int) []merkle.Part {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tree.Hashes(r, n)
+}
+
+// MerkleKeys returns the keys of the range with the digests of their entries.
+func (s *Store) MerkleKeys(r keyspace.Range) []merkle.Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tree.Keys(r)
+}
+
+// digest identifies the state of the entry: replicas holding the same entry
+// have the same digest.
+func (e Entry) digest() uint64 {
+	h := fnv.New64a()
+
+	var buf [8]byte
+
+	binary.BigEndian.PutUint64(buf[:], uint64(e.Version))
+	_, _ = h.Write(buf[:])
+
+	if e.Tombstone {
+		_, _ = h.Write([]byte{1})
+
+		return h.Sum64()
+	}
+
+	_, _ = h.Write([]byte{0, byte(e.Kind)})
+	_, _ = h.Write(e.Value)
+	_, _ = h.Write(e.Clock.Encode())
+
+	return h.Sum64()
+}
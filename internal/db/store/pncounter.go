@@ -0,0 +1,206 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// PNCounter is a counter the replicas update independently and merge without
+// losing updates: every replica only adds to its own slots, increments to P
+// and decrements to N, and a merge keeps the highest value of every slot.
+type PNCounter struct {
+	P map[string]int64
+	N map[string]int64
+}
+
+// Value returns the total of the counter.
+func (c PNCounter) Value() int64 {
+	var v int64
+
+	for _, n := range c.P {
+		v += n
+	}
+
+	for _, n := range c.N {
+		v -= n
+	}
+
+	return v
+}
+
+// Add returns a copy of the counter with delta added to the slots of actor.
+func (c PNCounter) Add(actor string, delta int64) PNCounter {
+	out := c.Merge(PNCounter{})
+
+	if delta >= 0 {
+		out.P[actor] += delta
+	} else {
+		out.N[actor] -= delta
+	}
+
+	return out
+}
+
+// Merge returns the counter holding the highest value of every slot of c and
+// other.
+func (c PNCounter) Merge(other PNCounter) PNCounter {
+	return PNCounter{
+		P: mergeSlots(c.P, other.P),
+		N: mergeSlots(c.N, other.N),
+	}
+}
+
+func (c PNCounter) Equal(other PNCounter) bool {
+	return equalSlots(c.P, other.P) && equalSlots(c.N, other.N)
+}
+
+// IncrementPN adds delta to the slots of actor in the PN-counter of the key
+// and returns the updated entry, to be replicated with MergePN. A missing or
+// deleted key starts from 0, and a counter or a plain value holding a decimal
+// integer is converted to a PN-counter.
+func (s *Store) IncrementPN(k string, delta, version int64, actor string) (Entry, error) {
+	if k == "" {
+		return Entry{}, fmt.Errorf("key cannot be empty")
+	}
+
+	if version == 0 {
+		return Entry{}, fmt.Errorf("version cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLock(k, ""); err != nil {
+		return Entry{}, err
+	}
+
+	found, ok := s.lookup(k)
+
+	entry, err := incrementedPN(found, ok, k, delta, version, actor)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return s.commit(entry)
+}
+
+// MergePN merges the PN-counter of the key with the one of another replica.
+func (s *Store) MergePN(k string, counter PNCounter, version int64) (Entry, error) {
+	if k == "" {
+		return Entry{}, fmt.Errorf("key cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLock(k, ""); err != nil {
+		return Entry{}, err
+	}
+
+	found, ok := s.lookup(k)
+
+	entry, changed, err := mergedPN(found, ok, k, counter, version)
+	if err != nil || !changed {
+		return entry, err
+	}
+
+	return s.commit(entry)
+}
+
+func incrementedPN(found Entry, ok bool, k string, delta, version int64, actor string) (Entry, error) {
+	counter, err := found.ToPNCounter()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	if ok && version <= found.Version {
+		version = found.Version + 1
+	}
+
+	return pnEntry(k, counter.Add(actor, delta), version), nil
+}
+
+// mergedPN returns the entry resulting from merging the counter into the entry
+// found for the key, and whether it differs from the one found.
+func mergedPN(found Entry, ok bool, k string, counter PNCounter, version int64) (Entry, bool, error) {
+	if ok && found.Tombstone && found.Version >= version {
+		return found, false, nil
+	}
+
+	current, err := found.ToPNCounter()
+	if err != nil {
+		return Entry{}, false, err
+	}
+
+	merged := current.Merge(counter)
+	if ok && found.Kind == PNCounterKind && merged.Equal(current) {
+		return found, false, nil
+	}
+
+	if found.Version > version {
+		version = found.Version
+	}
+
+	return pnEntry(k, merged, version), true, nil
+}
+
+// ToPNCounter returns the PN-counter of the entry. The value of other counters
+// is kept in the slots of the empty actor, which is the same on every replica.
+func (e Entry) ToPNCounter() (PNCounter, error) {
+	if e.Key == "" || e.Tombstone {
+		return PNCounter{}, nil
+	}
+
+	if e.Kind == PNCounterKind {
+		return e.PN, nil
+	}
+
+	n, err := e.counter()
+	if err != nil {
+		return PNCounter{}, err
+	}
+
+	return PNCounter{}.Add("", n), nil
+}
+
+func pnEntry(k string, counter PNCounter, version int64) Entry {
+	return Entry{
+		Key:     k,
+		Value:   []byte(strconv.FormatInt(counter.Value(), 10)),
+		Version: version,
+		Kind:    PNCounterKind,
+		PN:      counter,
+	}
+}
+
+func mergeSlots(a, b map[string]int64) map[string]int64 {
+	out := make(map[string]int64, len(a))
+
+	for actor, n := range a {
+		out[actor] = n
+	}
+
+	for actor, n := range b {
+		if n > out[actor] {
+			out[actor] = n
+		}
+	}
+
+	return out
+}
+
+func equalSlots(a, b map[string]int64) bool {
+	for actor, n := range a {
+		if b[actor] != n {
+			return false
+		}
+	}
+
+	for actor, n := range b {
+		if a[actor] != n {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"emag-homework/internal/db/keyspace"
+	"emag-homework/internal/db/vclock"
+)
+
+// Dump returns a point-in-time copy of the entries whose key hash falls in one
+// of the ranges, or of every entry without ranges, tombstones included.
+func (s *Store) Dump(ranges ...keyspace.Range) []Entry {
+	if len(ranges) == 0 {
+		ranges = []keyspace.Range{keyspace.Full}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]Entry, 0)
+
+	for _, r := range ranges {
+		for _, k := range s.tree.Keys(r) {
+			if e, ok := s.lookup(k.Key); ok {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	return entries
+}
+
+// Restore merges entries dumped by another replica, as one write to the log.
+// An entry only replaces a newer one when they merge: PN-counters and causal
+// siblings. It returns the number of entries that changed.
+func (s *Store) Restore(entries []Entry) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	applied := make([]Entry, 0, len(entries))
+
+	for _, e := range entries {
+		if e.Key == "" {
+			continue
+		}
+
+		found, ok := s.lookup(e.Key)
+
+		restored, changed, err := restoredEntry(found, ok, e)
+		if err != nil {
+			return 0, err
+		}
+
+		if changed {
+			applied = append(applied, restored)
+		}
+	}
+
+	if len(applied) == 0 {
+		return 0, nil
+	}
+
+	if err := s.write(record{Op: batchOp, Entries: applied}); err != nil {
+		return 0, err
+	}
+
+	for _, e := range applied {
+		s.set(e)
+	}
+
+	return len(applied), nil
+}
+
+func restoredEntry(found Entry, ok bool, e Entry) (Entry, bool, error) {
+	switch {
+	case !e.Tombstone && e.Kind == PNCounterKind && (!ok || found.Kind == PNCounterKind):
+		return mergedPN(found, ok, e.Key, e.PN, e.Version)
+	case !e.Tombstone && len(e.Siblings) > 0 && (!ok || len(found.Siblings) > 0 || found.Tombstone):
+		siblings := afterDelete(found, e.Siblings)
+		if len(siblings) == 0 {
+			return found, false, nil
+		}
+
+		merged := causalEntry(e.Key, MergeSiblings(found.Siblings, siblings))
+		merged.Clock = merged.Clock.Merge(found.Clock)
+
+		return merged, len(found.Siblings) != len(merged.Siblings) || found.Clock.Compare(merged.Clock) != vclock.Equal, nil
+	case !ok || e.newerThan(found):
+		return e, true, nil
+	default:
+		return found, false, nil
+	}
+}
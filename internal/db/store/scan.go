@@ -0,0 +1,47 @@
+package store
+
+// Scan returns up to limit entries in key order, from start, included, to end,
+// excluded, having the prefix. An empty end means no bound and a limit of 0
+// means no limit. Tombstones are returned too, for the replicas to be merged;
+// Entry.Tombstone tells them apart.
+func (s *Store) Scan(start, end, prefix string, limit int) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]Entry, 0)
+
+	s.index.ascend(start, end, prefix, func(k string) bool {
+		e, _ := s.lookup(k)
+		entries = append(entries, e)
+
+		return limit <= 0 || len(entries) < limit
+	})
+
+	return entries
+}
+
+// After returns the smallest key greater than k, to resume a scan after it.
+func After(k string) string {
+	return k + "\x00"
+}
+
+// set stores the entry, indexes its key and notifies the watchers.
+func (s *Store) set(e Entry) {
+	if _, ok := s.data[e.Key]; !ok {
+		s.index.insert(e.Key)
+	}
+
+	s.data[e.Key] = e
+	s.tree.Set(e.Key, e.digest())
+	s.notify(e)
+}
+
+// unset removes the entry and its key from the index.
+func (s *Store) unset(k string) {
+	if _, ok := s.data[k]; ok {
+		s.index.remove(k)
+		s.tree.Remove(k)
+	}
+
+	delete(s.data, k)
+}
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"emag-homework/pkg/fileutil"
+)
+
+const defaultSnapshotLogSize = 64 << 20
+
+// Snapshot writes a point-in-time image of the data next to the log and drops
+// the log segments the image covers. The image is framed exactly like the log:
+// a header record carrying the last sequence it includes, followed by one put
+// record per entry.
+func (s *Store) Snapshot() error {
+	if !s.IsPersisted() {
+		return nil
+	}
+
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.mu.Lock()
+
+	if s.wal == nil {
+		s.mu.Unlock()
+
+		return fmt.Errorf("store is closed")
+	}
+
+	seq := s.wal.seq
+	data := make([]Entry, 0, len(s.data))
+
+	for _, e := range s.data {
+		data = append(data, e)
+	}
+
+	intents := make([]Intent, 0, len(s.intents))
+
+	for _, intent := range s.intents {
+		intents = append(intents, intent)
+	}
+
+	// new writes go to a fresh segment, so everything before it is covered
+	// by the image and can be removed once the image is on disk
+	err := s.wal.rotate()
+
+	s.logBytes = 0
+	s.logEntries = 0
+	s.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed rotating log: %w", err)
+	}
+
+	s.logger.Info("writing snapshot at sequence %d with %d entries...", seq, len(data))
+
+	if err := writeSnapshot(s.filename, seq, data, intents); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal == nil {
+		return nil
+	}
+
+	// the records a reader did not get yet are kept, see Retain
+	if s.retaining && s.retain < seq {
+		seq = s.retain
+	}
+
+	if err := s.wal.compact(seq); err != nil {
+		return fmt.Errorf("failed compacting log: %w", err)
+	}
+
+	return nil
+}
+
+// WithSnapshotInterval takes a snapshot periodically, if anything was written
+// since the last one.
+func WithSnapshotInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.SnapshotInterval = interval
+	}
+}
+
+// WithSnapshotLogSize takes a snapshot once the log grew by size bytes.
+func WithSnapshotLogSize(size int64) Option {
+	return func(cfg *Config) {
+		cfg.SnapshotLogSize = size
+	}
+}
+
+// WithSnapshotEntries takes a snapshot once n records were appended to the log.
+func WithSnapshotEntries(n int) Option {
+	return func(cfg *Config) {
+		cfg.SnapshotEntries = n
+	}
+}
+
+func (s *Store) shouldSnapshot() bool {
+	if s.snapshotLogSize > 0 && s.logBytes >= s.snapshotLogSize {
+		return true
+	}
+
+	return s.snapshotEntries > 0 && s.logEntries >= s.snapshotEntries
+}
+
+func (s *Store) notifySnapshot() {
+	select {
+	case s.snapshotCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Store) startSnapshotting() {
+	var tick <-chan time.Time
+
+	if s.snapshotInterval > 0 {
+		t := time.NewTicker(s.snapshotInterval)
+		defer t.Stop()
+
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-s.snapshotCh:
+		case <-tick:
+			s.mu.Lock()
+			idle := s.logEntries == 0
+			s.mu.Unlock()
+
+			if idle {
+				continue
+			}
+		}
+
+		if err := s.Snapshot(); err != nil {
+			s.logger.Error("failed snapshot: %v", err)
+		}
+	}
+}
+
+func writeSnapshot(filename string, seq uint64, data []Entry, intents []Intent) error {
+	var buf bytes.Buffer
+
+	if err := writeFrames(&buf, seq, data, intents); err != nil {
+		return fmt.Errorf("failed encoding snapshot: %w", err)
+	}
+
+	if err := fileutil.WriteFile(filename, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed writing snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func writeFrames(w io.Writer, seq uint64, data []Entry, intents []Intent) error {
+	records := make([]record, 0, len(data)+len(intents)+1)
+	records = append(records, record{Seq: seq, Op: snapshotOp})
+
+	for _, e := range data {
+		records = append(records, record{Op: putOp, Entry: e})
+	}
+
+	for i := range intents {
+		records = append(records, record{Op: prepareOp, TxnID: intents[i].TxnID, Intent: &intents[i]})
+	}
+
+	for _, rec := range records {
+		frame, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSnapshot applies the records of the image and returns the last sequence
+// it covers. Files written before snapshots existed hold the whole map as
+// plain JSON and are read as an image at sequence 0.
+func readSnapshot(filename string, apply func(rec record) error) (uint64, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("failed opening file %q: %w", filename, err)
+	}
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+
+	first, err := r.Peek(1)
+	if err == io.EOF {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed reading snapshot: %w", err)
+	}
+
+	if first[0] == '{' {
+		data := make(map[string]Entry)
+
+		if err := json.NewDecoder(r).Decode(&data); err != nil {
+			return 0, fmt.Errorf("failed json decoding store data: %w", err)
+		}
+
+		for k, e := range data {
+			e.Key = k
+
+			if err := apply(record{Op: putOp, Entry: e}); err != nil {
+				return 0, err
+			}
+		}
+
+		return 0, nil
+	}
+
+	head, _, err := readRecord(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed reading snapshot header: %w", err)
+	}
+
+	if head.Op != snapshotOp {
+		return 0, fmt.Errorf("%w: missing snapshot header", errCorruptRecord)
+	}
+
+	for {
+		rec, _, err := readRecord(r)
+		if err == io.EOF {
+			return head.Seq, nil
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("failed reading snapshot: %w", err)
+		}
+
+		if err := apply(rec); err != nil {
+			return 0, err
+		}
+	}
+}
@@ -1,47 +1,90 @@
 package store
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"sync"
 	"time"
-)
 
-const (
-	defaultFlushInterval = time.Second * 3
+	"emag-homework/internal/db/merkle"
+	"emag-homework/internal/db/vclock"
+	"emag-homework/pkg/fileutil"
 )
 
 type Entry struct {
-	Key     string
-	Value   []byte
-	Version int64
+	Key       string
+	Value     []byte
+	Version   int64
+	Tombstone bool
+	DeletedAt int64
+	// ExpiresAt is when the entry expires, in unix nanoseconds, 0 for never.
+	ExpiresAt int64
+	Kind      Kind
+	Counter   int64
+	PN        PNCounter
+	// Clock and Siblings are only set for keys written in causal mode.
+	Clock    vclock.VectorClock
+	Siblings []Sibling
 }
 
 type Config struct {
-	Logger        Logger
-	FlushInterval time.Duration
-	NoPersist     bool
-	Filename      string
+	Logger               Logger
+	FlushInterval        time.Duration
+	SegmentSize          int64
+	SnapshotInterval     time.Duration
+	SnapshotLogSize      int64
+	SnapshotEntries      int
+	TombstoneGracePeriod time.Duration
+	CollectInterval      time.Duration
+	ExpireInterval       time.Duration
+	NoPersist            bool
+	Filename             string
 }
 
 type Option func(cfg *Config)
 
+// Store keeps every entry in memory. When a filename is configured, every
+// mutation is appended to a write-ahead log before it is applied, so a crash
+// loses nothing that was acknowledged. The log lives in "<filename>.wal" and
+// the file itself holds the latest snapshot the log is replayed on top of.
 type Store struct {
-	data          map[string]Entry
-	mu            sync.Mutex
-	fd            *os.File
-	filename      string
-	flushCh       chan struct{}
-	logger        Logger
-	flushInterval time.Duration
+	data                 map[string]Entry
+	index                index
+	tree                 *merkle.Tree
+	intents              map[string]Intent
+	locks                map[string]string
+	watchers             map[int]*watcher
+	watcherID            int
+	mu                   sync.Mutex
+	snapMu               sync.Mutex
+	wal                  *wal
+	filename             string
+	doneCh               chan struct{}
+	snapshotCh           chan struct{}
+	logger               Logger
+	flushInterval        time.Duration
+	segmentSize          int64
+	snapshotInterval     time.Duration
+	snapshotLogSize      int64
+	snapshotEntries      int
+	tombstoneGracePeriod time.Duration
+	collectInterval      time.Duration
+	expireInterval       time.Duration
+	logBytes             int64
+	retain               uint64
+	retaining            bool
+	logEntries           int
+	closed               bool
 }
 
 func New(opts ...Option) (*Store, error) {
 	cfg := &Config{
-		Logger:        noOpLogger{},
-		FlushInterval: defaultFlushInterval,
+		Logger:               noOpLogger{},
+		SegmentSize:          defaultSegmentSize,
+		SnapshotLogSize:      defaultSnapshotLogSize,
+		TombstoneGracePeriod: defaultTombstoneGracePeriod,
+		CollectInterval:      defaultCollectInterval,
+		ExpireInterval:       defaultExpireInterval,
 	}
 
 	for _, opt := range opts {
@@ -49,15 +92,23 @@ func New(opts ...Option) (*Store, error) {
 	}
 
 	s := &Store{
-		data:          make(map[string]Entry),
-		filename:      cfg.Filename,
-		logger:        cfg.Logger,
-		flushInterval: cfg.FlushInterval,
-		flushCh:       make(chan struct{}),
-	}
-
-	if !s.IsPersisted() {
-		s.flushCh = make(chan struct{}, 100)
+		data:                 make(map[string]Entry),
+		tree:                 merkle.New(),
+		intents:              make(map[string]Intent),
+		locks:                make(map[string]string),
+		watchers:             make(map[int]*watcher),
+		filename:             cfg.Filename,
+		logger:               cfg.Logger,
+		flushInterval:        cfg.FlushInterval,
+		segmentSize:          cfg.SegmentSize,
+		snapshotInterval:     cfg.SnapshotInterval,
+		snapshotLogSize:      cfg.SnapshotLogSize,
+		snapshotEntries:      cfg.SnapshotEntries,
+		tombstoneGracePeriod: cfg.TombstoneGracePeriod,
+		collectInterval:      cfg.CollectInterval,
+		expireInterval:       cfg.ExpireInterval,
+		doneCh:               make(chan struct{}),
+		snapshotCh:           make(chan struct{}, 1),
 	}
 
 	if err := s.setup(); err != nil {
@@ -79,17 +130,38 @@ func WithLogger(logger Logger) Option {
 	}
 }
 
+// WithFlushInternval sets how often the log is synced to disk. By default,
+// or when the interval is 0, the log is synced on every write.
 func WithFlushInternval(interval time.Duration) Option {
 	return func(cfg *Config) {
 		cfg.FlushInterval = interval
 	}
 }
 
+// WithSegmentSize sets the size after which the log rolls over to a new segment.
+func WithSegmentSize(size int64) Option {
+	return func(cfg *Config) {
+		cfg.SegmentSize = size
+	}
+}
+
+// Get returns the entry stored under the key, or nil when it is missing or
+// deleted.
 func (s *Store) Get(k string) *Entry {
+	e := s.Lookup(k)
+	if e == nil || e.Tombstone {
+		return nil
+	}
+
+	return e
+}
+
+// Lookup is like Get but it returns tombstones as well.
+func (s *Store) Lookup(k string) *Entry {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	e, ok := s.data[k]
+	e, ok := s.lookup(k)
 	if !ok {
 		return nil
 	}
@@ -104,17 +176,43 @@ func (s *Store) Size() int {
 	return len(s.data)
 }
 
+// Keys returns the keys of the entries not deleted, in order.
+func (s *Store) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.data))
+
+	s.index.ascend("", "", "", func(k string) bool {
+		if e, _ := s.lookup(k); !e.Tombstone {
+			keys = append(keys, k)
+		}
+
+		return true
+	})
+
+	return keys
+}
+
 func (s *Store) Del(k string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	delete(s.data, k)
+	if _, ok := s.data[k]; !ok {
+		return nil
+	}
+
+	if err := s.write(record{Op: delOp, Entry: Entry{Key: k}}); err != nil {
+		return err
+	}
 
-	s.notifyFlush()
+	s.unset(k)
 
 	return nil
 }
 
+// Put stores the entry unless the key holds a newer version, in which case
+// ErrStaleVersion is returned. Storing the same entry again is a no-op.
 func (s *Store) Put(entry Entry) error {
 	if entry.Key == "" {
 		return fmt.Errorf("key cannot be empty")
@@ -126,73 +224,155 @@ func (s *Store) Put(entry Entry) error {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	defer s.notifyFlush()
 
-	if found, ok := s.data[entry.Key]; ok && found.Version > entry.Version {
-		return nil
+	return s.put(entry)
+}
+
+func (s *Store) put(entry Entry) error {
+	if err := s.checkLock(entry.Key, ""); err != nil {
+		return err
 	}
 
-	s.data[entry.Key] = entry
+	entry = putEntry(entry)
 
-	return nil
+	if found, ok := s.lookup(entry.Key); ok && !entry.newerThan(found) {
+		if found.sameAs(entry) {
+			return nil
+		}
+
+		return fmt.Errorf("%q has version %d: %w", entry.Key, found.Version, ErrStaleVersion)
+	}
+
+	_, err := s.commit(entry)
+
+	return err
 }
 
-func (s *Store) notifyFlush() {
-	go func() {
-		if !s.IsPersisted() {
-			return
-		}
+// putEntry returns the entry as stored by a put: a plain value or a counter.
+func putEntry(entry Entry) Entry {
+	entry.Tombstone = false
+	entry.DeletedAt = 0
+	entry.Clock = nil
+	entry.Siblings = nil
+
+	switch entry.Kind {
+	case CounterKind:
+		entry = counterEntry(entry.Key, entry.Counter, entry.Version)
+	case PNCounterKind:
+		entry = pnEntry(entry.Key, entry.PN, entry.Version)
+	}
 
-		s.flushCh <- struct{}{}
-	}()
+	return entry
 }
 
-func (s *Store) Flush() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// commit writes the entry to the log, then applies it.
+func (s *Store) commit(entry Entry) (Entry, error) {
+	if err := s.write(record{Op: putOp, Entry: entry}); err != nil {
+		return Entry{}, err
+	}
 
-	return s.flush()
+	s.set(entry)
+
+	return entry, nil
 }
 
-func (s *Store) flush() error {
+// write appends the record to the log, syncing it right away unless the log
+// is synced periodically.
+func (s *Store) write(rec record) error {
 	if !s.IsPersisted() {
 		return nil
 	}
 
-	s.logger.Info("flushing to disk...")
+	if s.wal == nil {
+		return fmt.Errorf("store is closed")
+	}
+
+	rec.Time = time.Now().UnixNano()
+
+	n, err := s.wal.append(&rec)
+	if err != nil {
+		return fmt.Errorf("failed appending to log: %w", err)
+	}
+
+	s.logBytes += n
+	s.logEntries++
+
+	if s.shouldSnapshot() {
+		s.notifySnapshot()
+	}
 
-	if err := s.fd.Truncate(0); err != nil {
-		return fmt.Errorf("failed to truncate: %w", err)
+	if s.flushInterval > 0 {
+		return nil
 	}
 
-	if _, err := s.fd.Seek(0, 0); err != nil {
-		return fmt.Errorf("failed to seek: %w", err)
+	return s.wal.sync()
+}
+
+func (s *Store) apply(rec record) error {
+	switch rec.Op {
+	case putOp:
+		s.set(rec.Entry)
+	case delOp:
+		s.unset(rec.Entry.Key)
+	case batchOp, commitOp:
+		for _, e := range rec.Entries {
+			s.set(e)
+		}
+
+		s.removeIntent(rec.TxnID)
+	case prepareOp:
+		if rec.Intent != nil {
+			s.addIntent(*rec.Intent)
+		}
+	case abortOp:
+		s.removeIntent(rec.TxnID)
+	default:
+		return fmt.Errorf("unknown log operation %d", rec.Op)
 	}
 
-	if err := json.NewEncoder(s.fd).Encode(s.data); err != nil {
-		return fmt.Errorf("failed json encoding store data: %w", err)
+	return nil
+}
+
+// Flush syncs the log to disk.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+func (s *Store) flush() error {
+	if !s.IsPersisted() || s.wal == nil {
+		return nil
 	}
 
-	return s.fd.Sync()
+	return s.wal.sync()
 }
 
 func (s *Store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.fd == nil {
+	if s.closed {
 		return nil
 	}
 
-	if err := s.flush(); err != nil {
-		return fmt.Errorf("failed flushing: %w", err)
+	s.closed = true
+	close(s.doneCh)
+
+	for id := range s.watchers {
+		s.unwatch(id)
 	}
 
-	if err := s.fd.Close(); err != nil {
-		return fmt.Errorf("failed closing file: %w", err)
+	if s.wal == nil {
+		return nil
+	}
+
+	if err := s.wal.close(); err != nil {
+		return fmt.Errorf("failed closing log: %w", err)
 	}
 
-	s.fd = nil
+	s.wal = nil
 
 	return nil
 }
@@ -200,10 +380,23 @@ func (s *Store) Close() error {
 func (s *Store) Clean() error {
 	_ = s.Close()
 
-	return os.Remove(s.filename)
+	if err := os.RemoveAll(s.walDir()); err != nil {
+		return err
+	}
+
+	_ = os.Remove(s.filename + fileutil.TmpSuffix)
+
+	if err := os.Remove(s.filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
 }
 
 func (s *Store) setup() error {
+	go s.startCollecting()
+	go s.startExpiring()
+
 	if !s.IsPersisted() {
 		return nil
 	}
@@ -212,63 +405,50 @@ func (s *Store) setup() error {
 		return fmt.Errorf("failed loading store: %w", err)
 	}
 
-	go s.startFlushing()
+	if s.flushInterval > 0 {
+		go s.startFlushing()
+	}
+
+	go s.startSnapshotting()
 
 	return nil
 }
 
 func (s *Store) load() error {
-	var err error
-
-	s.fd, err = os.OpenFile(s.filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	seq, err := readSnapshot(s.filename, s.apply)
 	if err != nil {
-		return fmt.Errorf("failed opening file %q: %w", s.filename, err)
+		return err
 	}
 
-	if err := json.NewDecoder(s.fd).Decode(&s.data); err != nil {
-		if err != io.EOF {
-			_ = s.fd.Close()
+	s.wal, err = openWAL(s.walDir(), s.segmentSize)
+	if err != nil {
+		return err
+	}
 
-			return fmt.Errorf("failed json decoding store data: %w", err)
-		}
+	if err := s.wal.replay(seq, s.apply); err != nil {
+		return fmt.Errorf("failed replaying log: %w", err)
 	}
 
+	s.logger.Info(
+		"store loaded: %d entries, %d prepared transactions, log at sequence %d",
+		len(s.data), len(s.intents), s.wal.seq,
+	)
+
 	return nil
 }
 
 func (s *Store) startFlushing() {
-	var count int
-	t := time.NewTimer(s.flushInterval)
-
-	for range s.flushCh {
-		count++
+	t := time.NewTicker(s.flushInterval)
+	defer t.Stop()
 
+	for {
 		select {
+		case <-s.doneCh:
+			return
 		case <-t.C:
-			if count <= 0 {
-				break
-			}
-
 			if err := s.Flush(); err != nil {
 				s.logger.Error("failed flush: %v", err)
-
-				break
 			}
-
-			count = 0
-		default:
-			if count <= 100 {
-				break
-			}
-
-			if err := s.Flush(); err != nil {
-				s.logger.Error("failed flush: %v", err)
-
-				break
-			}
-
-			count = 0
-			t.Reset(s.flushInterval)
 		}
 	}
 }
@@ -276,3 +456,7 @@ func (s *Store) startFlushing() {
 func (s *Store) IsPersisted() bool {
 	return s.filename != ""
 }
+
+func (s *Store) walDir() string {
+	return s.filename + walDirSuffix
+}
@@ -2,10 +2,13 @@ package store_test
 
 import (
 	"emag-homework/internal/db/store"
+	"emag-homework/internal/db/vclock"
 	"emag-homework/pkg/test/require"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -28,7 +31,7 @@ func TestStore_Put(t *testing.T) {
 		fields  fields
 		args    args
 		want    store.Entry
-		wantErr bool
+		wantErr error
 	}{
 		{
 			name: "success",
@@ -82,6 +85,7 @@ func TestStore_Put(t *testing.T) {
 				Value:   []byte(fmt.Sprint(10)),
 				Version: 10,
 			},
+			wantErr: store.ErrStaleVersion,
 		},
 	}
 
@@ -91,13 +95,12 @@ func TestStore_Put(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			defer os.Remove(tt.fields.filename)
-
 			s, err := store.New(
 				store.WithFilename(tt.fields.filename),
 				store.WithFlushInternval(tt.fields.flushInterval),
 			)
 			require.NoError(t, err, tt.fields.filename)
+			defer s.Clean()
 
 			for _, entry := range tt.fields.entries {
 				err := s.Put(entry)
@@ -105,14 +108,8 @@ func TestStore_Put(t *testing.T) {
 			}
 
 			err = s.Put(tt.args.entry)
+			require.True(t, errors.Is(err, tt.wantErr), err)
 
-			if tt.wantErr {
-				require.Error(t, err)
-
-				return
-			}
-
-			require.NoError(t, err)
 			got := s.Get(tt.args.entry.Key)
 
 			require.Equal(t, tt.want.Value, got.Value)
@@ -126,7 +123,6 @@ func TestStore_Flush(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 
 	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
-	defer os.Remove(filename)
 
 	s, err := store.New(store.WithFilename(filename), store.WithFlushInternval(time.Second))
 	require.NoError(t, err, filename)
@@ -173,5 +169,608 @@ func TestStore_Flush(t *testing.T) {
 		require.Equal(t, want.Version, got.Version, "entry version")
 	}
 
-	_ = s.Close()
+	_ = s.Clean()
+}
+
+func TestStore_Replay(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+
+	s, err := store.New(store.WithFilename(filename), store.WithSegmentSize(128))
+	require.NoError(t, err, filename)
+
+	for i := 1; i <= 10; i++ {
+		err = s.Put(store.Entry{
+			Key:     fmt.Sprintf("key-%d", i),
+			Value:   []byte(fmt.Sprint(i)),
+			Version: int64(i),
+		})
+		require.NoError(t, err, "PUT")
+	}
+
+	err = s.Del("key-3")
+	require.NoError(t, err, "DEL")
+
+	// no close: the new store must recover everything from the log alone
+	got, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	defer got.Clean()
+
+	require.Equal(t, 9, got.Size())
+	require.True(t, got.Get("key-3") == nil, "deleted key")
+	require.Equal(t, []byte("10"), got.Get("key-10").Value)
+}
+
+func TestStore_ReplayTornWrite(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+
+	s, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	err = s.Put(store.Entry{Key: "key-1", Value: []byte("1"), Version: 1})
+	require.NoError(t, err, "PUT")
+
+	err = s.Close()
+	require.NoError(t, err, "CLOSE")
+
+	segments, err := filepath.Glob(filename + ".wal/*.log")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(segments))
+
+	fd, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+
+	_, err = fd.Write([]byte{0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	_ = fd.Close()
+
+	s, err = store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	defer s.Clean()
+
+	err = s.Put(store.Entry{Key: "key-2", Value: []byte("2"), Version: 1})
+	require.NoError(t, err, "PUT after recovery")
+
+	err = s.Close()
+	require.NoError(t, err, "CLOSE")
+
+	s, err = store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+	t.Cleanup(func() { _ = s.Close() })
+
+	require.Equal(t, 2, s.Size())
+}
+
+func TestStore_Snapshot(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+
+	s, err := store.New(store.WithFilename(filename), store.WithSegmentSize(128))
+	require.NoError(t, err, filename)
+
+	defer s.Clean()
+
+	for i := 1; i <= 10; i++ {
+		err = s.Put(store.Entry{
+			Key:     fmt.Sprintf("key-%d", i),
+			Value:   []byte(fmt.Sprint(i)),
+			Version: int64(i),
+		})
+		require.NoError(t, err, "PUT")
+	}
+
+	err = s.Snapshot()
+	require.NoError(t, err, "SNAPSHOT")
+
+	segments, err := filepath.Glob(filename + ".wal/*.log")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(segments), "segments left after compaction")
+
+	err = s.Put(store.Entry{Key: "key-11", Value: []byte("11"), Version: 11})
+	require.NoError(t, err, "PUT")
+
+	err = s.Del("key-1")
+	require.NoError(t, err, "DEL")
+
+	got, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+	t.Cleanup(func() { _ = got.Close() })
+
+	require.Equal(t, 10, got.Size())
+	require.True(t, got.Get("key-1") == nil, "deleted key")
+	require.Equal(t, []byte("11"), got.Get("key-11").Value)
+	require.Equal(t, []byte("5"), got.Get("key-5").Value)
+}
+
+func TestStore_SnapshotTrigger(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+
+	s, err := store.New(store.WithFilename(filename), store.WithSnapshotEntries(5))
+	require.NoError(t, err, filename)
+
+	defer s.Clean()
+
+	for i := 1; i <= 5; i++ {
+		err = s.Put(store.Entry{Key: fmt.Sprintf("key-%d", i), Value: []byte(fmt.Sprint(i)), Version: 1})
+		require.NoError(t, err, "PUT")
+	}
+
+	deadline := time.Now().Add(time.Second)
+
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filename); err == nil {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.True(t, false, "snapshot not taken")
+}
+
+func TestStore_Delete(t *testing.T) {
+	t.Parallel()
+
+	s, err := store.New(store.WithTombstoneGracePeriod(time.Millisecond))
+	require.NoError(t, err)
+
+	defer s.Close()
+
+	err = s.Put(store.Entry{Key: "foobar", Value: []byte("1"), Version: 10})
+	require.NoError(t, err, "PUT")
+
+	err = s.Delete("foobar", 5)
+	require.NoError(t, err, "older DELETE")
+	require.True(t, s.Get("foobar") != nil, "older delete ignored")
+
+	err = s.Delete("foobar", 20)
+	require.NoError(t, err, "DELETE")
+	require.True(t, s.Get("foobar") == nil, "deleted")
+
+	err = s.Put(store.Entry{Key: "foobar", Value: []byte("2"), Version: 15})
+	require.True(t, errors.Is(err, store.ErrStaleVersion), "older PUT")
+	require.True(t, s.Get("foobar") == nil, "older put does not resurrect")
+
+	got := s.Lookup("foobar")
+	require.True(t, got.Tombstone, "tombstone")
+	require.Equal(t, int64(20), got.Version)
+
+	time.Sleep(time.Millisecond * 5)
+
+	count, err := s.CollectTombstones()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.True(t, s.Lookup("foobar") == nil, "tombstone collected")
+}
+
+func TestStore_PutCausal(t *testing.T) {
+	t.Parallel()
+
+	s, err := store.New()
+	require.NoError(t, err)
+
+	defer s.Close()
+
+	first, err := s.PutCausal("foobar", []byte("1"), 1, nil, "node-1")
+	require.NoError(t, err, "PUT")
+
+	// two writers read the first value and write concurrently through the
+	// same coordinator
+	_, err = s.PutCausal("foobar", []byte("2"), 2, first.Clock.Clock(), "node-1")
+	require.NoError(t, err, "PUT")
+
+	concurrent, err := s.PutCausal("foobar", []byte("3"), 3, first.Clock.Clock(), "node-1")
+	require.NoError(t, err, "PUT")
+
+	got := s.Get("foobar")
+	require.Equal(t, 2, len(got.Siblings), "siblings")
+	require.Equal(t, []byte("3"), got.Value, "highest version")
+
+	// replaying a sibling already known changes nothing
+	err = s.MergeCausal("foobar", concurrent)
+	require.NoError(t, err, "MERGE")
+	require.Equal(t, 2, len(s.Get("foobar").Siblings), "siblings")
+
+	// a write with the merged context resolves the conflict
+	_, err = s.PutCausal("foobar", []byte("5"), 4, got.Clock, "node-1")
+	require.NoError(t, err, "PUT")
+
+	got = s.Get("foobar")
+	require.Equal(t, 1, len(got.Siblings), "resolved")
+	require.Equal(t, []byte("5"), got.Value)
+}
+
+func TestStore_Increment(t *testing.T) {
+	t.Parallel()
+
+	s, err := store.New()
+	require.NoError(t, err)
+
+	defer s.Close()
+
+	got, err := s.Increment("foo", 2, 1)
+	require.NoError(t, err, "missing key")
+	require.Equal(t, int64(2), got.Counter)
+
+	got, err = s.Increment("foo", 3, 1)
+	require.NoError(t, err, "same version")
+	require.Equal(t, int64(5), got.Counter)
+	require.Equal(t, int64(2), got.Version)
+	require.Equal(t, []byte("5"), s.Get("foo").Value)
+
+	err = s.Put(store.Entry{Key: "bar", Value: []byte("7"), Version: 1})
+	require.NoError(t, err, "PUT")
+
+	got, err = s.Increment("bar", 1, 2)
+	require.NoError(t, err, "plain value")
+	require.Equal(t, int64(8), got.Counter)
+
+	err = s.Put(store.Entry{Key: "baz", Value: []byte("baz"), Version: 1})
+	require.NoError(t, err, "PUT")
+
+	_, err = s.Increment("baz", 1, 2)
+	require.True(t, errors.Is(err, store.ErrNotCounter), "not a counter")
+}
+
+func TestStore_PNCounter(t *testing.T) {
+	t.Parallel()
+
+	a, err := store.New()
+	require.NoError(t, err)
+
+	defer a.Close()
+
+	b, err := store.New()
+	require.NoError(t, err)
+
+	defer b.Close()
+
+	// both replicas count while partitioned
+	_, err = a.IncrementPN("foo", 3, 1, "a")
+	require.NoError(t, err)
+
+	got, err := a.IncrementPN("foo", -1, 2, "a")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), got.PN.Value())
+
+	_, err = b.IncrementPN("foo", 5, 1, "b")
+	require.NoError(t, err)
+
+	gotA, err := a.MergePN("foo", b.Get("foo").PN, b.Get("foo").Version)
+	require.NoError(t, err)
+
+	gotB, err := b.MergePN("foo", got.PN, got.Version)
+	require.NoError(t, err)
+
+	require.Equal(t, int64(7), gotA.PN.Value())
+	require.True(t, gotA.PN.Equal(gotB.PN), "converged")
+	require.Equal(t, []byte("7"), a.Get("foo").Value)
+
+	// merging again changes nothing
+	again, err := a.MergePN("foo", gotB.PN, gotB.Version)
+	require.NoError(t, err)
+	require.Equal(t, gotA.Version, again.Version)
+	require.Equal(t, int64(7), again.PN.Value())
+}
+
+func TestStore_CompareAndSwap(t *testing.T) {
+	t.Parallel()
+
+	s, err := store.New()
+	require.NoError(t, err)
+
+	defer s.Close()
+
+	err = s.CompareAndSwap(store.Entry{Key: "foobar", Value: []byte("1"), Version: 1}, 0)
+	require.NoError(t, err, "missing key")
+
+	err = s.CompareAndSwap(store.Entry{Key: "foobar", Value: []byte("2"), Version: 2}, 0)
+	require.True(t, errors.Is(err, store.ErrVersionMismatch), "key exists")
+
+	err = s.CompareAndSwap(store.Entry{Key: "foobar", Value: []byte("2"), Version: 2}, 1)
+	require.NoError(t, err, "expected version")
+	require.Equal(t, []byte("2"), s.Get("foobar").Value)
+
+	err = s.Put(store.Entry{Key: "foobar", Value: []byte("2"), Version: 2})
+	require.NoError(t, err, "same entry again")
+}
+
+func TestStore_ApplyBatch(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+
+	s, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	err = s.Put(store.Entry{Key: "foo", Value: []byte("foo"), Version: 1})
+	require.NoError(t, err, "PUT")
+
+	got, err := s.ApplyBatch(store.NewBatch().
+		Put(store.Entry{Key: "bar", Value: []byte("bar"), Version: 2}).
+		Increment("baz", 2, 2).
+		Increment("foo", 1, 2))
+	require.True(t, errors.Is(err, store.ErrNotCounter), "failed batch")
+	require.Equal(t, 0, len(got))
+	require.True(t, s.Get("bar") == nil, "nothing applied")
+
+	got, err = s.ApplyBatch(store.NewBatch().
+		Put(store.Entry{Key: "bar", Value: []byte("bar"), Version: 2}).
+		Increment("baz", 2, 2).
+		Increment("baz", 3, 2).
+		Delete("foo", 2))
+	require.NoError(t, err, "batch")
+	require.Equal(t, 4, len(got))
+	require.Equal(t, int64(5), s.Get("baz").Counter)
+
+	// no close: the batch must be recovered from the log
+	replayed, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	defer replayed.Clean()
+
+	require.Equal(t, []byte("bar"), replayed.Get("bar").Value)
+	require.Equal(t, int64(5), replayed.Get("baz").Counter)
+	require.True(t, replayed.Get("foo") == nil, "deleted key")
+}
+
+func TestStore_Prepare(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+
+	s, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	err = s.Put(store.Entry{Key: "foo", Value: []byte("foo"), Version: 1})
+	require.NoError(t, err, "PUT")
+
+	err = s.Prepare(store.Intent{
+		TxnID:   "txn-1",
+		Version: 2,
+		Writes:  []store.Entry{{Key: "bar", Value: []byte("bar")}, {Key: "foo", Tombstone: true}},
+		Reads:   map[string]int64{"foo": 1},
+	})
+	require.NoError(t, err, "prepare")
+
+	err = s.Prepare(store.Intent{TxnID: "txn-2", Version: 3, Writes: []store.Entry{{Key: "bar"}}})
+	require.True(t, errors.Is(err, store.ErrLocked), "locked")
+
+	err = s.Prepare(store.Intent{TxnID: "txn-3", Version: 3, Reads: map[string]int64{"baz": 1}})
+	require.True(t, errors.Is(err, store.ErrVersionMismatch), "read mismatch")
+
+	err = s.Put(store.Entry{Key: "bar", Value: []byte("baz"), Version: 3})
+	require.True(t, errors.Is(err, store.ErrLocked), "plain write locked")
+
+	err = s.Put(store.Entry{Key: "baz", Value: []byte("baz"), Version: 5})
+	require.NoError(t, err, "PUT")
+
+	err = s.Prepare(store.Intent{TxnID: "txn-4", Version: 4, Writes: []store.Entry{{Key: "baz"}}})
+	require.True(t, errors.Is(err, store.ErrVersionMismatch), "write superseded")
+
+	err = s.Snapshot()
+	require.NoError(t, err, "snapshot")
+
+	// no close: the intent must be recovered from the snapshot
+	got, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	defer got.Clean()
+
+	require.Equal(t, 1, len(got.Intents()))
+	require.True(t, got.Get("bar") == nil, "not committed")
+
+	err = got.CommitIntent("txn-1")
+	require.NoError(t, err, "commit")
+	require.Equal(t, 0, len(got.Intents()))
+	require.Equal(t, []byte("bar"), got.Get("bar").Value)
+	require.Equal(t, int64(2), got.Get("bar").Version)
+	require.True(t, got.Get("foo") == nil, "deleted key")
+}
+
+func TestStore_Scan(t *testing.T) {
+	t.Parallel()
+
+	s, err := store.New()
+	require.NoError(t, err)
+
+	for i, k := range []string{"b/2", "a/1", "b/1", "c", "b/3"} {
+		err := s.Put(store.Entry{Key: k, Value: []byte(k), Version: int64(i + 1)})
+		require.NoError(t, err, k)
+	}
+
+	err = s.Delete("b/2", 10)
+	require.NoError(t, err, "DELETE")
+
+	keys := func(entries []store.Entry) []string {
+		out := make([]string, 0, len(entries))
+		for _, e := range entries {
+			out = append(out, e.Key)
+		}
+
+		return out
+	}
+
+	require.Equal(t, []string{"a/1", "b/1", "b/3", "c"}, s.Keys(), "keys")
+	require.Equal(t, []string{"a/1", "b/1", "b/2", "b/3", "c"}, keys(s.Scan("", "", "", 0)), "all")
+	require.Equal(t, []string{"b/1", "b/2"}, keys(s.Scan("b", "b/3", "", 0)), "range")
+	require.Equal(t, []string{"b/2", "b/3"}, keys(s.Scan(store.After("b/1"), "", "b/", 0)), "prefix")
+	require.Equal(t, []string{"a/1", "b/1"}, keys(s.Scan("", "", "", 2)), "limit")
+	require.True(t, s.Scan("b/2", "", "", 1)[0].Tombstone, "tombstone")
+}
+
+func TestStore_Expire(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+
+	s, err := store.New(store.WithFilename(filename), store.WithExpireInterval(time.Hour))
+	require.NoError(t, err, filename)
+
+	expiresAt := time.Now().Add(50 * time.Millisecond).UnixNano()
+	entry := store.Entry{Key: "foo", Value: []byte("foo"), Version: 1, ExpiresAt: expiresAt}
+
+	err = s.Put(entry)
+	require.NoError(t, err, "PUT")
+	require.Equal(t, []byte("foo"), s.Get("foo").Value)
+
+	time.Sleep(60 * time.Millisecond)
+
+	require.True(t, s.Get("foo") == nil, "expired")
+	require.True(t, s.Lookup("foo").Tombstone, "tombstone")
+	require.Equal(t, int64(1), s.Lookup("foo").Version, "tombstone version")
+
+	err = s.Put(entry)
+	require.True(t, errors.Is(err, store.ErrStaleVersion), "expired put")
+
+	count, err := s.ExpireEntries()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	err = s.Put(store.Entry{Key: "foo", Value: []byte("bar"), Version: 2})
+	require.NoError(t, err, "newer PUT")
+
+	err = s.Put(store.Entry{Key: "bar", Value: []byte("bar"), Version: 2, ExpiresAt: expiresAt})
+	require.NoError(t, err, "PUT expired")
+	require.True(t, s.Get("bar") == nil, "already expired")
+
+	count, err = s.ExpireEntries()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// no close: the expiry must be recovered from the log
+	replayed, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	defer replayed.Clean()
+
+	require.Equal(t, []byte("bar"), replayed.Get("foo").Value)
+	require.Equal(t, expiresAt, replayed.Lookup("bar").DeletedAt)
+}
+
+func TestStore_Watch(t *testing.T) {
+	t.Parallel()
+
+	s, err := store.New()
+	require.NoError(t, err)
+
+	entries, unwatch := s.Watch("foo/")
+
+	require.NoError(t, s.Put(store.Entry{Key: "foo/1", Value: []byte("1"), Version: 1}))
+	require.NoError(t, s.Put(store.Entry{Key: "bar", Value: []byte("bar"), Version: 2}))
+	require.NoError(t, s.Delete("foo/1", 3))
+
+	got := <-entries
+	require.Equal(t, "foo/1", got.Key)
+	require.Equal(t, []byte("1"), got.Value)
+
+	got = <-entries
+	require.True(t, got.Tombstone, "delete")
+	require.Equal(t, int64(3), got.Version)
+
+	unwatch()
+
+	_, ok := <-entries
+	require.True(t, !ok, "closed")
+
+	entries, _ = s.Watch("")
+	require.NoError(t, s.Close())
+
+	_, ok = <-entries
+	require.True(t, !ok, "closed with the store")
+}
+
+func TestStore_Changes(t *testing.T) {
+	t.Parallel()
+
+	rand.Seed(time.Now().UnixNano())
+
+	filename := fmt.Sprintf("/tmp/test_%d.json", rand.Int())
+
+	s, err := store.New(store.WithFilename(filename))
+	require.NoError(t, err, filename)
+
+	defer s.Clean()
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, s.Put(store.Entry{Key: fmt.Sprint(i), Value: []byte("v"), Version: int64(i)}))
+	}
+
+	changes, last, err := s.Changes(1, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), last)
+	require.Equal(t, 2, len(changes))
+	require.Equal(t, "2", changes[0].Entry.Key)
+
+	changes, last, err = s.Changes(0, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), last, "limit")
+	require.Equal(t, 1, len(changes))
+
+	s.Retain(1)
+	require.NoError(t, s.Snapshot())
+
+	changes, _, err = s.Changes(1, 0)
+	require.NoError(t, err, "retained")
+	require.Equal(t, 2, len(changes))
+
+	s.Retain(3)
+	require.NoError(t, s.Snapshot())
+
+	_, last, err = s.Changes(1, 0)
+	require.True(t, errors.Is(err, store.ErrLogCompacted), "compacted")
+	require.Equal(t, uint64(3), last)
+}
+
+func TestStore_PutCausal_Deleted(t *testing.T) {
+	t.Parallel()
+
+	s, err := store.New()
+	require.NoError(t, err)
+
+	defer s.Close()
+
+	first, err := s.PutCausal("foobar", []byte("1"), 1, nil, "node-1")
+	require.NoError(t, err, "PUT")
+
+	require.NoError(t, s.Delete("foobar", 3), "DELETE")
+
+	// a late replica write from before the delete does not bring the key back
+	late := store.Sibling{Value: []byte("2"), Version: 2, Clock: vclock.NewDotted("node-2", 0, first.Clock.Clock())}
+	require.NoError(t, s.MergeCausal("foobar", late), "MERGE")
+	require.True(t, s.Get("foobar") == nil, "still deleted")
+
+	_, err = s.PutCausal("foobar", []byte("2"), 2, nil, "node-1")
+	require.True(t, errors.Is(err, store.ErrStaleVersion), "PUT before the delete")
+
+	// the counter of the actor goes on after the delete
+	next, err := s.PutCausal("foobar", []byte("4"), 4, nil, "node-1")
+	require.NoError(t, err, "PUT")
+	require.Equal(t, uint64(2), next.Clock.Dot.Counter, "dot")
+
+	got := s.Get("foobar")
+	require.True(t, got != nil, "written after the delete")
+	require.Equal(t, 1, len(got.Siblings), "siblings")
 }
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"emag-homework/internal/db/vclock"
+)
+
+const (
+	defaultTombstoneGracePeriod = time.Hour * 24
+	defaultCollectInterval      = time.Minute
+)
+
+// WithTombstoneGracePeriod sets how long a tombstone is kept before it is
+// purged. It must be longer than the time it takes for a delete to reach
+// every replica, otherwise an older write can bring the key back.
+func WithTombstoneGracePeriod(period time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.TombstoneGracePeriod = period
+	}
+}
+
+// Delete writes a tombstone for the key at the given version, so writes with a
+// lower version arriving later are ignored instead of resurrecting the key.
+func (s *Store) Delete(k string, version int64) error {
+	if k == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	if version == 0 {
+		return fmt.Errorf("version cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLock(k, ""); err != nil {
+		return err
+	}
+
+	found, ok := s.lookup(k)
+	entry := tombstone(k, version, found.Clock)
+
+	if ok && !entry.newerThan(found) {
+		return nil
+	}
+
+	_, err := s.commit(entry)
+
+	return err
+}
+
+// tombstone returns the entry of a deleted key. It keeps the causal clock of
+// the key, so the siblings written afterwards get new dots.
+func tombstone(k string, version int64, clock vclock.VectorClock) Entry {
+	return Entry{
+		Key:       k,
+		Version:   version,
+		Tombstone: true,
+		DeletedAt: time.Now().UnixNano(),
+		Clock:     clock,
+	}
+}
+
+// CollectTombstones purges the tombstones older than the grace period and
+// returns how many were removed.
+func (s *Store) CollectTombstones() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	threshold := time.Now().Add(-s.tombstoneGracePeriod).UnixNano()
+
+	var count int
+
+	for k, e := range s.data {
+		if !e.Tombstone || e.DeletedAt > threshold {
+			continue
+		}
+
+		if err := s.write(record{Op: delOp, Entry: Entry{Key: k}}); err != nil {
+			return count, err
+		}
+
+		s.unset(k)
+		count++
+	}
+
+	return count, nil
+}
+
+// newerThan reports whether e replaces other. Equal versions are resolved the
+// same way on every replica: a delete wins over a write, then the highest
+// value wins.
+func (e Entry) newerThan(other Entry) bool {
+	if e.Version != other.Version {
+		return e.Version > other.Version
+	}
+
+	if e.Tombstone != other.Tombstone {
+		return e.Tombstone
+	}
+
+	if c := bytes.Compare(e.Value, other.Value); c != 0 {
+		return c > 0
+	}
+
+	// a counter replaces the plain value it was written back as
+	return e.Kind > other.Kind
+}
+
+func (s *Store) startCollecting() {
+	t := time.NewTicker(s.collectInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-t.C:
+			count, err := s.CollectTombstones()
+			if err != nil {
+				s.logger.Error("failed collecting tombstones: %v", err)
+
+				continue
+			}
+
+			if count > 0 {
+				s.logger.Info("collected %d tombstone(s)", count)
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrLocked = errors.New("key is locked by a transaction")
+
+// Intent is the part of a transaction prepared on this store: the writes to
+// apply on commit and the versions the transaction read. While prepared, its
+// keys are locked: the other transactions and the plain writes to them fail
+// with ErrLocked, so nothing supersedes the writes once committed.
+type Intent struct {
+	TxnID   string
+	Version int64
+	// Writes are applied at Version on commit, tombstones being deletes.
+	Writes []Entry
+	// Reads are the versions the transaction read, 0 for a missing key.
+	Reads      map[string]int64
+	PreparedAt int64
+}
+
+// Prepare checks the transaction still reads the versions it read and locks
+// its keys. The intent is persisted, so it survives a restart until it is
+// committed or aborted. ErrVersionMismatch or ErrLocked are returned when the
+// transaction cannot commit, including when a key it writes already holds its
+// version or a newer one, as the write would be lost. Preparing the same
+// transaction again is a no-op.
+func (s *Store) Prepare(intent Intent) error {
+	if intent.TxnID == "" {
+		return fmt.Errorf("transaction id cannot be empty")
+	}
+
+	if intent.Version == 0 {
+		return fmt.Errorf("version cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.intents[intent.TxnID]; ok {
+		return nil
+	}
+
+	for k, expected := range intent.Reads {
+		if err := s.checkLock(k, intent.TxnID); err != nil {
+			return err
+		}
+
+		var current int64
+
+		if found, ok := s.lookup(k); ok && !found.Tombstone {
+			current = found.Version
+		}
+
+		if current != expected {
+			return fmt.Errorf("%q has version %d, read %d: %w", k, current, expected, ErrVersionMismatch)
+		}
+	}
+
+	for _, e := range intent.Writes {
+		if e.Key == "" {
+			return fmt.Errorf("key cannot be empty")
+		}
+
+		if err := s.checkLock(e.Key, intent.TxnID); err != nil {
+			return err
+		}
+
+		if found, ok := s.lookup(e.Key); ok && found.Version >= intent.Version {
+			return fmt.Errorf("%q has version %d, newer than %d: %w", e.Key, found.Version, intent.Version, ErrVersionMismatch)
+		}
+	}
+
+	intent.PreparedAt = time.Now().UnixNano()
+
+	if err := s.write(record{Op: prepareOp, TxnID: intent.TxnID, Intent: &intent}); err != nil {
+		return err
+	}
+
+	s.addIntent(intent)
+
+	return nil
+}
+
+// CommitIntent applies the writes of the prepared transaction and releases its
+// locks, in a single log record. Committing an unknown transaction is a no-op,
+// as it was already committed.
+func (s *Store) CommitIntent(txnID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	intent, ok := s.intents[txnID]
+	if !ok {
+		return nil
+	}
+
+	b := NewBatch()
+
+	for _, e := range intent.Writes {
+		if e.Tombstone {
+			b.Delete(e.Key, intent.Version)
+
+			continue
+		}
+
+		e.Version = intent.Version
+		b.Put(e)
+	}
+
+	entries, err := s.resolveBatch(b)
+	if err != nil {
+		return err
+	}
+
+	if err := s.write(record{Op: commitOp, TxnID: txnID, Entries: entries}); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		s.set(e)
+	}
+
+	s.removeIntent(txnID)
+
+	return nil
+}
+
+// AbortIntent drops the prepared transaction and releases its locks. Aborting
+// an unknown transaction is a no-op.
+func (s *Store) AbortIntent(txnID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.intents[txnID]; !ok {
+		return nil
+	}
+
+	if err := s.write(record{Op: abortOp, TxnID: txnID}); err != nil {
+		return err
+	}
+
+	s.removeIntent(txnID)
+
+	return nil
+}
+
+// Intents returns the prepared transactions, oldest first.
+func (s *Store) Intents() []Intent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Intent, 0, len(s.intents))
+
+	for _, intent := range s.intents {
+		out = append(out, intent)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].PreparedAt < out[j].PreparedAt
+	})
+
+	return out
+}
+
+func (s *Store) checkLock(k, txnID string) error {
+	if owner, ok := s.locks[k]; ok && owner != txnID {
+		return fmt.Errorf("%q by %s: %w", k, owner, ErrLocked)
+	}
+
+	return nil
+}
+
+func (s *Store) addIntent(intent Intent) {
+	s.intents[intent.TxnID] = intent
+
+	for k := range intent.Reads {
+		s.locks[k] = intent.TxnID
+	}
+
+	for _, e := range intent.Writes {
+		s.locks[e.Key] = intent.TxnID
+	}
+}
+
+func (s *Store) removeIntent(txnID string) {
+	intent, ok := s.intents[txnID]
+	if !ok {
+		return
+	}
+
+	for k := range intent.Reads {
+		if s.locks[k] == txnID {
+			delete(s.locks, k)
+		}
+	}
+
+	for _, e := range intent.Writes {
+		if s.locks[e.Key] == txnID {
+			delete(s.locks, e.Key)
+		}
+	}
+
+	delete(s.intents, txnID)
+}
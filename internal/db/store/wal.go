@@ -0,0 +1,364 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSegmentSize = 4 << 20
+	maxRecordSize      = 64 << 20
+
+	walDirSuffix  = ".wal"
+	segmentExt    = ".log"
+	frameHeadSize = 8
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt wal record")
+)
+
+type op uint8
+
+const (
+	putOp      op = 1
+	delOp      op = 2
+	snapshotOp op = 3
+	// batchOp records carry the entries of a batch, applied all at once
+	batchOp op = 4
+	// prepareOp, commitOp and abortOp records track the transaction intents,
+	// a commit record also carrying the entries the transaction wrote
+	prepareOp op = 5
+	commitOp  op = 6
+	abortOp   op = 7
+)
+
+// record is a single mutation as it is written to the log. Every record gets a
+// sequence number which is strictly increasing across segments.
+type record struct {
+	Seq   uint64 `json:"seq"`
+	Op    op     `json:"op"`
+	Entry Entry  `json:"entry"`
+	// Entries is only set for batch and commit records.
+	Entries []Entry `json:"entries,omitempty"`
+	// TxnID and Intent are only set for transaction records.
+	TxnID  string  `json:"txn,omitempty"`
+	Intent *Intent `json:"intent,omitempty"`
+	// Time is when the record was logged, in unix nanoseconds.
+	Time int64 `json:"time,omitempty"`
+}
+
+// wal is an append-only log split in segments. Each record is framed as
+// [length uint32][crc32c uint32][json payload].
+type wal struct {
+	dir         string
+	segmentSize int64
+	segments    []uint64
+	fd          *os.File
+	size        int64
+	seq         uint64
+	dirty       bool
+}
+
+func openWAL(dir string, segmentSize int64) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed creating wal dir %q: %w", dir, err)
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wal{
+		dir:         dir,
+		segmentSize: segmentSize,
+		segments:    segments,
+	}, nil
+}
+
+// replay reads every record newer than after in order and opens the last
+// segment for appending. A torn or corrupted record at the tail of the last segment is the result of
+// a crash in the middle of a write, so it is truncated away. Corruption in any
+// other place is reported as an error.
+func (w *wal) replay(after uint64, fn func(rec record) error) error {
+	defer func() {
+		if w.seq < after {
+			w.seq = after
+		}
+	}()
+
+	for i, first := range w.segments {
+		last := i == len(w.segments)-1
+
+		offset, err := w.replaySegment(first, after, fn)
+		if err != nil {
+			if !last || !errors.Is(err, errCorruptRecord) {
+				return err
+			}
+		}
+
+		if last {
+			return w.openSegment(first, offset)
+		}
+	}
+
+	if w.seq < after {
+		w.seq = after
+	}
+
+	return w.openSegment(w.seq+1, 0)
+}
+
+func (w *wal) replaySegment(first, after uint64, fn func(rec record) error) (int64, error) {
+	fd, err := os.Open(w.segmentPath(first))
+	if err != nil {
+		return 0, fmt.Errorf("failed opening segment: %w", err)
+	}
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+	var offset int64
+
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+
+		if err != nil {
+			return offset, fmt.Errorf("segment %d at offset %d: %w", first, offset, err)
+		}
+
+		if rec.Seq <= w.seq {
+			return offset, fmt.Errorf("segment %d at offset %d: %w: sequence %d out of order", first, offset, errCorruptRecord, rec.Seq)
+		}
+
+		if rec.Seq > after {
+			if err := fn(rec); err != nil {
+				return offset, err
+			}
+		}
+
+		w.seq = rec.Seq
+		offset += n
+	}
+}
+
+// append writes the record at the next sequence and returns the number of
+// bytes it took in the log.
+func (w *wal) append(rec *record) (int64, error) {
+	if w.fd == nil {
+		return 0, fmt.Errorf("wal is closed")
+	}
+
+	if w.size >= w.segmentSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	rec.Seq = w.seq + 1
+
+	frame, err := encodeRecord(*rec)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.fd.Write(frame)
+	w.size += int64(n)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed writing wal record: %w", err)
+	}
+
+	w.seq = rec.Seq
+	w.dirty = true
+
+	return int64(n), nil
+}
+
+func (w *wal) sync() error {
+	if w.fd == nil || !w.dirty {
+		return nil
+	}
+
+	if err := w.fd.Sync(); err != nil {
+		return fmt.Errorf("failed syncing wal: %w", err)
+	}
+
+	w.dirty = false
+
+	return nil
+}
+
+func (w *wal) close() error {
+	if w.fd == nil {
+		return nil
+	}
+
+	if err := w.sync(); err != nil {
+		return err
+	}
+
+	err := w.fd.Close()
+	w.fd = nil
+
+	return err
+}
+
+// compact removes the segments that only hold records up to seq. The segment
+// being written to is never removed.
+func (w *wal) compact(seq uint64) error {
+	keep := 0
+
+	for keep < len(w.segments)-1 && w.segments[keep+1] <= seq+1 {
+		if err := os.Remove(w.segmentPath(w.segments[keep])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed removing segment: %w", err)
+		}
+
+		keep++
+	}
+
+	w.segments = w.segments[keep:]
+
+	return nil
+}
+
+func (w *wal) rotate() error {
+	if w.size == 0 {
+		return nil
+	}
+
+	if err := w.sync(); err != nil {
+		return err
+	}
+
+	if err := w.fd.Close(); err != nil {
+		return fmt.Errorf("failed closing segment: %w", err)
+	}
+
+	return w.openSegment(w.seq+1, 0)
+}
+
+func (w *wal) openSegment(first uint64, offset int64) error {
+	fd, err := os.OpenFile(w.segmentPath(first), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed opening segment: %w", err)
+	}
+
+	if err := fd.Truncate(offset); err != nil {
+		_ = fd.Close()
+
+		return fmt.Errorf("failed truncating segment: %w", err)
+	}
+
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		_ = fd.Close()
+
+		return fmt.Errorf("failed seeking segment: %w", err)
+	}
+
+	if len(w.segments) == 0 || w.segments[len(w.segments)-1] != first {
+		w.segments = append(w.segments, first)
+	}
+
+	w.fd = fd
+	w.size = offset
+
+	return nil
+}
+
+func (w *wal) segmentPath(first uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading wal dir %q: %w", dir, err)
+	}
+
+	segments := make([]uint64, 0, len(files))
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, first)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	return segments, nil
+}
+
+func encodeRecord(rec record) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed json encoding wal record: %w", err)
+	}
+
+	frame := make([]byte, frameHeadSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[frameHeadSize:], payload)
+
+	return frame, nil
+}
+
+func readRecord(r io.Reader) (record, int64, error) {
+	var rec record
+
+	head := make([]byte, frameHeadSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		if err == io.EOF {
+			return rec, 0, io.EOF
+		}
+
+		return rec, 0, fmt.Errorf("%w: short header", errCorruptRecord)
+	}
+
+	size := binary.BigEndian.Uint32(head[0:4])
+	sum := binary.BigEndian.Uint32(head[4:8])
+
+	if size > maxRecordSize {
+		return rec, 0, fmt.Errorf("%w: record too large", errCorruptRecord)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, fmt.Errorf("%w: short payload", errCorruptRecord)
+	}
+
+	if crc32.Checksum(payload, crcTable) != sum {
+		return rec, 0, fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+	}
+
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, 0, fmt.Errorf("%w: %v", errCorruptRecord, err)
+	}
+
+	return rec, int64(frameHeadSize + len(payload)), nil
+}
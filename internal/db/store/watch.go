@@ -0,0 +1,62 @@
+package store
+
+import "strings"
+
+const watchBuffer = 256
+
+type watcher struct {
+	prefix string
+	ch     chan Entry
+}
+
+// Watch returns the entries stored from now on under keys having the prefix,
+// deletes being tombstones, and a function to stop watching. The channel is
+// closed when the store is closed, or when the watcher falls behind by more
+// than a few hundred entries, in which case it has to watch again.
+func (s *Store) Watch(prefix string) (<-chan Entry, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.watcherID++
+	id := s.watcherID
+	w := &watcher{prefix: prefix, ch: make(chan Entry, watchBuffer)}
+
+	if s.closed {
+		close(w.ch)
+
+		return w.ch, func() {}
+	}
+
+	s.watchers[id] = w
+
+	return w.ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.unwatch(id)
+	}
+}
+
+// notify sends the entry to the watchers of its key, dropping the ones whose
+// buffer is full rather than blocking the writes.
+func (s *Store) notify(e Entry) {
+	for id, w := range s.watchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+
+		select {
+		case w.ch <- e:
+		default:
+			s.logger.Error("watcher of %q fell behind, dropping it", w.prefix)
+			s.unwatch(id)
+		}
+	}
+}
+
+func (s *Store) unwatch(id int) {
+	if w, ok := s.watchers[id]; ok {
+		close(w.ch)
+		delete(s.watchers, id)
+	}
+}
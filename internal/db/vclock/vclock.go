@@ -0,0 +1,166 @@
+// Package vclock implements vector clocks, used to track causality between
+// writes made without coordination. Every actor owns a counter in the clock,
+// and a write descends from another one when its clock is greater or equal for
+// every actor.
+//
+// Values are stamped with dotted version vectors: the dot identifies the write
+// itself and the clock is the causal context it was written in. This way two
+// writes coordinated by the same actor from the same context are still seen as
+// concurrent.
+package vclock
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+type VectorClock map[string]uint64
+
+// Dot identifies a single write: the actor and the counter it assigned to it.
+type Dot struct {
+	Actor   string `json:"a"`
+	Counter uint64 `json:"c"`
+}
+
+// Dotted is the causal history of a value: the write that created it and the
+// context the write was based on.
+type Dotted struct {
+	Dot     Dot         `json:"d"`
+	Context VectorClock `json:"c,omitempty"`
+}
+
+// NewDotted stamps a write coordinated by actor in the given context. floor is
+// the highest counter of actor known by the coordinator.
+func NewDotted(actor string, floor uint64, context VectorClock) Dotted {
+	if context[actor] > floor {
+		floor = context[actor]
+	}
+
+	return Dotted{
+		Dot:     Dot{Actor: actor, Counter: floor + 1},
+		Context: context.Copy(),
+	}
+}
+
+// Obsoletes reports whether the value stamped with d replaces the one stamped
+// with other, meaning the writer of d had seen other.
+func (d Dotted) Obsoletes(other Dotted) bool {
+	return d.Context.Contains(other.Dot)
+}
+
+// Clock returns the context including the dot.
+func (d Dotted) Clock() VectorClock {
+	out := d.Context.Copy()
+
+	if d.Dot.Counter > out[d.Dot.Actor] {
+		out[d.Dot.Actor] = d.Dot.Counter
+	}
+
+	return out
+}
+
+func (d Dotted) Encode() []byte {
+	b, _ := json.Marshal(d)
+
+	return b
+}
+
+func DecodeDotted(b []byte) (Dotted, error) {
+	var d Dotted
+
+	if err := json.Unmarshal(b, &d); err != nil {
+		return d, fmt.Errorf("invalid clock: %w", err)
+	}
+
+	return d, nil
+}
+
+// Contains reports whether the write identified by the dot was seen.
+func (vc VectorClock) Contains(d Dot) bool {
+	return vc[d.Actor] >= d.Counter
+}
+
+// Merge returns the least clock descending from both clocks.
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	out := vc.Copy()
+
+	for actor, counter := range other {
+		if counter > out[actor] {
+			out[actor] = counter
+		}
+	}
+
+	return out
+}
+
+// Compare tells how vc is ordered relative to other.
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	var less, greater bool
+
+	for actor, counter := range vc {
+		if counter > other[actor] {
+			greater = true
+		}
+	}
+
+	for actor, counter := range other {
+		if counter > vc[actor] {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
+
+func (vc VectorClock) Copy() VectorClock {
+	out := make(VectorClock, len(vc))
+
+	for actor, counter := range vc {
+		out[actor] = counter
+	}
+
+	return out
+}
+
+// Encode serializes the clock into the opaque causal context handed to clients.
+func (vc VectorClock) Encode() []byte {
+	if len(vc) == 0 {
+		return nil
+	}
+
+	b, _ := json.Marshal(map[string]uint64(vc))
+
+	return b
+}
+
+func Decode(b []byte) (VectorClock, error) {
+	vc := make(VectorClock)
+
+	if len(b) == 0 {
+		return vc, nil
+	}
+
+	if err := json.Unmarshal(b, &vc); err != nil {
+		return nil, fmt.Errorf("invalid causal context: %w", err)
+	}
+
+	return vc, nil
+}
@@ -0,0 +1,90 @@
+package vclock_test
+
+import (
+	"testing"
+
+	"emag-homework/internal/db/vclock"
+	"emag-homework/pkg/test/require"
+)
+
+func TestVectorClock_Compare(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		a    vclock.VectorClock
+		b    vclock.VectorClock
+		want vclock.Ordering
+	}{
+		{
+			name: "equal",
+			a:    vclock.VectorClock{"a": 1, "b": 2},
+			b:    vclock.VectorClock{"a": 1, "b": 2},
+			want: vclock.Equal,
+		},
+		{
+			name: "empty clocks are equal",
+			a:    vclock.VectorClock{},
+			b:    nil,
+			want: vclock.Equal,
+		},
+		{
+			name: "before",
+			a:    vclock.VectorClock{"a": 1},
+			b:    vclock.VectorClock{"a": 1, "b": 1},
+			want: vclock.Before,
+		},
+		{
+			name: "after",
+			a:    vclock.VectorClock{"a": 2, "b": 1},
+			b:    vclock.VectorClock{"a": 1, "b": 1},
+			want: vclock.After,
+		},
+		{
+			name: "concurrent",
+			a:    vclock.VectorClock{"a": 2},
+			b:    vclock.VectorClock{"a": 1, "b": 1},
+			want: vclock.Concurrent,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tt.want, tt.a.Compare(tt.b))
+		})
+	}
+}
+
+func TestDotted_Obsoletes(t *testing.T) {
+	t.Parallel()
+
+	first := vclock.NewDotted("a", 0, nil)
+	require.Equal(t, vclock.Dot{Actor: "a", Counter: 1}, first.Dot)
+
+	// two writes coordinated by the same actor from the same context
+	second := vclock.NewDotted("a", 1, first.Clock())
+	third := vclock.NewDotted("a", 2, first.Clock())
+
+	require.True(t, second.Obsoletes(first), "second replaces first")
+	require.True(t, third.Obsoletes(first), "third replaces first")
+	require.False(t, third.Obsoletes(second), "concurrent")
+	require.False(t, second.Obsoletes(third), "concurrent")
+
+	merged := second.Clock().Merge(third.Clock())
+	resolved := vclock.NewDotted("b", 0, merged)
+
+	require.True(t, resolved.Obsoletes(second), "resolved replaces second")
+	require.True(t, resolved.Obsoletes(third), "resolved replaces third")
+
+	decoded, err := vclock.DecodeDotted(resolved.Encode())
+	require.NoError(t, err)
+	require.Equal(t, resolved, decoded, "encoding")
+
+	clock, err := vclock.Decode(merged.Encode())
+	require.NoError(t, err)
+	require.Equal(t, merged, clock, "encoding")
+}
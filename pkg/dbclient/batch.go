@@ -0,0 +1,73 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "emag-homework/internal/db/api/v1"
+)
+
+// Batch is a set of writes applied with a single call. Every replica applies
+// its part of a batch atomically.
+type Batch struct {
+	ops []*v1.BatchOp
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Put(key string, value []byte) *Batch {
+	b.ops = append(b.ops, &v1.BatchOp{Type: v1.BatchOp_BATCH_OP_PUT, Key: key, Value: value})
+
+	return b
+}
+
+func (b *Batch) Delete(key string) *Batch {
+	b.ops = append(b.ops, &v1.BatchOp{Type: v1.BatchOp_BATCH_OP_DELETE, Key: key})
+
+	return b
+}
+
+// Increment adds the delta to the counter of the key, see Client.Increment.
+func (b *Batch) Increment(key string, delta int64) *Batch {
+	b.ops = append(b.ops, &v1.BatchOp{Type: v1.BatchOp_BATCH_OP_INCREMENT, Key: key, Delta: delta})
+
+	return b
+}
+
+// IncrementCounter adds the delta to the PN-counter of the key, see
+// Client.IncrementCounter.
+func (b *Batch) IncrementCounter(key string, delta int64) *Batch {
+	b.ops = append(b.ops, &v1.BatchOp{Type: v1.BatchOp_BATCH_OP_INCREMENT_COUNTER, Key: key, Delta: delta})
+
+	return b
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Batch applies the writes of the batch.
+func (c *Client) Batch(ctx context.Context, b *Batch, opts ...CallOption) error {
+	if c.client == nil {
+		return errors.New("closed connection")
+	}
+
+	if b.Len() == 0 {
+		return nil
+	}
+
+	cfg := newCallConfig(opts)
+
+	_, err := c.client.Batch(ctx, &v1.BatchRequest{
+		Ops:         b.ops,
+		Consistency: cfg.Consistency,
+	})
+	if err != nil {
+		return fmt.Errorf("batch failed: %w", err)
+	}
+
+	return nil
+}
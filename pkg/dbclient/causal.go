@@ -0,0 +1,60 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "emag-homework/internal/db/api/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Resolver merges the concurrent values of a key into a single value.
+type Resolver func(key string, siblings [][]byte) ([]byte, error)
+
+// Object is a key read in causal mode.
+type Object struct {
+	// Siblings are the concurrent values of the key.
+	Siblings [][]byte
+	// Context is the opaque causal context to write the merged value with.
+	Context []byte
+}
+
+// GetObject returns every concurrent value of the key with its causal context.
+func (c *Client) GetObject(ctx context.Context, key string, opts ...CallOption) (*Object, error) {
+	if c.client == nil {
+		return nil, errors.New("closed connection")
+	}
+
+	cfg := newCallConfig(opts)
+
+	res, err := c.client.Get(ctx, &v1.GetRequest{
+		Key:         key,
+		Consistency: cfg.Consistency,
+	})
+	if err != nil {
+		if s := status.Convert(err); s != nil && s.Code() == codes.NotFound {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("get failed: %w", err)
+	}
+
+	obj := &Object{
+		Context: res.Context,
+	}
+
+	if len(res.Siblings) == 0 {
+		obj.Siblings = [][]byte{res.Value}
+
+		return obj, nil
+	}
+
+	for _, sib := range res.Siblings {
+		obj.Siblings = append(obj.Siblings, sib.Value)
+	}
+
+	return obj, nil
+}
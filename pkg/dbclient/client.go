@@ -3,41 +3,116 @@ package dbclient
 import (
 	"context"
 	v1 "emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/controller/redirect"
 	"errors"
 	"fmt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"strings"
 	"sync"
 	"time"
 )
 
-var ErrNotFound = errors.New("not found")
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrVersionMismatch is returned by a Put made WithExpectedVersion when
+	// the key is at another version.
+	ErrVersionMismatch = errors.New("version mismatch")
+	// ErrSuperseded is returned by a Put dropped because the key already had
+	// a newer value.
+	ErrSuperseded = errors.New("superseded by a newer version")
+)
+
+// Item is a value along with its version.
+type Item struct {
+	Value   []byte
+	Version int64
+	// ExpiresAt is zero for a value that does not expire.
+	ExpiresAt time.Time
+}
 
 type Client struct {
-	mu     sync.Mutex
-	conn   *grpc.ClientConn
-	client v1.ControllerClient
+	mu       sync.Mutex
+	conn     *redirect.Conn
+	client   v1.ControllerClient
+	resolver Resolver
 }
 
-func New(addr string) (*Client, error) {
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+// New connects to the controller at addr, and to the ones given
+// WithControllers to fail over to.
+func New(addr string, opts ...Option) (*Client, error) {
+	cfg := &Config{}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	conn, err := redirect.Dial(append([]string{addr}, cfg.Controllers...), grpc.WithInsecure())
 	if err != nil {
 		return nil, err
 	}
 
 	return &Client{
-		conn:   conn,
-		client: v1.NewControllerClient(conn),
+		conn:     conn,
+		client:   v1.NewControllerClient(conn),
+		resolver: cfg.Resolver,
 	}, nil
 }
 
-func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+// Get returns the value of the key. When the client has a resolver, the
+// concurrent values of the key are merged with it and the result is written
+// back.
+func (c *Client) Get(ctx context.Context, key string, opts ...CallOption) ([]byte, error) {
+	if c.resolver == nil {
+		return c.get(ctx, key, opts...)
+	}
+
+	obj, err := c.GetObject(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(obj.Siblings) == 1 {
+		return obj.Siblings[0], nil
+	}
+
+	value, err := c.resolver(key, obj.Siblings)
+	if err != nil {
+		return nil, fmt.Errorf("failed resolving siblings: %w", err)
+	}
+
+	opts = append(opts, WithCausalContext(obj.Context))
+
+	if err := c.Put(ctx, key, value, opts...); err != nil {
+		return nil, fmt.Errorf("failed writing back resolved value: %w", err)
+	}
+
+	return value, nil
+}
+
+func (c *Client) get(ctx context.Context, key string, opts ...CallOption) ([]byte, error) {
+	item, err := c.GetItem(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return item.Value, nil
+}
+
+// GetItem returns the value of the key with its version, to be used with
+// WithExpectedVersion.
+func (c *Client) GetItem(ctx context.Context, key string, opts ...CallOption) (*Item, error) {
 	if c.client == nil {
 		return nil, errors.New("closed connection")
 	}
 
-	res, err := c.client.Get(ctx, &v1.GetRequest{Key: key})
+	cfg := newCallConfig(opts)
+
+	res, err := c.client.Get(ctx, &v1.GetRequest{
+		Key:         key,
+		Consistency: cfg.Consistency,
+	})
 	if err != nil {
 		if s := status.Convert(err); s != nil && s.Code() == codes.NotFound {
 			return nil, ErrNotFound
@@ -46,26 +121,156 @@ func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
 		return nil, fmt.Errorf("get failed: %w", err)
 	}
 
-	return res.Value, err
+	item := &Item{Value: res.Value, Version: res.Version}
+
+	if res.ExpiresAt != 0 {
+		item.ExpiresAt = time.Unix(0, res.ExpiresAt)
+	}
+
+	return item, nil
 }
 
-func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+// ttlMillis converts the ttl to milliseconds, rounding away from zero, so a
+// ttl under a millisecond still expires the value instead of meaning none.
+func ttlMillis(ttl time.Duration) int64 {
+	ms := ttl.Milliseconds()
+
+	switch {
+	case ttl > 0 && ttl%time.Millisecond != 0:
+		ms++
+	case ttl < 0 && ttl%time.Millisecond != 0:
+		ms--
+	}
+
+	return ms
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+// Put writes the value of the key. When the client has a resolver, or when a
+// causal context is given, the value is written in causal mode: it replaces
+// the values seen in the context and is kept next to the concurrent ones.
+// ErrSuperseded is returned when the value was dropped for a newer one.
+func (c *Client) Put(ctx context.Context, key string, value []byte, opts ...CallOption) error {
 	if c.client == nil {
 		return errors.New("closed connection")
 	}
 
-	_, err := c.client.Put(ctx, &v1.PutRequest{
-		Key:     key,
-		Value:   value,
-		Version: time.Now().UnixNano(),
+	cfg := newCallConfig(opts)
+
+	res, err := c.client.Put(ctx, &v1.PutRequest{
+		Key:             key,
+		Value:           value,
+		Consistency:     cfg.Consistency,
+		Causal:          c.resolver != nil || cfg.CausalContext != nil,
+		Context:         cfg.CausalContext,
+		Cas:             cfg.CAS,
+		ExpectedVersion: cfg.ExpectedVersion,
+		Ttl:             ttlMillis(cfg.TTL),
+		ExpiresAt:       unixNano(cfg.ExpiresAt),
 	})
 	if err != nil {
+		if isVersionMismatch(err) {
+			msg := strings.TrimSuffix(status.Convert(err).Message(), ": "+ErrVersionMismatch.Error())
+
+			return fmt.Errorf("%s: %w", msg, ErrVersionMismatch)
+		}
+
 		return fmt.Errorf("put failed: %w", err)
 	}
 
+	if res.Superseded {
+		return ErrSuperseded
+	}
+
+	return nil
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if c.client == nil {
+		return errors.New("closed connection")
+	}
+
+	_, err := c.client.Delete(ctx, &v1.DeleteRequest{Key: key})
+	if err != nil {
+		return fmt.Errorf("delete failed: %w", err)
+	}
+
 	return nil
 }
 
+// Increment atomically adds the delta to the counter of the key and returns
+// the new value. A missing key starts from 0.
+func (c *Client) Increment(ctx context.Context, key string, delta int64, opts ...CallOption) (int64, error) {
+	if c.client == nil {
+		return 0, errors.New("closed connection")
+	}
+
+	cfg := newCallConfig(opts)
+
+	res, err := c.client.Increment(ctx, &v1.IncrementRequest{
+		Key:         key,
+		Delta:       delta,
+		Consistency: cfg.Consistency,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("increment failed: %w", err)
+	}
+
+	return res.Value, nil
+}
+
+// IncrementCounter adds the delta to the PN-counter of the key and returns
+// its new total. Unlike Increment, the updates made while replicas are
+// partitioned are all kept once they merge.
+func (c *Client) IncrementCounter(ctx context.Context, key string, delta int64, opts ...CallOption) (int64, error) {
+	if c.client == nil {
+		return 0, errors.New("closed connection")
+	}
+
+	cfg := newCallConfig(opts)
+
+	res, err := c.client.IncrementCounter(ctx, &v1.IncrementCounterRequest{
+		Key:         key,
+		Delta:       delta,
+		Consistency: cfg.Consistency,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("increment counter failed: %w", err)
+	}
+
+	return res.Value, nil
+}
+
+// Counter returns the total of the PN-counter of the key.
+func (c *Client) Counter(ctx context.Context, key string, opts ...CallOption) (int64, error) {
+	if c.client == nil {
+		return 0, errors.New("closed connection")
+	}
+
+	cfg := newCallConfig(opts)
+
+	res, err := c.client.GetCounter(ctx, &v1.GetCounterRequest{
+		Key:         key,
+		Consistency: cfg.Consistency,
+	})
+	if err != nil {
+		if s := status.Convert(err); s != nil && s.Code() == codes.NotFound {
+			return 0, ErrNotFound
+		}
+
+		return 0, fmt.Errorf("get counter failed: %w", err)
+	}
+
+	return res.Value, nil
+}
+
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -80,3 +285,12 @@ func (c *Client) Close() error {
 
 	return c.conn.Close()
 }
+
+// isVersionMismatch tells whether the write failed on the expected version.
+// The other preconditions failing, such as a key locked by a transaction,
+// have the same code but not the message ending of the version mismatches.
+func isVersionMismatch(err error) bool {
+	s := status.Convert(err)
+
+	return s.Code() == codes.FailedPrecondition && strings.HasSuffix(s.Message(), ErrVersionMismatch.Error())
+}
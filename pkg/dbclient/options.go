@@ -0,0 +1,103 @@
+package dbclient
+
+import (
+	"time"
+
+	v1 "emag-homework/internal/db/api/v1"
+)
+
+// Consistency is how many replicas must answer before a call succeeds.
+type Consistency = v1.Consistency
+
+const (
+	// ConsistencyDefault uses the level configured on the controller.
+	ConsistencyDefault = v1.Consistency_CONSISTENCY_DEFAULT
+	ConsistencyOne     = v1.Consistency_CONSISTENCY_ONE
+	ConsistencyQuorum  = v1.Consistency_CONSISTENCY_QUORUM
+	ConsistencyAll     = v1.Consistency_CONSISTENCY_ALL
+)
+
+type Config struct {
+	Resolver    Resolver
+	Controllers []string
+}
+
+type Option func(cfg *Config)
+
+// WithResolver switches the client to causal mode, the resolver being used to
+// merge the concurrent values found on Get.
+func WithResolver(resolver Resolver) Option {
+	return func(cfg *Config) {
+		cfg.Resolver = resolver
+	}
+}
+
+// WithControllers adds the addresses of other controllers of the cluster, the
+// calls failing over to them.
+func WithControllers(addrs ...string) Option {
+	return func(cfg *Config) {
+		cfg.Controllers = append(cfg.Controllers, addrs...)
+	}
+}
+
+type CallConfig struct {
+	Consistency     Consistency
+	CausalContext   []byte
+	CAS             bool
+	ExpectedVersion int64
+	TTL             time.Duration
+	ExpiresAt       time.Time
+}
+
+type CallOption func(cfg *CallConfig)
+
+// WithConsistency sets the consistency level of a single call.
+func WithConsistency(level Consistency) CallOption {
+	return func(cfg *CallConfig) {
+		cfg.Consistency = level
+	}
+}
+
+// WithCausalContext writes in causal mode, the value replacing the values read
+// with the context.
+func WithCausalContext(context []byte) CallOption {
+	return func(cfg *CallConfig) {
+		cfg.CausalContext = context
+	}
+}
+
+// WithExpectedVersion only writes if the key is still at the version, as
+// returned by GetItem. Version 0 only writes if the key does not exist.
+func WithExpectedVersion(version int64) CallOption {
+	return func(cfg *CallConfig) {
+		cfg.CAS = true
+		cfg.ExpectedVersion = version
+	}
+}
+
+// WithTTL makes the value written expire after the duration, with
+// millisecond precision, rounded up.
+func WithTTL(ttl time.Duration) CallOption {
+	return func(cfg *CallConfig) {
+		cfg.TTL = ttl
+	}
+}
+
+// WithExpiresAt makes the value written expire at the given time.
+func WithExpiresAt(t time.Time) CallOption {
+	return func(cfg *CallConfig) {
+		cfg.ExpiresAt = t
+	}
+}
+
+func newCallConfig(opts []CallOption) *CallConfig {
+	cfg := &CallConfig{
+		Consistency: ConsistencyDefault,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
@@ -0,0 +1,176 @@
+package dbclient
+
+import (
+	"context"
+	"io"
+
+	v1 "emag-homework/internal/db/api/v1"
+)
+
+type ScanConfig struct {
+	Start    string
+	End      string
+	Prefix   string
+	PageSize int
+}
+
+type ScanOption func(cfg *ScanConfig)
+
+// WithRange scans the keys from start, included, to end, excluded. An empty
+// end means no bound.
+func WithRange(start, end string) ScanOption {
+	return func(cfg *ScanConfig) {
+		cfg.Start = start
+		cfg.End = end
+	}
+}
+
+// WithPrefix scans the keys having the prefix.
+func WithPrefix(prefix string) ScanOption {
+	return func(cfg *ScanConfig) {
+		cfg.Prefix = prefix
+	}
+}
+
+// WithPageSize sets how many keys are fetched per call, the controller
+// default being used otherwise.
+func WithPageSize(size int) ScanOption {
+	return func(cfg *ScanConfig) {
+		cfg.PageSize = size
+	}
+}
+
+// Iterator walks the keys of a scan in key order, fetching them page by page.
+//
+//	it := client.Scan(ctx, dbclient.WithPrefix("user/"))
+//	defer it.Close()
+//
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	client v1.ControllerClient
+	req    *v1.ScanRequest
+	stream v1.Controller_ScanClient
+	items  []*v1.ScanItem
+	item   *v1.ScanItem
+	done   bool
+	err    error
+}
+
+// Scan returns an iterator over the keys matching the options, all the keys
+// when there is none.
+func (c *Client) Scan(ctx context.Context, opts ...ScanOption) *Iterator {
+	cfg := &ScanConfig{}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &Iterator{
+		ctx:    ctx,
+		cancel: cancel,
+		client: c.client,
+		req: &v1.ScanRequest{
+			Start:  cfg.Start,
+			End:    cfg.End,
+			Prefix: cfg.Prefix,
+			Limit:  int32(cfg.PageSize),
+		},
+	}
+}
+
+// Next moves to the next key, returning false when the scan is over or
+// failed, see Err.
+func (it *Iterator) Next() bool {
+	for len(it.items) == 0 {
+		if it.done || it.err != nil {
+			it.item = nil
+
+			return false
+		}
+
+		it.fetch()
+	}
+
+	it.item = it.items[0]
+	it.items = it.items[1:]
+
+	return true
+}
+
+// fetch receives the next chunk of the page, requesting the next page once
+// the current one is over.
+func (it *Iterator) fetch() {
+	if it.stream == nil {
+		it.stream, it.err = it.client.Scan(it.ctx, it.req)
+		if it.err != nil {
+			return
+		}
+
+		it.req.PageToken = ""
+	}
+
+	res, err := it.stream.Recv()
+	if err == io.EOF {
+		it.stream = nil
+		it.done = it.req.PageToken == ""
+
+		return
+	}
+
+	if err != nil {
+		it.err = err
+
+		return
+	}
+
+	it.items = res.Items
+
+	if res.NextPageToken != "" {
+		it.req.PageToken = res.NextPageToken
+	}
+}
+
+func (it *Iterator) Key() string {
+	if it.item == nil {
+		return ""
+	}
+
+	return it.item.Key
+}
+
+func (it *Iterator) Value() []byte {
+	if it.item == nil {
+		return nil
+	}
+
+	return it.item.Value
+}
+
+func (it *Iterator) Version() int64 {
+	if it.item == nil {
+		return 0
+	}
+
+	return it.item.Version
+}
+
+// Err returns the error the scan stopped on, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close ends the scan, releasing its stream.
+func (it *Iterator) Close() {
+	it.done = true
+	it.cancel()
+}
@@ -0,0 +1,211 @@
+package dbclient
+
+import (
+	"context"
+	"time"
+
+	v1 "emag-homework/internal/db/api/v1"
+	"emag-homework/internal/db/hlc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRetryInterval = time.Second
+	// defaultResumeWindow covers the time a write takes to reach the nodes,
+	// the controllers giving up on a replica after 5s by default
+	defaultResumeWindow = time.Second * 10
+)
+
+type EventType int
+
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+)
+
+// Event is a change of a key. Value is empty for deletes.
+type Event struct {
+	Type    EventType
+	Key     string
+	Value   []byte
+	Version int64
+}
+
+type WatchConfig struct {
+	FromVersion   int64
+	RetryInterval time.Duration
+	ResumeWindow  time.Duration
+}
+
+type WatchOption func(cfg *WatchConfig)
+
+// WithFromVersion starts the watch with the keys changed after the version,
+// at their latest version, such as the version of the last event received by
+// a previous watch.
+func WithFromVersion(version int64) WatchOption {
+	return func(cfg *WatchConfig) {
+		cfg.FromVersion = version
+	}
+}
+
+// WithRetryInterval sets how long to wait before reconnecting an interrupted
+// watch.
+func WithRetryInterval(interval time.Duration) WatchOption {
+	return func(cfg *WatchConfig) {
+		cfg.RetryInterval = interval
+	}
+}
+
+// WithResumeWindow sets how far before the last version received an
+// interrupted watch resumes. The versions are issued before the writes reach
+// the nodes, so a change with a lower version than one already received may
+// still be in flight, on another node, when the watch is interrupted.
+func WithResumeWindow(window time.Duration) WatchOption {
+	return func(cfg *WatchConfig) {
+		cfg.ResumeWindow = window
+	}
+}
+
+// Watch returns the changes of the key until the context is done, the channel
+// being closed then. An interrupted watch is reconnected and resumed from the
+// resume window before the last version received, the changes sent again
+// being dropped. The changes missed meanwhile are sent at the latest version
+// of their key, so the intermediate ones are skipped, and a change reaching
+// the nodes later than the resume window is missed.
+func (c *Client) Watch(ctx context.Context, key string, opts ...WatchOption) <-chan Event {
+	return c.watch(ctx, &v1.WatchRequest{Key: key}, opts)
+}
+
+// WatchPrefix is Watch for the keys having the prefix.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, opts ...WatchOption) <-chan Event {
+	return c.watch(ctx, &v1.WatchRequest{Prefix: prefix}, opts)
+}
+
+func (c *Client) watch(ctx context.Context, req *v1.WatchRequest, opts []WatchOption) <-chan Event {
+	cfg := &WatchConfig{
+		RetryInterval: defaultRetryInterval,
+		ResumeWindow:  defaultResumeWindow,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	req.FromVersion = cfg.FromVersion
+	eventCh := make(chan Event)
+	w := &watcher{sent: make(map[string]int64), window: cfg.ResumeWindow}
+
+	go func() {
+		defer close(eventCh)
+
+		if c.client == nil {
+			return
+		}
+
+		for {
+			err := c.watchOnce(ctx, req, w, eventCh)
+			if ctx.Err() != nil || status.Code(err) == codes.InvalidArgument {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cfg.RetryInterval):
+			}
+
+			req.FromVersion = w.resumeFrom(cfg.FromVersion)
+		}
+	}()
+
+	return eventCh
+}
+
+// watcher is what a watch received so far.
+type watcher struct {
+	// sent is the last version sent of the keys changed within the window
+	// before the last version received
+	sent   map[string]int64
+	last   int64
+	window time.Duration
+	// floor is the version the keys were last forgotten below
+	floor int64
+}
+
+// resumeFrom returns the version the watch resumes from: the window before the
+// last version received, and never before the first version asked.
+func (w *watcher) resumeFrom(first int64) int64 {
+	w.forget()
+
+	if w.floor > first {
+		return w.floor
+	}
+
+	return first
+}
+
+// forget forgets the keys sent before the window preceding the last version
+// received, so the keys sent are bounded by the window.
+func (w *watcher) forget() {
+	if w.last == 0 {
+		return
+	}
+
+	w.floor = hlc.FromTime(hlc.Time(w.last).Add(-w.window))
+
+	for k, version := range w.sent {
+		if version <= w.floor {
+			delete(w.sent, k)
+		}
+	}
+}
+
+// watchOnce streams the events until the watch fails, dropping the ones
+// already sent.
+func (c *Client) watchOnce(ctx context.Context, req *v1.WatchRequest, w *watcher, eventCh chan<- Event) error {
+	stream, err := c.client.Watch(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if res.Version <= w.sent[res.Key] {
+			continue
+		}
+
+		event := Event{
+			Type:    EventPut,
+			Key:     res.Key,
+			Value:   res.Value,
+			Version: res.Version,
+		}
+
+		if res.Type == v1.WatchEvent_WATCH_EVENT_DELETE {
+			event.Type = EventDelete
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case eventCh <- event:
+		}
+
+		w.sent[res.Key] = res.Version
+
+		if res.Version > w.last {
+			w.last = res.Version
+		}
+
+		// forgotten once per window
+		if hlc.Time(w.last).Sub(hlc.Time(w.floor)) >= 2*w.window {
+			w.forget()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TmpSuffix is appended to the name of a file to write the data before it
+// replaces the file. It is left behind by a crash in between.
+const TmpSuffix = ".tmp"
+
+// WriteFile replaces the file with the data, so a crash leaves either the old
+// or the new content. Both the file and its dir are synced before returning.
+func WriteFile(filename string, b []byte) error {
+	tmp := filename + TmpSuffix
+
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed creating %q: %w", tmp, err)
+	}
+
+	_, err = fd.Write(b)
+	if err == nil {
+		err = fd.Sync()
+	}
+
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+
+		return fmt.Errorf("failed writing %q: %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed replacing %q: %w", filename, err)
+	}
+
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return fmt.Errorf("failed opening dir of %q: %w", filename, err)
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}